@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const adminRequestHeader = "X-Admin-Request"
+
+// The admin API listens on admin_address:
+//
+//	GET    /overrides                                         lists the overrides in effect
+//	POST   /overrides?domain=vk.com&duration=15m[&client=IP]  allows a domain for a while
+//	DELETE /overrides?domain=vk.com[&client=IP]               blocks it again
+//	GET    /stats[?top=10]                                    reports the blocking statistics
+//	DELETE /stats                                             resets them
+//	GET    /stats/unused[?offset=0&limit=100]                 lists the rules which never blocked
+//
+// With admin_token set, the requests must carry it as "Authorization: Bearer <token>".
+// Without it the API may only listen on a loopback address, and the changes must carry the
+// adminRequestHeader: a web page can post to a loopback address, but not with such a header.
+func (server DnsProxyServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/overrides", server.handleOverrides)
+	mux.HandleFunc("/stats", server.handleStats)
+	mux.HandleFunc("/stats/unused", server.handleUnusedRules)
+	token := server.config.adminToken
+	if token == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get(adminRequestHeader) == "" {
+				http.Error(w, "missing "+adminRequestHeader+" header", http.StatusForbidden)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackAddress tells whether a listening address only accepts local connections.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (server DnsProxyServer) runAdmin() {
+	fmt.Println("Admin API is running on", server.config.adminAddress)
+	err := http.ListenAndServe(server.config.adminAddress, server.adminHandler())
+	exitOnError(err, "Failed to run admin API: %v\n")
+}
+
+func (server DnsProxyServer) handleOverrides(w http.ResponseWriter, r *http.Request) {
+	overrides := server.config.overrides
+	now := server.config.now()
+
+	var client net.IP
+	if value := r.URL.Query().Get("client"); value != "" {
+		if client = net.ParseIP(value); client == nil {
+			http.Error(w, "invalid client address", http.StatusBadRequest)
+			return
+		}
+	}
+	domain := r.URL.Query().Get("domain")
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, server.displayOverrides(overrides.active(now)))
+	case http.MethodPost:
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if domain == "" || err != nil || duration <= 0 {
+			http.Error(w, "domain and a positive duration are required", http.StatusBadRequest)
+			return
+		}
+		if err := overrides.allow(domain, client, now.Add(duration)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Println("Override added:", server.config.displayName(normalizeName(domain)), "client:", client, "for", duration)
+		writeJSON(w, server.displayOverrides(overrides.active(now)))
+	case http.MethodDelete:
+		if domain == "" {
+			http.Error(w, "domain is required", http.StatusBadRequest)
+			return
+		}
+		if err := overrides.remove(domain, client); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Println("Override removed:", server.config.displayName(normalizeName(domain)), "client:", client)
+		writeJSON(w, server.displayOverrides(overrides.active(now)))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (server DnsProxyServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	top := defaultStatsTop
+	if value := r.URL.Query().Get("top"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number <= 0 {
+			http.Error(w, "top must be a positive number", http.StatusBadRequest)
+			return
+		}
+		top = number
+	}
+
+	stats := server.config.stats
+	switch r.Method {
+	case http.MethodGet:
+		report := stats.report(server.config.blocklists, top)
+		for i := range report.Domains {
+			report.Domains[i].Name = server.config.displayName(report.Domains[i].Name)
+		}
+		writeJSON(w, report)
+	case http.MethodDelete:
+		stats.reset(server.config.now())
+		fmt.Println("Stats reset")
+		writeJSON(w, stats.report(server.config.blocklists, top))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (server DnsProxyServer) handleUnusedRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	offset, limit := 0, defaultUnusedLimit
+	if value := r.URL.Query().Get("offset"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			http.Error(w, "offset must be a number", http.StatusBadRequest)
+			return
+		}
+		offset = number
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number <= 0 || number > maxUnusedLimit {
+			http.Error(w, fmt.Sprintf("limit must be a number from 1 to %d", maxUnusedLimit), http.StatusBadRequest)
+			return
+		}
+		limit = number
+	}
+	writeJSON(w, server.config.stats.unusedRules(server.config.blocklists, offset, limit))
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (server DnsProxyServer) displayOverrides(overrides []Override) []Override {
+	for i := range overrides {
+		overrides[i].Domain = server.config.displayName(overrides[i].Domain)
+	}
+	return overrides
+}
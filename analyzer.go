@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AnalyzerAction int
+
+const (
+	AnalyzerOff AnalyzerAction = iota
+	AnalyzerLog
+	AnalyzerAlert
+	AnalyzerBlock
+)
+
+var analyzerActionNames = map[string]AnalyzerAction{
+	"off":   AnalyzerOff,
+	"log":   AnalyzerLog,
+	"alert": AnalyzerAlert,
+	"block": AnalyzerBlock,
+}
+
+const (
+	defaultAnalyzerThreshold   = 0.6
+	defaultAnalyzerWindow      = time.Minute
+	defaultMaxUniqueSubdomains = 50
+	maxTrackedParents          = 10000
+)
+
+// commonBigrams are frequent letter pairs of English text, names made of words use mostly these.
+var commonBigrams = toSet(strings.Fields(`
+th he in er an re on at en nd ti es or te of ed is it al ar st to nt ng se ha as ou io le
+ve co me de hi ri ro ic ne ea ra ce li ch ll be ma si om ur ca el ta la ns di fo ho pe ec
+pr no ct us ac ot il tr ly nc et ut ss so rs un lo wa ge ie wh ee wi em ad ol rt po we na
+ul ni ts mo ow pa im mi ai sh ir su id os iv ia am fi ci vi pl ig tu ev ld ry mp fe bl ab
+gh ty op wo sa ay ex ke fr oo av ag if ap gr od bo sp rd do uc bu ei ov by rm ep tt oc fa
+ef cu rn sc gi da yo cr cl du ga qu ue ff ba ey ls va um pp ua up lu go ht ru ug ds lt pi
+rc rr eg au ck ew mu br bi pt ak pu ui rg ib tl ny ki rk ys ob mm fu ph og ms ye ud mb ip
+ub oi rl gu dr hr cc tw ft wn nu af hu nn eo vo rv nf xp gn sm fl iz ok nl my gl aw ju oa
+eq sy sl ps jo lf nv je nk kn gs dy hy ze ks xt bs ik dd cy rp sk
+`))
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// Analyzer scores query names for algorithmically generated domains and DNS tunneling.
+type Analyzer struct {
+	action              AnalyzerAction
+	threshold           float64
+	window              time.Duration
+	maxUniqueSubdomains int
+	webhook             string
+
+	mutex      sync.Mutex
+	subdomains map[string]*subdomainSet // by client and parent domain
+	swept      time.Time
+}
+
+// subdomainSet holds the subdomains a client asked under a parent domain with the time they were last seen.
+type subdomainSet struct {
+	names    map[string]time.Time
+	lastSeen time.Time
+}
+
+type AnalyzerVerdict struct {
+	Name    string             `json:"name"`
+	Client  string             `json:"client"`
+	Score   float64            `json:"score"`
+	Signals map[string]float64 `json:"signals"`
+}
+
+func (verdict AnalyzerVerdict) String() string {
+	var signals []string
+	for name, value := range verdict.Signals {
+		if value > 0 {
+			signals = append(signals, fmt.Sprintf("%s=%.2f", name, value))
+		}
+	}
+	sort.Strings(signals)
+	return fmt.Sprintf("score %.2f (%s)", verdict.Score, strings.Join(signals, ", "))
+}
+
+func NewAnalyzer(action AnalyzerAction, threshold float64, window time.Duration, maxUniqueSubdomains int) *Analyzer {
+	return &Analyzer{
+		action:              action,
+		threshold:           threshold,
+		window:              window,
+		maxUniqueSubdomains: maxUniqueSubdomains,
+		subdomains:          make(map[string]*subdomainSet),
+	}
+}
+
+func (analyzer *Analyzer) isEnabled() bool {
+	return analyzer != nil && analyzer.action != AnalyzerOff
+}
+
+// analyze scores the name, the verdict is suspicious when its score reaches the threshold.
+func (analyzer *Analyzer) analyze(qname string, client string, now time.Time) (verdict AnalyzerVerdict, suspicious bool) {
+	qname = strings.ToLower(qname)
+	labels := strings.Split(qname, ".")
+	if len(labels) > 1 {
+		labels = labels[:len(labels)-1]
+	}
+	longest := ""
+	for _, label := range labels {
+		if len(label) > len(longest) {
+			longest = label
+		}
+	}
+
+	signals := map[string]float64{
+		"entropy":    clamp((shannonEntropy(longest) - 3.0) / 1.0),
+		"length":     math.Max(clamp(float64(len(longest)-24)/24), clamp(float64(len(qname)-100)/100)),
+		"consonants": clamp(float64(longestConsonantRun(longest)-4) / 4),
+		"ngrams":     clamp((0.6 - commonBigramRatio(longest)) / 0.6),
+		"subdomains": analyzer.uniqueSubdomainRate(qname, client, now),
+	}
+	lexical := 0.35*signals["entropy"] + 0.2*signals["length"] + 0.15*signals["consonants"] + 0.3*signals["ngrams"]
+	score := math.Max(lexical, signals["subdomains"])
+
+	verdict = AnalyzerVerdict{Name: qname, Client: client, Score: score, Signals: signals}
+	return verdict, score >= analyzer.threshold
+}
+
+// uniqueSubdomainRate tracks the distinct names a client asked under a registrable domain within the window,
+// relative to the configured maximum.
+func (analyzer *Analyzer) uniqueSubdomainRate(qname string, client string, now time.Time) float64 {
+	parent := registrableDomain(qname)
+	if parent == qname {
+		return 0
+	}
+	analyzer.mutex.Lock()
+	defer analyzer.mutex.Unlock()
+
+	if now.Sub(analyzer.swept) > analyzer.window {
+		analyzer.sweepLocked(now)
+	}
+	key := client + "|" + parent
+	seen, ok := analyzer.subdomains[key]
+	if !ok {
+		if len(analyzer.subdomains) >= maxTrackedParents {
+			analyzer.evictLocked()
+		}
+		seen = &subdomainSet{names: make(map[string]time.Time)}
+		analyzer.subdomains[key] = seen
+	}
+	seen.names[qname] = now
+	seen.lastSeen = now
+	for name, lastSeen := range seen.names {
+		if now.Sub(lastSeen) > analyzer.window {
+			delete(seen.names, name)
+		}
+	}
+	return clamp(float64(len(seen.names)) / float64(analyzer.maxUniqueSubdomains))
+}
+
+// sweepLocked forgets the parent domains not asked for within the window, once per window.
+func (analyzer *Analyzer) sweepLocked(now time.Time) {
+	analyzer.swept = now
+	for key, seen := range analyzer.subdomains {
+		if now.Sub(seen.lastSeen) > analyzer.window {
+			delete(analyzer.subdomains, key)
+		}
+	}
+}
+
+// evictLocked forgets the least recently asked parent domain to make room for another one.
+func (analyzer *Analyzer) evictLocked() {
+	var oldest string
+	for key, seen := range analyzer.subdomains {
+		if oldest == "" || seen.lastSeen.Before(analyzer.subdomains[oldest].lastSeen) {
+			oldest = key
+		}
+	}
+	delete(analyzer.subdomains, oldest)
+}
+
+// alert sends the verdict to the webhook when one is configured.
+func (analyzer *Analyzer) alert(verdict AnalyzerVerdict) {
+	fmt.Println("ALERT suspicious query:", verdict.Name, "client:", verdict.Client, verdict)
+	if analyzer.webhook == "" {
+		return
+	}
+	go func() {
+		body, _ := json.Marshal(verdict)
+		client := http.Client{Timeout: upstreamTimeout}
+		response, err := client.Post(analyzer.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Println("Failed to send alert:", err)
+			return
+		}
+		response.Body.Close()
+	}()
+}
+
+func shannonEntropy(value string) float64 {
+	if value == "" {
+		return 0
+	}
+	counts := make(map[rune]int)
+	for _, c := range value {
+		counts[c]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(len(value))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// longestConsonantRun counts digits as consonants, generated names mix both freely.
+func longestConsonantRun(value string) int {
+	longest, run := 0, 0
+	for _, c := range value {
+		if (c >= 'a' && c <= 'z' || c >= '0' && c <= '9') && !strings.ContainsRune("aeiouy", c) {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	return longest
+}
+
+// commonBigramRatio is the share of character pairs of the value which are common in English.
+func commonBigramRatio(value string) float64 {
+	if len(value) < 2 {
+		return 1
+	}
+	common := 0
+	for i := 0; i+1 < len(value); i++ {
+		if commonBigrams[value[i:i+2]] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(value)-1)
+}
+
+func clamp(value float64) float64 {
+	return math.Max(0, math.Min(1, value))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzerBenignNames(t *testing.T) {
+	analyzer := NewAnalyzer(AnalyzerLog, defaultAnalyzerThreshold, defaultAnalyzerWindow, defaultMaxUniqueSubdomains)
+	now := time.Now()
+	for _, name := range []string{"www.google.com", "mail.yandex.ru", "cdn.jsdelivr.net", "login.microsoftonline.com", "github.com"} {
+		verdict, suspicious := analyzer.analyze(name, "10.0.0.1", now)
+		assert.False(t, suspicious, name+" "+verdict.String())
+	}
+}
+
+func TestAnalyzerGeneratedNames(t *testing.T) {
+	analyzer := NewAnalyzer(AnalyzerLog, defaultAnalyzerThreshold, defaultAnalyzerWindow, defaultMaxUniqueSubdomains)
+	now := time.Now()
+	for _, name := range []string{
+		"xjw9qkz3vbtl7mpf2hgr.com",
+		"mzxw6ytboi4dsnrxgq2tmnzyhe3a.tunnel.example",
+		"q8hf3kd0zlw1rnb7.net",
+	} {
+		verdict, suspicious := analyzer.analyze(name, "10.0.0.1", now)
+		assert.True(t, suspicious, name+" "+verdict.String())
+	}
+}
+
+func TestAnalyzerUniqueSubdomainRate(t *testing.T) {
+	analyzer := NewAnalyzer(AnalyzerLog, defaultAnalyzerThreshold, time.Minute, 10)
+	now := time.Now()
+	names := []string{"one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten"}
+	var suspicious bool
+	for i, label := range names {
+		_, suspicious = analyzer.analyze(label+".data.example", "10.0.0.1", now)
+		if i < 5 {
+			assert.False(t, suspicious)
+		}
+	}
+	assert.True(t, suspicious)
+
+	// other clients and expired names are counted apart
+	_, suspicious = analyzer.analyze("eleven.data.example", "10.0.0.2", now)
+	assert.False(t, suspicious)
+	_, suspicious = analyzer.analyze("eleven.data.example", "10.0.0.1", now.Add(2*time.Minute))
+	assert.False(t, suspicious)
+}
+
+func TestAnalyzerEviction(t *testing.T) {
+	analyzer := NewAnalyzer(AnalyzerLog, defaultAnalyzerThreshold, time.Minute, 10)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		analyzer.uniqueSubdomainRate(fmt.Sprintf("s%d.data.example", i), "10.0.0.1", now)
+	}
+	// a flood of other parent domains evicts the least recent ones, not the whole state
+	for i := 0; i < maxTrackedParents; i++ {
+		analyzer.uniqueSubdomainRate(fmt.Sprintf("www.flood%d.example", i), "10.0.0.2", now.Add(time.Second))
+		if i%1000 == 0 {
+			analyzer.uniqueSubdomainRate("again.data.example", "10.0.0.1", now.Add(time.Second))
+		}
+	}
+	assert.Len(t, analyzer.subdomains, maxTrackedParents)
+	assert.Len(t, analyzer.subdomains["10.0.0.1|data.example"].names, 6)
+
+	// the parents not asked for within the window are swept
+	analyzer.uniqueSubdomainRate("s9.data.example", "10.0.0.1", now.Add(2*time.Minute))
+	assert.Len(t, analyzer.subdomains, 1)
+}
+
+func TestAnalyzerBlocks(t *testing.T) {
+	config := testConfig(t, "analyzer = block\nblock_mode = nxdomain")
+	packet, err := process(EncodeRequest(testRequest("xjw9qkz3vbtl7mpf2hgr.com", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeNameError, DecodePacket(packet).header.rcode)
+}
+
+func TestAnalyzerSkipsAllowlist(t *testing.T) {
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		response := newResponse(request, RcodeSuccess)
+		response.answers = []DnsAnswer{addressRecord(request.question.qname, 60, net.ParseIP("198.51.100.1"))}
+		return response
+	})
+	config := testConfig(t, "analyzer = block\nblock_mode = nxdomain\nnameserver = "+upstream+`
+[client.office]
+networks = 10.0.0.0/8
+allowlist = cdn.example
+`)
+	request := EncodeRequest(testRequest("xjw9qkz3vbtl7mpf2hgr.cdn.example", TypeA))
+
+	packet, err := process(request, nil, udpAddr("10.0.0.1"), config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeSuccess, DecodePacket(packet).header.rcode)
+
+	packet, err = process(request, nil, udpAddr("192.168.1.5"), config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeNameError, DecodePacket(packet).header.rcode)
+}
+
+func TestAnalyzerConfig(t *testing.T) {
+	config := testConfig(t, "analyzer = alert\nanalyzer_threshold = 0.8\nanalyzer_window = 30s")
+	assert.Equal(t, AnalyzerAlert, config.analyzer.action)
+	assert.Equal(t, 0.8, config.analyzer.threshold)
+	assert.Equal(t, 30*time.Second, config.analyzer.window)
+	assert.False(t, testConfig(t, "").analyzer.isEnabled())
+
+	_, err := parseConfig(loadIni(t, "analyzer = maybe"))
+	assert.Error(t, err)
+}
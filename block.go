@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type BlockMode int
+
+const (
+	BlockRefused        BlockMode = iota // REFUSED without answers, the historical behaviour
+	BlockNxdomain                        // NXDOMAIN with a synthetic SOA for negative caching
+	BlockNodata                          // NOERROR without answers, with a synthetic SOA
+	BlockNullIP                          // 0.0.0.0 for A and :: for AAAA queries
+	BlockSinkhole                        // configured sinkhole addresses for A and AAAA queries
+	BlockNotImplemented                  // NOTIMP without answers
+)
+
+var blockModeNames = map[string]BlockMode{
+	"refused":  BlockRefused,
+	"nxdomain": BlockNxdomain,
+	"nodata":   BlockNodata,
+	"null":     BlockNullIP,
+	"sinkhole": BlockSinkhole,
+	"notimp":   BlockNotImplemented,
+}
+
+func parseBlockMode(name string) (BlockMode, error) {
+	mode, ok := blockModeNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return BlockRefused, fmt.Errorf("unknown block mode %q", name)
+	}
+	return mode, nil
+}
+
+func (mode BlockMode) String() string {
+	for name, value := range blockModeNames {
+		if value == mode {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// BlockResponse describes how a blocked query is answered.
+type BlockResponse struct {
+	mode     BlockMode
+	ttl      uint32
+	sinkhole []net.IP
+}
+
+type BlockList struct {
+	name     string
+	rules    []*BlockRule
+	response BlockResponse
+	schedule *Schedule   // the list is always active when not set
+	index    *BlockIndex // compiled names blocked in addition to the rules
+}
+
+// matchIndex returns a rule standing for the entry of the compiled index covering the hostname.
+func (list *BlockList) matchIndex(hostname string) *BlockRule {
+	if list.index == nil {
+		return nil
+	}
+	if domain, ok := list.index.match(hostname); ok {
+		return &BlockRule{domain: domain, list: list}
+	}
+	return nil
+}
+
+type BlockRule struct {
+	domain    string     // "*" matches every name, "*.example.com" only the subdomains
+	lookalike bool       // the rule matches the names which read as the domain instead of the domain
+	network   *net.IPNet // set for rules matching answer addresses instead of names
+	qtypes    []uint16   // the rule only applies to these query types when not empty
+	mode      *BlockMode // overrides the block mode of the list when set
+	sinkhole  []net.IP   // overrides the sinkhole addresses of the list when not empty
+	schedule  *Schedule
+	list      *BlockList
+}
+
+// matches checks the rule against a query, qtype 0 stands for a query of unspecified type
+// which rules restricted to some query types never match.
+func (rule *BlockRule) matches(hostname string, qtype uint16, now time.Time) bool {
+	if rule.network != nil || !rule.schedule.isActive(now) || !rule.matchesType(qtype) {
+		return false
+	}
+	if rule.lookalike {
+		return isLookalike(hostname, rule.domain)
+	}
+	if rule.domain == "*" {
+		return true
+	}
+	if strings.HasPrefix(rule.domain, "*.") {
+		return strings.HasSuffix(hostname, rule.domain[1:])
+	}
+	return hostname == rule.domain || strings.HasSuffix(hostname, "."+rule.domain)
+}
+
+func (rule *BlockRule) matchesType(qtype uint16) bool {
+	if len(rule.qtypes) == 0 {
+		return true
+	}
+	for _, ruleType := range rule.qtypes {
+		if ruleType == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *BlockRule) matchesAddress(ip net.IP, now time.Time) bool {
+	return rule.network != nil && rule.network.Contains(ip) && rule.schedule.isActive(now)
+}
+
+func (rule *BlockRule) response() BlockResponse {
+	return rule.override(rule.list.response)
+}
+
+// override applies the block mode and sinkhole addresses of the rule to a list or group response.
+func (rule *BlockRule) override(response BlockResponse) BlockResponse {
+	if len(rule.sinkhole) > 0 {
+		response.mode = BlockSinkhole
+		response.sinkhole = rule.sinkhole
+	}
+	if rule.mode != nil {
+		response.mode = *rule.mode
+	}
+	return response
+}
+
+func (rule *BlockRule) String() string {
+	if rule.lookalike {
+		return rule.list.name + ":~" + rule.domain
+	}
+	return rule.list.name + ":" + rule.domain
+}
+
+// parseBlockRule reads a rule line, which is a domain or an address range of upstream answers,
+// optionally followed by sinkhole addresses, by the name of a schedule prefixed with "@",
+// by the query types the rule applies to and by a block mode overriding the one of the list:
+//
+//	ads.example.com
+//	tracker.example.com 10.0.0.1 fd00::1
+//	198.51.100.0/24
+//	facebook.com @workhours
+//	*.example.com qtype=AAAA
+//	* qtype=ANY,HINFO mode=notimp
+//
+// Rules restricted to query types answer NODATA unless they set a mode.
+func parseBlockRule(line string, list *BlockList, schedules map[string]*Schedule) (*BlockRule, error) {
+	fields := strings.Fields(line)
+	rule := &BlockRule{list: list}
+	name := fields[0]
+	if strings.HasPrefix(name, "~") {
+		// "~paypal.com" blocks the homographs of the domain such as "раураl.com" or "paypa1.com"
+		name = name[1:]
+		rule.lookalike = true
+	}
+	if _, err := toASCII(name); err != nil {
+		return nil, fmt.Errorf("invalid name %q: %v", fields[0], err)
+	}
+	rule.domain = normalizeName(name)
+	var addresses []string
+	for _, field := range fields[1:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			schedule, ok := schedules[field[1:]]
+			if !ok {
+				return nil, fmt.Errorf("unknown schedule %q", field[1:])
+			}
+			rule.schedule = schedule
+		case strings.HasPrefix(field, "qtype="):
+			for _, name := range strings.Split(strings.TrimPrefix(field, "qtype="), ",") {
+				qtype, err := parseType(name)
+				if err != nil {
+					return nil, err
+				}
+				rule.qtypes = append(rule.qtypes, qtype)
+			}
+		case strings.HasPrefix(field, "mode="):
+			mode, err := parseBlockMode(strings.TrimPrefix(field, "mode="))
+			if err != nil {
+				return nil, err
+			}
+			rule.mode = &mode
+		default:
+			addresses = append(addresses, field)
+		}
+	}
+	if len(rule.qtypes) > 0 && rule.mode == nil {
+		nodata := BlockNodata
+		rule.mode = &nodata
+	}
+	sinkhole, err := parseAddresses(addresses)
+	if err != nil {
+		return nil, err
+	}
+	rule.sinkhole = sinkhole
+	if _, network, err := net.ParseCIDR(fields[0]); err == nil {
+		rule.network = network
+	} else if ip := net.ParseIP(fields[0]); ip != nil {
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	}
+	return rule, nil
+}
+
+func parseAddresses(values []string) ([]net.IP, error) {
+	var addresses []net.IP
+	for _, value := range values {
+		ip := net.ParseIP(strings.TrimSpace(value))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", value)
+		}
+		addresses = append(addresses, ip)
+	}
+	return addresses, nil
+}
+
+func blockedSoa(ttl uint32) SoaData {
+	return SoaData{
+		mname:   "blocked.invalid",
+		rname:   "hostmaster.blocked.invalid",
+		serial:  1,
+		refresh: 1800,
+		retry:   900,
+		expire:  604800,
+		minimum: ttl,
+	}
+}
+
+func newResponse(request DnsRequest, rcode uint8) DnsPacket {
+	header := request.header
+	header.qr = true
+	header.ra = true
+	header.rcode = rcode
+	return DnsPacket{
+		header:    header,
+		questions: []DnsQuestion{request.question},
+	}
+}
+
+func blockResponse(request DnsRequest, block BlockResponse) DnsPacket {
+	question := request.question
+	switch block.mode {
+	case BlockNxdomain:
+		response := newResponse(request, RcodeNameError)
+		response.authorities = []DnsAnswer{soaRecord(question.qname, block.ttl, blockedSoa(block.ttl))}
+		return response
+	case BlockNullIP:
+		return addressResponse(request, block.ttl, []net.IP{net.IPv4zero, net.IPv6zero})
+	case BlockSinkhole:
+		return addressResponse(request, block.ttl, block.sinkhole)
+	case BlockNodata:
+		return nodataResponse(request, block.ttl)
+	case BlockNotImplemented:
+		return newResponse(request, RcodeNotImplemented)
+	default:
+		return rejectResponse(request)
+	}
+}
+
+// addressResponse answers A and AAAA queries with the matching addresses and falls back to NODATA
+// when there is no address of the requested family.
+func addressResponse(request DnsRequest, ttl uint32, addresses []net.IP) DnsPacket {
+	question := request.question
+	response := newResponse(request, RcodeSuccess)
+	response.answers = addressRecords(question.qname, question.qtype, ttl, addresses)
+	if len(response.answers) == 0 {
+		return nodataResponse(request, ttl)
+	}
+	return response
+}
+
+func nodataResponse(request DnsRequest, ttl uint32) DnsPacket {
+	response := newResponse(request, RcodeSuccess)
+	response.authorities = []DnsAnswer{soaRecord(request.question.qname, ttl, blockedSoa(ttl))}
+	return response
+}
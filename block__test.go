@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/ini.v1"
+)
+
+func testRequest(qname string, qtype uint16) DnsRequest {
+	return DnsRequest{
+		header:   DnsHeader{id: 0x1234, rd: true, qdcount: 1},
+		question: DnsQuestion{qname: qname, qtype: qtype, qclass: ClassIN},
+	}
+}
+
+func loadIni(t *testing.T, source string) *ini.File {
+	cfg, err := ini.Load([]byte(source))
+	assert.NoError(t, err)
+	return cfg
+}
+
+func testConfig(t *testing.T, source string) *Config {
+	config, err := parseConfig(loadIni(t, source))
+	assert.NoError(t, err)
+	return config
+}
+
+func TestBlockResponseRefused(t *testing.T) {
+	response := blockResponse(testRequest("vk.com", TypeA), BlockResponse{mode: BlockRefused})
+
+	assert.Equal(t, RcodeRefused, response.header.rcode)
+	assert.Empty(t, response.answers)
+	assert.Empty(t, response.authorities)
+}
+
+func TestBlockResponseNxdomain(t *testing.T) {
+	response := blockResponse(testRequest("vk.com", TypeA), BlockResponse{mode: BlockNxdomain, ttl: 42})
+
+	assert.Equal(t, RcodeNameError, response.header.rcode)
+	assert.Empty(t, response.answers)
+	assert.Len(t, response.authorities, 1)
+	assert.Equal(t, TypeSOA, response.authorities[0].atype)
+	assert.Equal(t, uint32(42), response.authorities[0].ttl)
+}
+
+func TestBlockResponseNullIP(t *testing.T) {
+	block := BlockResponse{mode: BlockNullIP, ttl: 10}
+
+	response := blockResponse(testRequest("vk.com", TypeA), block)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, []byte{0, 0, 0, 0}, response.answers[0].rdata)
+
+	response = blockResponse(testRequest("vk.com", TypeAAAA), block)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, []byte(net.IPv6zero), response.answers[0].rdata)
+
+	response = blockResponse(testRequest("vk.com", TypeMX), block)
+	assert.Empty(t, response.answers)
+	assert.Len(t, response.authorities, 1)
+}
+
+func TestBlockResponseSinkholeFromRule(t *testing.T) {
+	config := testConfig(t, `
+block_mode = nxdomain
+blacklist = """
+vk.com
+ads.example.com 10.0.0.1
+"""
+`)
+	rule := config.matchBlacklist("www.ads.example.com")
+	assert.NotNil(t, rule)
+
+	response := blockResponse(testRequest("www.ads.example.com", TypeA), rule.response())
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, []byte{10, 0, 0, 1}, response.answers[0].rdata)
+
+	response = blockResponse(testRequest("vk.com", TypeA), config.matchBlacklist("vk.com").response())
+	assert.Equal(t, RcodeNameError, response.header.rcode)
+}
+
+func TestBlockListSectionOverridesMode(t *testing.T) {
+	config := testConfig(t, `
+blacklist = vk.com
+block_ttl = 60
+
+[blocklist.ads]
+block_mode = sinkhole
+sinkhole = 10.0.0.2, fd00::2
+domains = doubleclick.net
+`)
+	rule := config.matchBlacklist("ad.doubleclick.net")
+	assert.Equal(t, "ads", rule.list.name)
+	assert.Equal(t, BlockSinkhole, rule.response().mode)
+	assert.Equal(t, uint32(60), rule.response().ttl)
+
+	response := blockResponse(testRequest("ad.doubleclick.net", TypeAAAA), rule.response())
+	assert.Equal(t, []byte(net.ParseIP("fd00::2")), response.answers[0].rdata)
+}
+
+func TestEncodeSoaRecord(t *testing.T) {
+	soa := soaRecord("vk.com", 10, SoaData{mname: "ns.vk.com", rname: "hostmaster.vk.com", serial: 7, minimum: 10})
+	packet := EncodePacket(DnsPacket{
+		header:      DnsHeader{qr: true},
+		authorities: []DnsAnswer{soa},
+		additionals: []DnsAnswer{addressRecord("ns.vk.com", 10, net.IP{10, 0, 0, 1})},
+	})
+	// no spare capacity to read past the message
+	decoded := DecodePacket(packet[:len(packet):len(packet)])
+
+	assert.Equal(t, soa.rdata, decoded.authorities[0].rdata)
+	assert.Equal(t, []byte{10, 0, 0, 1}, decoded.additionals[0].rdata)
+}
+
+func TestEncodeBlockResponse(t *testing.T) {
+	response := blockResponse(testRequest("vk.com", TypeA), BlockResponse{mode: BlockNxdomain, ttl: 10})
+	decoded := DecodePacket(EncodePacket(response))
+
+	assert.Equal(t, uint16(1), decoded.header.qdcount)
+	assert.Equal(t, uint16(0), decoded.header.ancount)
+	assert.Equal(t, uint16(1), decoded.header.nscount)
+	assert.Equal(t, RcodeNameError, decoded.header.rcode)
+	assert.Equal(t, "vk.com", decoded.questions[0].qname)
+}
+
+func TestQueryTypeRules(t *testing.T) {
+	config := testConfig(t, `
+blacklist = """
+* qtype=ANY,HINFO mode=notimp
+*.example.com qtype=AAAA
+broken.net qtype=TYPE65
+"""
+`)
+	group := config.defaultGroup
+	now := config.now()
+
+	assert.Nil(t, group.matchBlacklist("example.com", TypeAAAA, now))
+	assert.Nil(t, group.matchBlacklist("www.example.com", TypeA, now))
+	assert.NotNil(t, group.matchBlacklist("www.example.com", TypeAAAA, now))
+	assert.NotNil(t, group.matchBlacklist("anything.org", TypeANY, now))
+	assert.NotNil(t, group.matchBlacklist("anything.org", TypeHINFO, now))
+	assert.NotNil(t, group.matchBlacklist("broken.net", 65, now))
+	assert.False(t, config.isBlacklisted("www.example.com"))
+
+	response := blockResponse(testRequest("anything.org", TypeANY), group.matchBlacklist("anything.org", TypeANY, now).response())
+	assert.Equal(t, RcodeNotImplemented, response.header.rcode)
+
+	response = blockResponse(testRequest("www.example.com", TypeAAAA), group.matchBlacklist("www.example.com", TypeAAAA, now).response())
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Empty(t, response.answers)
+	assert.Len(t, response.authorities, 1)
+}
+
+func TestInvalidQueryTypeRule(t *testing.T) {
+	_, err := parseConfig(loadIni(t, `blacklist = example.com qtype=BOGUS`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+const (
+	optionClientSubnet uint16 = 8     // RFC 7871
+	optionMacAddress   uint16 = 65001 // dnsmasq add-mac
+)
+
+// ClientGroup is a filtering policy applied to the clients it matches.
+type ClientGroup struct {
+	name        string
+	networks    []*net.IPNet
+	macs        []net.HardwareAddr
+	blocklists  []*BlockList
+	allowlist   []string
+	response    *BlockResponse // overrides the responses of the lists when set
+	rewrites    []*Rewrite
+	nameservers []string
+	dns64       bool // AAAA records synthesized from the A records
+}
+
+func (group *ClientGroup) isDefault() bool {
+	return group.name == defaultGroupName
+}
+
+func (group *ClientGroup) isAllowed(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	for _, domain := range group.allowlist {
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (group *ClientGroup) matchBlacklist(hostname string, qtype uint16, now time.Time) *BlockRule {
+	hostname = strings.ToLower(hostname)
+	if group.isAllowed(hostname) {
+		return nil
+	}
+	for _, list := range group.activeLists(now) {
+		for _, rule := range list.rules {
+			if rule.matches(hostname, qtype, now) {
+				return rule
+			}
+		}
+		if rule := list.matchIndex(hostname); rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (group *ClientGroup) matchBlacklistAddress(ip net.IP, now time.Time) *BlockRule {
+	for _, list := range group.activeLists(now) {
+		for _, rule := range list.rules {
+			if rule.matchesAddress(ip, now) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+func (group *ClientGroup) activeLists(now time.Time) []*BlockList {
+	var lists []*BlockList
+	for _, list := range group.blocklists {
+		if list.schedule.isActive(now) {
+			lists = append(lists, list)
+		}
+	}
+	return lists
+}
+
+func (group *ClientGroup) blockResponse(rule *BlockRule) BlockResponse {
+	if group.response == nil {
+		return rule.response()
+	}
+	return rule.override(*group.response)
+}
+
+// clientGroup selects the group of the client: a MAC address match wins,
+// then the most specific network, then the default group.
+func (config Config) clientGroup(remoteAddr net.Addr, request DnsRequest) *ClientGroup {
+	ip, mac := clientIdentity(remoteAddr, request, config.trustClientSubnet, config.macForwarders)
+
+	selected := config.defaultGroup
+	selectedPrefix := -1
+	for _, group := range config.clientGroups {
+		for _, groupMac := range group.macs {
+			if mac != nil && bytes.Equal(mac, groupMac) {
+				return group
+			}
+		}
+		for _, network := range group.networks {
+			prefix, _ := network.Mask.Size()
+			if ip != nil && network.Contains(ip) && prefix > selectedPrefix {
+				selected = group
+				selectedPrefix = prefix
+			}
+		}
+	}
+	return selected
+}
+
+// clientIdentity finds the address and the MAC address identifying the client. The address comes
+// from the EDNS client subnet option when it is trusted and present, from the socket otherwise.
+// The MAC address option is only read from the forwarders of macForwarders, anyone could send it.
+func clientIdentity(remoteAddr net.Addr, request DnsRequest, trustClientSubnet bool, macForwarders []*net.IPNet) (ip net.IP, mac net.HardwareAddr) {
+	switch addr := remoteAddr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	trustMac := false
+	for _, network := range macForwarders {
+		trustMac = trustMac || ip != nil && network.Contains(ip)
+	}
+	opt := findOpt(request.additionals)
+	if opt == nil {
+		return ip, nil
+	}
+	for _, option := range DecodeEdnsOptions(opt.rdata) {
+		switch option.code {
+		case optionClientSubnet:
+			if subnet := decodeClientSubnet(option.data); subnet != nil && trustClientSubnet {
+				ip = subnet
+			}
+		case optionMacAddress:
+			if len(option.data) == 6 && trustMac {
+				mac = net.HardwareAddr(option.data)
+			}
+		}
+	}
+	return ip, mac
+}
+
+/*
++---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+|                            FAMILY                             |
++---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+|     SOURCE PREFIX-LENGTH      |     SCOPE PREFIX-LENGTH       |
++---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+|                           ADDRESS...                          /
++---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+*/
+func decodeClientSubnet(data []byte) net.IP {
+	if len(data) < 4 {
+		return nil
+	}
+	var ip net.IP
+	switch binary.BigEndian.Uint16(data[0:2]) {
+	case 1:
+		ip = make(net.IP, net.IPv4len)
+	case 2:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil
+	}
+	copy(ip, data[4:])
+	return ip
+}
+
+const defaultGroupName = "default"
+
+func parseClientGroup(section *ini.Section, config *Config, defaults BlockResponse) (*ClientGroup, error) {
+	group := &ClientGroup{
+		name:        strings.TrimPrefix(section.Name(), "client."),
+		blocklists:  config.blocklists,
+		nameservers: config.defaultGroup.nameservers,
+		dns64:       section.Key("dns64").MustBool(config.defaultGroup.dns64),
+	}
+	rewrites, err := parseRewrites(section.Key("rewrites").Strings("\n"))
+	if err != nil {
+		return nil, err
+	}
+	group.rewrites = append(rewrites, config.rewrites...)
+	if section.Key("safe_search").MustBool(config.safeSearch) {
+		group.rewrites = append(group.rewrites, safeSearchRewrites...)
+	}
+	for _, value := range section.Key("networks").Strings(",") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		group.networks = append(group.networks, network)
+	}
+	for _, value := range section.Key("macs").Strings(",") {
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return nil, err
+		}
+		group.macs = append(group.macs, mac)
+	}
+	if section.HasKey("blocklists") {
+		group.blocklists = nil
+		for _, value := range section.Key("blocklists").Strings(",") {
+			list, err := config.scheduledBlocklist(value)
+			if err != nil {
+				return nil, err
+			}
+			group.blocklists = append(group.blocklists, list)
+		}
+	}
+	for _, domain := range filter(section.Key("allowlist").Strings("\n"), isNotEmpty) {
+		group.allowlist = append(group.allowlist, normalizeName(domain))
+	}
+	if section.HasKey("block_mode") || section.HasKey("block_ttl") || section.HasKey("sinkhole") {
+		response, err := parseBlockResponse(section, defaults)
+		if err != nil {
+			return nil, err
+		}
+		group.response = &response
+	}
+	if section.HasKey("nameserver") {
+		group.nameservers = section.Key("nameserver").Strings(",")
+	}
+	return group, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const clientsConfig = `
+blacklist = vk.com
+nameserver = 8.8.8.8
+mac_forwarders = 172.16.0.1/32
+
+[blocklist.social]
+domains = facebook.com
+
+[client.guests]
+networks = 192.168.50.0/24
+block_mode = nxdomain
+allowlist = """
+m.vk.com
+"""
+
+[client.kiosk]
+networks = 192.168.50.16/28
+blocklists = social
+
+[client.builders]
+networks = 10.1.0.0/16
+macs = 02:00:00:00:00:01
+blocklists =
+nameserver = 10.1.0.53, 10.1.0.54
+`
+
+func udpAddr(ip string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}
+}
+
+func TestClientGroupByNetwork(t *testing.T) {
+	config := testConfig(t, clientsConfig)
+	request := testRequest("vk.com", TypeA)
+
+	assert.Equal(t, "guests", config.clientGroup(udpAddr("192.168.50.3"), request).name)
+	assert.Equal(t, "kiosk", config.clientGroup(udpAddr("192.168.50.17"), request).name)
+	assert.Equal(t, "builders", config.clientGroup(udpAddr("10.1.2.3"), request).name)
+	assert.Equal(t, "default", config.clientGroup(udpAddr("172.16.0.1"), request).name)
+	assert.Equal(t, "default", config.clientGroup(nil, request).name)
+}
+
+func TestClientGroupByEdnsOptions(t *testing.T) {
+	config := testConfig(t, clientsConfig)
+
+	request := testRequest("vk.com", TypeA)
+	request.additionals = []DnsAnswer{optRecord([]EdnsOption{{code: optionMacAddress, data: []byte{2, 0, 0, 0, 0, 1}}})}
+	assert.Equal(t, "builders", config.clientGroup(udpAddr("172.16.0.1"), request).name)
+	// only the forwarders may tell the MAC address of a client
+	assert.Equal(t, "default", config.clientGroup(udpAddr("172.16.0.2"), request).name)
+
+	subnet := []byte{0, 1, 24, 0, 192, 168, 50}
+	request.additionals = []DnsAnswer{optRecord([]EdnsOption{{code: optionClientSubnet, data: subnet}})}
+	assert.Equal(t, "default", config.clientGroup(udpAddr("172.16.0.1"), request).name)
+
+	config.trustClientSubnet = true
+	assert.Equal(t, "guests", config.clientGroup(udpAddr("172.16.0.1"), request).name)
+}
+
+func TestClientGroupPolicies(t *testing.T) {
+	config := testConfig(t, clientsConfig)
+	guests := config.clientGroup(udpAddr("192.168.50.3"), testRequest("vk.com", TypeA))
+	kiosk := config.clientGroup(udpAddr("192.168.50.17"), testRequest("vk.com", TypeA))
+	builders := config.clientGroup(udpAddr("10.1.2.3"), testRequest("vk.com", TypeA))
+
+	assert.NotNil(t, guests.matchBlacklist("vk.com", TypeA, config.now()))
+	assert.Nil(t, guests.matchBlacklist("m.vk.com", TypeA, config.now()))
+	assert.NotNil(t, guests.matchBlacklist("facebook.com", TypeA, config.now()))
+	assert.Equal(t, BlockNxdomain, guests.blockResponse(guests.matchBlacklist("vk.com", TypeA, config.now())).mode)
+
+	assert.Nil(t, kiosk.matchBlacklist("vk.com", TypeA, config.now()))
+	assert.NotNil(t, kiosk.matchBlacklist("www.facebook.com", TypeA, config.now()))
+	assert.Equal(t, BlockRefused, kiosk.blockResponse(kiosk.matchBlacklist("facebook.com", TypeA, config.now())).mode)
+
+	assert.Nil(t, builders.matchBlacklist("vk.com", TypeA, config.now()))
+	assert.Equal(t, []string{"10.1.0.53", "10.1.0.54"}, builders.nameservers)
+	assert.Equal(t, []string{"8.8.8.8"}, guests.nameservers)
+}
+
+func TestClientGroupFilteredExtendedError(t *testing.T) {
+	config := testConfig(t, clientsConfig)
+	request := testRequest("vk.com", TypeA)
+	request.additionals = []DnsAnswer{optRecord(nil)}
+
+	packet, err := process(EncodeRequest(request), nil, udpAddr("192.168.50.3"), config)
+	assert.NoError(t, err)
+
+	response := DecodePacket(packet)
+	assert.Equal(t, RcodeNameError, response.header.rcode)
+	options := DecodeEdnsOptions(findOpt(response.additionals).rdata)
+	assert.Equal(t, EdeFiltered, binary.BigEndian.Uint16(options[0].data[0:2]))
+	assert.Equal(t, "filtered by blacklist:vk.com for guests", string(options[0].data[2:]))
+}
+
+func TestUnknownBlocklistInClientGroup(t *testing.T) {
+	cfg := `
+[client.office]
+networks = 10.0.0.0/8
+blocklists = missing
+`
+	_, err := parseConfig(loadIni(t, cfg))
+	assert.Error(t, err)
+}
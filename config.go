@@ -1,14 +1,53 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"strings"
+	"time"
 
 	"gopkg.in/ini.v1"
 )
 
+const defaultBlockTTL = 10
+
 type Config struct {
-	blacklist  []string `ini:"blacklist"`
-	nameserver string   `ini:"nameserver"`
+	blocklists        []*BlockList
+	nameserver        string `ini:"nameserver"`
+	filterResponses   bool   `ini:"filter_responses"`
+	trustClientSubnet bool   `ini:"trust_client_subnet"`
+	defaultGroup      *ClientGroup
+	clientGroups      []*ClientGroup
+	macForwarders     []*net.IPNet
+	schedules         map[string]*Schedule
+	rewrites          []*Rewrite
+	rewriteTTL        uint32 `ini:"rewrite_ttl"`
+	safeSearch        bool   `ini:"safe_search"`
+	adminAddress      string `ini:"admin_address"`
+	adminToken        string `ini:"admin_token"`
+	overrides         *Overrides
+	rpzZones          []*RpzZone
+	rpzTTL            uint32 `ini:"rpz_ttl"`
+	rpzNameservers    *RpzNameservers
+	analyzer          *Analyzer
+	newDomains        *NewDomains
+	blockResponse     BlockResponse // how blocked queries are answered unless lists or groups say otherwise
+	warnings          []string      // likely mistakes found in the configuration
+	displayUnicode    bool
+	stats             *Stats
+	hosts             *Hosts
+	leases            *Leases
+	zones             []*Zone
+	tsigKeys          map[string]*TsigKey
+	views             []*View
+	forwardRules      []*ForwardRule
+	privateReverse    bool
+	ptrTemplate       *PtrTemplate
+	ptrTTL            uint32
+	dns64             *Dns64
+	hostsTTL          uint32
+	statsInterval     time.Duration
+	clock             Clock
 }
 
 func filter(ss []string, test func(string) bool) (ret []string) {
@@ -24,23 +63,401 @@ func isNotEmpty(str string) bool {
 	return len(str) > 0
 }
 
+// normalizeName lowercases a name and converts its internationalized labels to A-labels,
+// a name which is not a valid IDN is only lowercased.
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if ascii, err := toASCII(name); err == nil {
+		return ascii
+	}
+	return name
+}
+
 func readConfig(name string) *Config {
 	cfg, err := ini.Load(name)
 	exitOnError(err, "Fail to read file: %v")
 
-	config := new(Config)
-	config.blacklist = filter(cfg.Section("").Key("blacklist").Strings("\n"), isNotEmpty)
-	config.nameserver = cfg.Section("").Key("nameserver").String()
+	config, err := parseConfig(cfg)
+	exitOnError(err, "Invalid configuration: %v\n")
+	for _, warning := range config.warnings {
+		fmt.Println("Warning:", warning)
+	}
 	return config
 }
 
-func (config Config) isBlacklisted(hostname string) bool {
-	for _, blacklistedDomain := range config.blacklist {
-		if hostname == blacklistedDomain {
-			return true
-		} else if strings.HasSuffix(hostname, "."+blacklistedDomain) {
-			return true
+func parseConfig(cfg *ini.File) (*Config, error) {
+	root := cfg.Section("")
+	defaults, err := parseBlockResponse(root, BlockResponse{mode: BlockRefused, ttl: defaultBlockTTL})
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(Config)
+	config.blockResponse = defaults
+	config.nameserver = root.Key("nameserver").String()
+	config.filterResponses = root.Key("filter_responses").MustBool(true)
+	config.trustClientSubnet = root.Key("trust_client_subnet").MustBool(false)
+	for _, value := range filter(root.Key("mac_forwarders").Strings(","), isNotEmpty) {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("mac_forwarders: %v", err)
+		}
+		config.macForwarders = append(config.macForwarders, network)
+	}
+	config.clock = time.Now
+	config.rewriteTTL = uint32(root.Key("rewrite_ttl").MustUint(defaultRewriteTTL))
+	config.safeSearch = root.Key("safe_search").MustBool(false)
+	config.adminAddress = root.Key("admin_address").String()
+	config.adminToken = root.Key("admin_token").String()
+	if config.adminAddress != "" && config.adminToken == "" && !isLoopbackAddress(config.adminAddress) {
+		return nil, fmt.Errorf("admin_address %s is not a loopback address, set admin_token", config.adminAddress)
+	}
+	config.displayUnicode = root.Key("display_unicode").MustBool(false)
+	config.stats = NewStats(config.now())
+	config.statsInterval = root.Key("stats_interval").MustDuration(defaultStatsInterval)
+	config.overrides = NewOverrides(root.Key("overrides_file").String())
+	if err := config.overrides.load(); err != nil {
+		return nil, fmt.Errorf("overrides_file: %v", err)
+	}
+
+	config.rewrites, err = parseRewrites(root.Key("rewrites").Strings("\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	config.forwardRules, err = parseForwardRules(root.Key("forward").Strings("\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	config.privateReverse = root.Key("private_reverse").MustBool(true)
+	config.ptrTTL = uint32(root.Key("ptr_ttl").MustUint(defaultHostsTTL))
+	config.ptrTemplate, err = parsePtrTemplate(root.Key("ptr_template").String())
+	if err != nil {
+		return nil, err
+	}
+
+	config.dns64, err = parseDns64(root)
+	if err != nil {
+		return nil, err
+	}
+
+	config.analyzer, err = parseAnalyzer(root)
+	if err != nil {
+		return nil, err
+	}
+
+	config.newDomains, err = parseNewDomains(root)
+	if err != nil {
+		return nil, err
+	}
+
+	config.hostsTTL = uint32(root.Key("hosts_ttl").MustUint(defaultHostsTTL))
+	config.hosts = NewHosts(root.Key("hosts").Strings(","))
+	if err := config.hosts.load(); err != nil {
+		return nil, fmt.Errorf("hosts: %v", err)
+	}
+
+	config.leases, err = NewLeases(
+		root.Key("dhcp_leases").String(),
+		root.Key("dhcp_leases_format").MustString(LeasesAuto),
+		root.Key("local_domain").MustString(defaultLocalDomain),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if config.leases.isEnabled() {
+		if err := config.leases.load(); err != nil {
+			return nil, fmt.Errorf("dhcp_leases: %v", err)
 		}
 	}
-	return false
+
+	config.rpzTTL = uint32(root.Key("rpz_ttl").MustUint(defaultBlockTTL))
+	config.rpzNameservers = NewRpzNameservers()
+	for _, value := range root.Key("rpz").Strings(",") {
+		zone, err := parseRpzSource(value)
+		if err != nil {
+			return nil, fmt.Errorf("rpz: %v", err)
+		}
+		config.rpzZones = append(config.rpzZones, zone)
+	}
+
+	config.tsigKeys = make(map[string]*TsigKey)
+	for _, section := range cfg.Section("tsig").ChildSections() {
+		key, err := parseTsigKey(section)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+		}
+		config.tsigKeys[key.name] = key
+	}
+
+	for _, section := range cfg.Section("zone").ChildSections() {
+		origin := strings.TrimPrefix(section.Name(), "zone.")
+		var zone *Zone
+		if section.HasKey("primaries") {
+			zone, err = parseSecondaryZone(section, origin, config.tsigKeys)
+		} else {
+			zone, err = loadZone(section.Key("file").String(), origin)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+		}
+		if err := config.parseZoneUpdates(section, zone); err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+		}
+		if err := config.parseZoneTransfers(section, zone); err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+		}
+		config.zones = append(config.zones, zone)
+	}
+
+	for _, section := range cfg.Section("view").ChildSections() {
+		view, err := parseView(section)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+		}
+		config.views = append(config.views, view)
+	}
+
+	config.schedules = make(map[string]*Schedule)
+	for _, section := range cfg.Section("schedule").ChildSections() {
+		schedule, err := parseSchedule(section)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+		}
+		config.schedules[schedule.name] = schedule
+	}
+
+	blacklist, err := parseBlockList("blacklist", root.Key("blacklist"), defaults, config.schedules)
+	if err != nil {
+		return nil, err
+	}
+	config.blocklists = append(config.blocklists, blacklist)
+
+	for _, section := range cfg.Section("blocklist").ChildSections() {
+		response, err := parseBlockResponse(section, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+		}
+		name := strings.TrimPrefix(section.Name(), "blocklist.")
+		list, err := parseBlockList(name, section.Key("domains"), response, config.schedules)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+		}
+		if section.HasKey("index") {
+			list.index, err = loadIndex(section.Key("index").String())
+			if err != nil {
+				return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+			}
+		}
+		if section.HasKey("schedule") {
+			schedule, ok := config.schedules[section.Key("schedule").String()]
+			if !ok {
+				return nil, fmt.Errorf("[%s]: unknown schedule %q", section.Name(), section.Key("schedule").String())
+			}
+			list.schedule = schedule
+		}
+		config.blocklists = append(config.blocklists, list)
+	}
+
+	config.warnings = publicSuffixWarnings(config.blocklists)
+
+	config.defaultGroup = &ClientGroup{
+		name:        defaultGroupName,
+		blocklists:  config.blocklists,
+		rewrites:    config.rewrites,
+		nameservers: []string{config.nameserver},
+		dns64:       root.Key("dns64").MustBool(false),
+	}
+	if config.safeSearch {
+		config.defaultGroup.rewrites = append(config.defaultGroup.rewrites, safeSearchRewrites...)
+	}
+	for _, section := range cfg.Section("client").ChildSections() {
+		group, err := parseClientGroup(section, config, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section.Name(), err)
+		}
+		config.clientGroups = append(config.clientGroups, group)
+	}
+	return config, nil
+}
+
+// parseZoneUpdates reads the keys allowed to update a zone and replays its journal,
+// kept next to the zone file unless configured otherwise.
+func (config *Config) parseZoneUpdates(section *ini.Section, zone *Zone) error {
+	for _, name := range filter(section.Key("allow_update").Strings(","), isNotEmpty) {
+		name = normalizeName(name)
+		if config.tsigKeys[name] == nil {
+			return fmt.Errorf("allow_update: unknown TSIG key %q", name)
+		}
+		zone.updateKeys = append(zone.updateKeys, name)
+	}
+	if len(zone.updateKeys) == 0 {
+		return nil
+	}
+	zone.journal = section.Key("journal").MustString(section.Key("file").String() + ".jnl")
+	count, err := zone.loadJournal()
+	if err != nil {
+		return fmt.Errorf("journal: %v", err)
+	}
+	if count > 0 {
+		fmt.Println("Replayed", count, "changes of the journal of zone", zone.origin)
+	}
+	return nil
+}
+
+// parseZoneTransfers reads the networks and keys allowed to transfer a zone, and its secondaries.
+func (config *Config) parseZoneTransfers(section *ini.Section, zone *Zone) error {
+	for _, value := range filter(section.Key("allow_transfer").Strings(","), isNotEmpty) {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("allow_transfer: %v", err)
+		}
+		zone.transferNetworks = append(zone.transferNetworks, network)
+	}
+	for _, name := range filter(section.Key("transfer_keys").Strings(","), isNotEmpty) {
+		name = normalizeName(name)
+		if config.tsigKeys[name] == nil {
+			return fmt.Errorf("transfer_keys: unknown TSIG key %q", name)
+		}
+		zone.transferKeys = append(zone.transferKeys, name)
+	}
+	for _, secondary := range filter(section.Key("notify").Strings(","), isNotEmpty) {
+		if !isServerAddress(secondary) {
+			return fmt.Errorf("notify: invalid address %q", secondary)
+		}
+		zone.secondaries = append(zone.secondaries, secondary)
+	}
+	return nil
+}
+
+func parseAnalyzer(section *ini.Section) (*Analyzer, error) {
+	action, ok := analyzerActionNames[section.Key("analyzer").MustString("off")]
+	if !ok {
+		return nil, fmt.Errorf("unknown analyzer action %q", section.Key("analyzer").String())
+	}
+	analyzer := NewAnalyzer(
+		action,
+		section.Key("analyzer_threshold").MustFloat64(defaultAnalyzerThreshold),
+		section.Key("analyzer_window").MustDuration(defaultAnalyzerWindow),
+		section.Key("analyzer_max_subdomains").MustInt(defaultMaxUniqueSubdomains),
+	)
+	analyzer.webhook = section.Key("analyzer_webhook").String()
+	return analyzer, nil
+}
+
+func parseNewDomains(section *ini.Section) (*NewDomains, error) {
+	action, ok := newDomainActionNames[section.Key("newly_observed").MustString("off")]
+	if !ok {
+		return nil, fmt.Errorf("unknown newly_observed action %q", section.Key("newly_observed").String())
+	}
+	newDomains := NewNewDomains(
+		action,
+		section.Key("newly_observed_age").MustDuration(defaultNewDomainAge),
+		section.Key("newly_observed_max").MustInt(defaultMaxObservedDomain),
+		section.Key("newly_observed_file").String(),
+	)
+	newDomains.learning = section.Key("newly_observed_learning").MustDuration(defaultNewDomainLearning)
+	if err := newDomains.load(); err != nil {
+		return nil, fmt.Errorf("newly_observed_file: %v", err)
+	}
+	return newDomains, nil
+}
+
+// parseBlockResponse reads block_mode, block_ttl and sinkhole keys of a section,
+// taking the missing ones from defaults.
+func parseBlockResponse(section *ini.Section, defaults BlockResponse) (BlockResponse, error) {
+	response := defaults
+	if section.HasKey("block_mode") {
+		mode, err := parseBlockMode(section.Key("block_mode").String())
+		if err != nil {
+			return response, err
+		}
+		response.mode = mode
+	}
+	if section.HasKey("block_ttl") {
+		ttl, err := section.Key("block_ttl").Uint()
+		if err != nil {
+			return response, fmt.Errorf("invalid block_ttl: %v", err)
+		}
+		response.ttl = uint32(ttl)
+	}
+	if section.HasKey("sinkhole") {
+		addresses, err := parseAddresses(section.Key("sinkhole").Strings(","))
+		if err != nil {
+			return response, err
+		}
+		response.sinkhole = addresses
+	}
+	if response.mode == BlockSinkhole && len(response.sinkhole) == 0 {
+		return response, fmt.Errorf("block_mode sinkhole requires sinkhole addresses")
+	}
+	return response, nil
+}
+
+func parseBlockList(name string, key *ini.Key, response BlockResponse, schedules map[string]*Schedule) (*BlockList, error) {
+	list := &BlockList{name: name, response: response}
+	for _, line := range filter(key.Strings("\n"), isNotEmpty) {
+		rule, err := parseBlockRule(line, list, schedules)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		list.rules = append(list.rules, rule)
+	}
+	return list, nil
+}
+
+func (config Config) blocklist(name string) *BlockList {
+	for _, list := range config.blocklists {
+		if list.name == name {
+			return list
+		}
+	}
+	return nil
+}
+
+// scheduledBlocklist finds a list by name, "social@workhours" refers to the list "social"
+// restricted to the schedule "workhours", on top of its own schedule.
+func (config Config) scheduledBlocklist(value string) (*BlockList, error) {
+	parts := strings.SplitN(value, "@", 2)
+	list := config.blocklist(parts[0])
+	if list == nil {
+		return nil, fmt.Errorf("unknown blocklist %q", parts[0])
+	}
+	if len(parts) == 1 {
+		return list, nil
+	}
+	schedule, ok := config.schedules[parts[1]]
+	if !ok {
+		return nil, fmt.Errorf("unknown schedule %q", parts[1])
+	}
+	scheduled := *list
+	scheduled.schedule = schedule
+	if list.schedule != nil {
+		combined := *schedule
+		combined.within = list.schedule
+		scheduled.schedule = &combined
+	}
+	return &scheduled, nil
+}
+
+// displayName shows a name in logs and API output, in Unicode when display_unicode is set.
+func (config Config) displayName(name string) string {
+	if config.displayUnicode {
+		return toUnicode(name)
+	}
+	return name
+}
+
+func (config Config) now() time.Time {
+	return config.clock()
+}
+
+// matchBlacklist checks a hostname regardless of the query type against the default group.
+func (config Config) matchBlacklist(hostname string) *BlockRule {
+	return config.defaultGroup.matchBlacklist(hostname, 0, config.now())
+}
+
+func (config Config) isBlacklisted(hostname string) bool {
+	return config.matchBlacklist(hostname) != nil
 }
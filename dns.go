@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/binary"
+	"fmt"
 	"strings"
 )
 
@@ -115,8 +116,9 @@ type DnsAnswer struct {
 	0000020: 7500 0001 0001 u.....
 */
 type DnsRequest struct {
-	header   DnsHeader
-	question DnsQuestion
+	header      DnsHeader
+	question    DnsQuestion
+	additionals []DnsAnswer // carries the EDNS OPT pseudo-record when the client supports EDNS
 }
 
 /*
@@ -135,9 +137,11 @@ type DnsResponse struct {
 }
 
 type DnsPacket struct {
-	header    DnsHeader
-	questions []DnsQuestion
-	answers   []DnsAnswer
+	header      DnsHeader
+	questions   []DnsQuestion
+	answers     []DnsAnswer
+	authorities []DnsAnswer
+	additionals []DnsAnswer
 }
 
 func DecodeHeader(headerData []byte) DnsHeader {
@@ -221,7 +225,43 @@ func DecodeName(data []byte) (name string, nameLength int) {
 	}
 }
 
+// DecodeNameAt reads a name starting at offset within the whole message, following
+// compression pointers, and returns the offset right after the name.
+func DecodeNameAt(message []byte, offset int) (name string, next int) {
+	var labels []string
+	next = -1
+	for jumps := 0; jumps < maxCompressionJumps; {
+		partLength, pointer := DecodeLengthOrPointer(message[offset:])
+		if partLength < 0 {
+			panic("invalid label length")
+		}
+		if pointer != 0 {
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(pointer)
+			jumps++
+			continue
+		}
+		if partLength == 0 {
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next
+		}
+		labels = append(labels, string(message[offset+1:offset+1+int(partLength)]))
+		offset += 1 + int(partLength)
+	}
+	panic("too many compression pointers")
+}
+
+const maxCompressionJumps = 64
+
 func EncodeName(name string) []byte {
+	if name == "" {
+		// the root domain is just the terminating null label
+		return []byte{0}
+	}
 	parts := strings.Split(name, ".")
 	size := len(name) + 2
 	var result = make([]byte, size)
@@ -268,7 +308,7 @@ func DecodeAnswer(data []byte) (answer DnsAnswer, offset int) {
 func EncodeAnswer(answer DnsAnswer) []byte {
 	encodedName := EncodeName(answer.name)
 
-	data := make([]byte, 8+len(answer.rdata))
+	data := make([]byte, 10+len(answer.rdata))
 	binary.BigEndian.PutUint16(data[0:2], answer.atype)
 	binary.BigEndian.PutUint16(data[2:4], answer.aclass)
 	binary.BigEndian.PutUint32(data[4:8], answer.ttl)
@@ -279,17 +319,30 @@ func EncodeAnswer(answer DnsAnswer) []byte {
 }
 
 func DecodeRequest(packet []byte) DnsRequest {
-	headerData := packet[0:12]
-	questionData := packet[12:]
-	question, _ := DecodeQuestion(questionData)
+	header := DecodeHeader(packet[0:12])
+	question, questionLength := DecodeQuestion(packet[12:])
+	offset := 12 + questionLength
+	_, offset = decodeRecords(packet, offset, header.ancount)
+	_, offset = decodeRecords(packet, offset, header.nscount)
+	additionals, _ := decodeRecords(packet, offset, header.arcount)
 	return DnsRequest{
-		header:   DecodeHeader(headerData),
-		question: question,
+		header:      header,
+		question:    question,
+		additionals: additionals,
 	}
 }
 
 func EncodeRequest(request DnsRequest) []byte {
-	return append(EncodeHeader(request.header), EncodeQuestion(request.question)...)
+	header := request.header
+	header.qdcount = 1
+	header.ancount = 0
+	header.nscount = 0
+	header.arcount = uint16(len(request.additionals))
+	data := append(EncodeHeader(header), EncodeQuestion(request.question)...)
+	for _, additional := range request.additionals {
+		data = append(data, EncodeAnswer(additional)...)
+	}
+	return data
 }
 
 func DecodeResponse(packet []byte) DnsResponse {
@@ -317,30 +370,109 @@ func DecodePacket(packet []byte) DnsPacket {
 	answersCount := header.ancount
 
 	questions := make([]DnsQuestion, questionsCount)
-	answers := make([]DnsAnswer, answersCount)
 
 	offset := 12
 	for q := 0; q < int(questionsCount); q++ {
-		question, questionLength := DecodeQuestion(packet[offset:])
-		questions[q] = question
-		offset += questionLength
-	}
-	for a := 0; a < int(answersCount); a++ {
-		answer, answerLength := DecodeAnswer(packet[offset:])
-		answers[a] = answer
-		offset += answerLength
+		name, nameEnd := DecodeNameAt(packet, offset)
+		questions[q] = DnsQuestion{
+			qname:  name,
+			qtype:  binary.BigEndian.Uint16(packet[nameEnd : nameEnd+2]),
+			qclass: binary.BigEndian.Uint16(packet[nameEnd+2 : nameEnd+4]),
+		}
+		offset = nameEnd + 4
 	}
+	answers, offset := decodeRecords(packet, offset, answersCount)
+	authorities, offset := decodeRecords(packet, offset, header.nscount)
+	additionals, _ := decodeRecords(packet, offset, header.arcount)
 
 	return DnsPacket{
-		header:    header,
-		questions: questions,
-		answers:   answers,
+		header:      header,
+		questions:   questions,
+		answers:     answers,
+		authorities: authorities,
+		additionals: additionals,
+	}
+}
+
+// SafeDecodePacket decodes a packet coming from the network, reporting malformed data as an error.
+func SafeDecodePacket(packet []byte) (decoded DnsPacket, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed packet: %v", r)
+		}
+	}()
+	return DecodePacket(packet[:len(packet):len(packet)]), nil
+}
+
+// SafeDecodeRequest decodes a query coming from the network, reporting malformed data as an error.
+func SafeDecodeRequest(packet []byte) (request DnsRequest, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed request: %v", r)
+		}
+	}()
+	// the decoder must not read past the message into the rest of a reused buffer
+	return DecodeRequest(packet[:len(packet):len(packet)]), nil
+}
+
+// formatErrorResponse answers a malformed message with FORMERR, nil when it has no header to answer.
+func formatErrorResponse(packet []byte) []byte {
+	if len(packet) < 12 {
+		return nil
+	}
+	header := DecodeHeader(packet[0:12])
+	return EncodeHeader(DnsHeader{id: header.id, qr: true, opcode: header.opcode, rd: header.rd, ra: true, rcode: RcodeFormatError})
+}
+
+func decodeRecords(packet []byte, offset int, count uint16) ([]DnsAnswer, int) {
+	records := make([]DnsAnswer, count)
+	for r := 0; r < int(count); r++ {
+		records[r], offset = decodeRecordAt(packet, offset)
+	}
+	return records, offset
+}
+
+// decodeRecordAt reads a resource record within the whole message. Names inside the RDATA
+// of well-known types are decompressed, so that the record can be encoded again on its own,
+// and the RDATA is copied: the record outlives the message, read into a reused buffer.
+func decodeRecordAt(packet []byte, offset int) (DnsAnswer, int) {
+	name, nameEnd := DecodeNameAt(packet, offset)
+	rdlength := int(binary.BigEndian.Uint16(packet[nameEnd+8 : nameEnd+10]))
+	rdataStart := nameEnd + 10
+	record := DnsAnswer{
+		name:   name,
+		atype:  binary.BigEndian.Uint16(packet[nameEnd : nameEnd+2]),
+		aclass: binary.BigEndian.Uint16(packet[nameEnd+2 : nameEnd+4]),
+		ttl:    binary.BigEndian.Uint32(packet[nameEnd+4 : nameEnd+8]),
+		rdata:  append([]byte{}, packet[rdataStart:rdataStart+rdlength]...),
+	}
+	if rdlength == 0 {
+		// the empty records of UPDATE messages, which delete or test for RRsets
+		return record, rdataStart
+	}
+	switch record.atype {
+	case TypeCNAME, TypeDNAME, TypeNS, TypePTR:
+		target, _ := DecodeNameAt(packet, rdataStart)
+		record.rdata = EncodeName(target)
+	case TypeMX:
+		exchange, _ := DecodeNameAt(packet, rdataStart+2)
+		record.rdata = append(append([]byte{}, record.rdata[0:2]...), EncodeName(exchange)...)
+	case TypeSOA:
+		mname, rnameStart := DecodeNameAt(packet, rdataStart)
+		rname, timersStart := DecodeNameAt(packet, rnameStart)
+		soa := append(EncodeName(mname), EncodeName(rname)...)
+		record.rdata = append(soa, packet[timersStart:timersStart+20]...)
 	}
+	return record, rdataStart + rdlength
 }
 
 func EncodePacket(packet DnsPacket) []byte {
-	headerData := EncodeHeader(packet.header)
-	data := headerData
+	header := packet.header
+	header.qdcount = uint16(len(packet.questions))
+	header.ancount = uint16(len(packet.answers))
+	header.nscount = uint16(len(packet.authorities))
+	header.arcount = uint16(len(packet.additionals))
+	data := EncodeHeader(header)
 
 	for _, question := range packet.questions {
 		data = append(data, EncodeQuestion(question)...)
@@ -348,6 +480,12 @@ func EncodePacket(packet DnsPacket) []byte {
 	for _, answer := range packet.answers {
 		data = append(data, EncodeAnswer(answer)...)
 	}
+	for _, authority := range packet.authorities {
+		data = append(data, EncodeAnswer(authority)...)
+	}
+	for _, additional := range packet.additionals {
+		data = append(data, EncodeAnswer(additional)...)
+	}
 
 	return data
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// See also: https://datatracker.ietf.org/doc/html/rfc6147 for DNS64
+// and https://datatracker.ietf.org/doc/html/rfc6052 for the embedding of IPv4 addresses
+
+const (
+	defaultDns64Prefix  = "64:ff9b::/96"
+	defaultDns64Exclude = "::ffff:0:0/96"
+	maxDns64TTL         = 600 // when the negative answer has no SOA, RFC 6147 section 5.1.7
+)
+
+// Dns64 synthesizes the AAAA records of names which only have A records, for the client groups
+// with dns64 enabled, and maps the reverse names of the prefix back to the IPv4 reverse names.
+type Dns64 struct {
+	prefix   *net.IPNet
+	excluded []*net.IPNet // IPv6 networks of AAAA records treated as missing, IPv4 networks never synthesized
+}
+
+func parseDns64(section *ini.Section) (*Dns64, error) {
+	_, prefix, err := net.ParseCIDR(section.Key("dns64_prefix").MustString(defaultDns64Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("dns64_prefix: %v", err)
+	}
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 || ones%8 != 0 || ones < 32 || ones > 96 || ones == 72 || ones == 80 || ones == 88 {
+		return nil, fmt.Errorf("dns64_prefix %s must be a /32, /40, /48, /56, /64 or /96 IPv6 prefix", prefix)
+	}
+	if ones == 96 && prefix.IP[8] != 0 {
+		return nil, fmt.Errorf("dns64_prefix %s: bits 64 to 71 must be zero", prefix)
+	}
+	dns64 := &Dns64{prefix: prefix}
+	excludes := []string{defaultDns64Exclude}
+	if section.HasKey("dns64_exclude") {
+		excludes = filter(section.Key("dns64_exclude").Strings(","), isNotEmpty)
+	}
+	for _, value := range excludes {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("dns64_exclude: %v", err)
+		}
+		dns64.excluded = append(dns64.excluded, network)
+	}
+	return dns64, nil
+}
+
+func (dns64 *Dns64) isWellKnownPrefix() bool {
+	return dns64.prefix.String() == defaultDns64Prefix
+}
+
+// synthesize embeds an IPv4 address in the prefix, nil when it must not be: the excluded
+// addresses, and the non-global ones with the well-known prefix (RFC 6052 section 3.1).
+func (dns64 *Dns64) synthesize(ip net.IP) net.IP {
+	ip = ip.To4()
+	if ip == nil || dns64.isExcluded(ip) || dns64.isWellKnownPrefix() && privateReverseZone(reverseName(ip)) != "" {
+		return nil
+	}
+	synthesized := make(net.IP, net.IPv6len)
+	copy(synthesized, dns64.prefix.IP)
+	position, _ := dns64.prefix.Mask.Size()
+	position /= 8
+	for _, b := range ip {
+		// the bits 64 to 71 stay zero
+		if position == 8 {
+			position++
+		}
+		synthesized[position] = b
+		position++
+	}
+	return synthesized
+}
+
+// address reads the IPv4 address embedded in an address of the prefix, nil for other addresses.
+func (dns64 *Dns64) address(ip net.IP) net.IP {
+	if ip == nil || ip.To4() != nil || !dns64.prefix.Contains(ip) {
+		return nil
+	}
+	embedded := make(net.IP, 0, net.IPv4len)
+	position, _ := dns64.prefix.Mask.Size()
+	position /= 8
+	for len(embedded) < net.IPv4len {
+		if position == 8 {
+			position++
+		}
+		embedded = append(embedded, ip[position])
+		position++
+	}
+	return embedded
+}
+
+// isExcluded tells whether an address is in one of the excluded networks of its family.
+// IPv4-mapped addresses such as ::ffff:192.0.2.1 only match IPv6 networks.
+func (dns64 *Dns64) isExcluded(ip net.IP) bool {
+	for _, network := range dns64.excluded {
+		if len(ip) == net.IPv4len && len(network.IP) == net.IPv4len && network.Contains(ip) {
+			return true
+		}
+		if len(ip) == net.IPv6len && len(network.IP) == net.IPv6len && ip.Mask(network.Mask).Equal(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// complete answers an AAAA query of a client with dns64 with the records of the name, or with
+// records synthesized from its A records when it has none. The query went through the policies
+// already, lookup only resolves the A query the way the AAAA one was.
+func (dns64 *Dns64) complete(request DnsRequest, group *ClientGroup, response []byte, err error, lookup func(aRequest DnsRequest) ([]byte, error), config *Config) ([]byte, error) {
+	question := request.question
+	if !group.dns64 || question.qtype != TypeAAAA || question.qclass != ClassIN || response == nil {
+		return response, err
+	}
+	decoded, decodeErr := SafeDecodePacket(response)
+	if decodeErr != nil || decoded.header.rcode == RcodeNameError {
+		return response, err
+	}
+
+	// other errors than NXDOMAIN are treated as an empty answer, RFC 6147 section 5.1.2
+	if decoded.header.rcode == RcodeSuccess {
+		answers := make([]DnsAnswer, 0, len(decoded.answers))
+		found := false
+		for _, answer := range decoded.answers {
+			if answer.atype == TypeAAAA && dns64.isExcluded(net.IP(answer.rdata)) {
+				continue
+			}
+			found = found || answer.atype == TypeAAAA
+			answers = append(answers, answer)
+		}
+		if found {
+			if len(answers) == len(decoded.answers) {
+				return response, err
+			}
+			decoded.answers = answers
+			return EncodePacket(decoded), err
+		}
+	}
+
+	aRequest := request
+	aRequest.question.qtype = TypeA
+	aResponse, _ := lookup(aRequest)
+	if aResponse == nil {
+		return response, err
+	}
+	aDecoded, decodeErr := SafeDecodePacket(aResponse)
+	if decodeErr != nil || aDecoded.header.rcode != RcodeSuccess {
+		return response, err
+	}
+	ttl := negativeTTL(decoded)
+	var answers []DnsAnswer
+	synthesized := 0
+	for _, answer := range aDecoded.answers {
+		if answer.atype != TypeA {
+			answers = append(answers, answer)
+			continue
+		}
+		ip := dns64.synthesize(net.IP(answer.rdata))
+		if ip == nil {
+			continue
+		}
+		record := addressRecord(answer.name, answer.ttl, ip)
+		if ttl < record.ttl {
+			record.ttl = ttl
+		}
+		answers = append(answers, record)
+		synthesized++
+	}
+	if synthesized == 0 {
+		return response, err
+	}
+	fmt.Println("Synthesized IPv6 address:", config.displayName(question.qname), "addresses:", synthesized, "prefix:", dns64.prefix)
+
+	aDecoded.questions = []DnsQuestion{question}
+	aDecoded.answers = answers
+	aDecoded.authorities = nil
+	opt := findOpt(aDecoded.additionals)
+	aDecoded.additionals = nil
+	if opt != nil {
+		aDecoded.additionals = []DnsAnswer{*opt}
+	}
+	return EncodePacket(aDecoded), nil
+}
+
+// negativeTTL is how long the missing AAAA records may be cached: the lesser of the TTL and
+// minimum of the SOA of the negative answer, maxDns64TTL without SOA.
+func negativeTTL(response DnsPacket) uint32 {
+	for _, authority := range response.authorities {
+		if authority.atype != TypeSOA || len(authority.rdata) < 20 {
+			continue
+		}
+		ttl := authority.ttl
+		if minimum := binary.BigEndian.Uint32(authority.rdata[len(authority.rdata)-4:]); minimum < ttl {
+			ttl = minimum
+		}
+		return ttl
+	}
+	return maxDns64TTL
+}
+
+// resolvePtr answers the reverse query of a synthesized address with the answer for the
+// IPv4 address, the records of its reverse name renamed to the queried name.
+func (dns64 *Dns64) resolvePtr(request DnsRequest, ip net.IP, conn net.PacketConn, remoteAddr net.Addr, config *Config) ([]byte, error) {
+	ptrRequest := request
+	ptrRequest.question.qname = reverseName(ip)
+	response, err := processQuery(ptrRequest, EncodeRequest(ptrRequest), conn, remoteAddr, config)
+	if response == nil {
+		return response, err
+	}
+	decoded, decodeErr := SafeDecodePacket(response)
+	if decodeErr != nil {
+		return response, err
+	}
+	fmt.Println("Synthesized name:", request.question.qname, typeName(request.question.qtype), ip)
+	decoded.questions = []DnsQuestion{request.question}
+	for i := range decoded.answers {
+		if strings.EqualFold(decoded.answers[i].name, ptrRequest.question.qname) {
+			decoded.answers[i].name = request.question.qname
+		}
+	}
+	return EncodePacket(decoded), err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dns64Upstream(t *testing.T) string {
+	return startUpstream(t, func(request DnsRequest) DnsPacket {
+		question := request.question
+		response := newResponse(request, RcodeSuccess)
+		address := func(name string, ttl uint32, ip string) {
+			if record := addressRecord(name, ttl, net.ParseIP(ip)); record.atype == question.qtype {
+				response.answers = append(response.answers, record)
+			}
+		}
+		switch question.qname {
+		case "v4only.example":
+			address(question.qname, 3600, "93.184.216.34")
+		case "short.example":
+			address(question.qname, 60, "93.184.216.35")
+		case "alias.example":
+			response.answers = []DnsAnswer{cnameRecord(question.qname, 300, "v4only.example")}
+			address("v4only.example", 3600, "93.184.216.34")
+		case "dual.example":
+			address(question.qname, 300, "93.184.216.36")
+			address(question.qname, 300, "2001:db8::36")
+		case "mapped.example":
+			address(question.qname, 300, "93.184.216.37")
+			if question.qtype == TypeAAAA {
+				response.answers = []DnsAnswer{{name: question.qname, atype: TypeAAAA, aclass: ClassIN, ttl: 300, rdata: net.ParseIP("::ffff:93.184.216.37")}}
+			}
+		case "private.example":
+			address(question.qname, 300, "10.0.0.1")
+		case "34.216.184.93.in-addr.arpa":
+			response.answers = []DnsAnswer{{name: question.qname, atype: TypePTR, aclass: ClassIN, ttl: 300, rdata: EncodeName("v4only.example")}}
+		default:
+			response.header.rcode = RcodeNameError
+		}
+		if len(response.answers) == 0 {
+			response.authorities = []DnsAnswer{soaRecord("example", 900, SoaData{mname: "ns.example", rname: "hostmaster.example", serial: 1, minimum: 120})}
+		}
+		return response
+	})
+}
+
+func dns64Config(t *testing.T, extra string) *Config {
+	return testConfig(t, fmt.Sprintf("nameserver = %s\ndns64 = true\n%s", dns64Upstream(t), extra))
+}
+
+func queryDns64(t *testing.T, config *Config, qname string, qtype uint16) DnsPacket {
+	response, err := process(EncodeRequest(testRequest(qname, qtype)), nil, udpAddr("2001:db8:1::5"), config)
+	assert.NoError(t, err)
+	return DecodePacket(response)
+}
+
+func TestDns64Synthesis(t *testing.T) {
+	config := dns64Config(t, "")
+
+	response := queryDns64(t, config, "v4only.example", TypeAAAA)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Equal(t, "v4only.example", response.questions[0].qname)
+	assert.Equal(t, TypeAAAA, response.questions[0].qtype)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, TypeAAAA, response.answers[0].atype)
+	assert.Equal(t, net.ParseIP("64:ff9b::93.184.216.34"), net.IP(response.answers[0].rdata))
+	// the lesser of the A record and the negative answer
+	assert.Equal(t, uint32(120), response.answers[0].ttl)
+	assert.Empty(t, response.authorities)
+
+	response = queryDns64(t, config, "short.example", TypeAAAA)
+	assert.Equal(t, uint32(60), response.answers[0].ttl)
+
+	// the CNAME chain is kept
+	response = queryDns64(t, config, "alias.example", TypeAAAA)
+	assert.Len(t, response.answers, 2)
+	assert.Equal(t, TypeCNAME, response.answers[0].atype)
+	assert.Equal(t, "v4only.example", response.answers[1].name)
+	assert.Equal(t, net.ParseIP("64:ff9b::93.184.216.34"), net.IP(response.answers[1].rdata))
+
+	// real AAAA records win
+	response = queryDns64(t, config, "dual.example", TypeAAAA)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, net.ParseIP("2001:db8::36"), net.IP(response.answers[0].rdata))
+
+	// mapped addresses are excluded by default
+	response = queryDns64(t, config, "mapped.example", TypeAAAA)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, net.ParseIP("64:ff9b::93.184.216.37"), net.IP(response.answers[0].rdata))
+
+	// no private addresses in the well-known prefix
+	response = queryDns64(t, config, "private.example", TypeAAAA)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Empty(t, response.answers)
+
+	response = queryDns64(t, config, "missing.example", TypeAAAA)
+	assert.Equal(t, RcodeNameError, response.header.rcode)
+
+	// other types are untouched
+	response = queryDns64(t, config, "v4only.example", TypeA)
+	assert.Equal(t, []byte{93, 184, 216, 34}, response.answers[0].rdata)
+}
+
+func TestDns64Exclusions(t *testing.T) {
+	config := dns64Config(t, "dns64_prefix = 2001:db8:64::/96\ndns64_exclude = 2001:db8::/32, 93.184.216.34/32\n")
+
+	// private addresses are fine in a prefix of the network
+	response := queryDns64(t, config, "private.example", TypeAAAA)
+	assert.Equal(t, net.ParseIP("2001:db8:64::10.0.0.1"), net.IP(response.answers[0].rdata))
+
+	response = queryDns64(t, config, "v4only.example", TypeAAAA)
+	assert.Empty(t, response.answers)
+
+	// the excluded AAAA records count as missing
+	response = queryDns64(t, config, "dual.example", TypeAAAA)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, net.ParseIP("2001:db8:64::93.184.216.36"), net.IP(response.answers[0].rdata))
+}
+
+func TestDns64Ptr(t *testing.T) {
+	config := dns64Config(t, "")
+
+	name := reverseName(net.ParseIP("64:ff9b::93.184.216.34"))
+	response := queryDns64(t, config, name, TypePTR)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Equal(t, name, response.questions[0].qname)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, name, response.answers[0].name)
+	assert.Equal(t, EncodeName("v4only.example"), response.answers[0].rdata)
+
+	response = queryDns64(t, config, reverseName(net.ParseIP("64:ff9b::93.184.216.35")), TypePTR)
+	assert.Equal(t, RcodeNameError, response.header.rcode)
+}
+
+func TestDns64ClientGroups(t *testing.T) {
+	config := testConfig(t, fmt.Sprintf(`
+nameserver = %s
+[client.lab]
+networks = 2001:db8:1::/48
+dns64 = true
+`, dns64Upstream(t)))
+
+	response := queryDns64(t, config, "v4only.example", TypeAAAA)
+	assert.Len(t, response.answers, 1)
+
+	other, err := process(EncodeRequest(testRequest("v4only.example", TypeAAAA)), nil, udpAddr("2001:db8:2::5"), config)
+	assert.NoError(t, err)
+	assert.Empty(t, DecodePacket(other).answers)
+}
+
+func TestDns64Prefixes(t *testing.T) {
+	for _, prefix := range []string{"2001:db8::/32", "2001:db8:100::/40", "2001:db8:122::/48", "2001:db8:122:300::/56", "2001:db8:122:344::/64", "2001:db8:122:344::/96"} {
+		dns64, err := parseDns64(loadIni(t, "dns64_prefix = "+prefix).Section(""))
+		assert.NoError(t, err)
+		ip := dns64.synthesize(net.ParseIP("192.0.2.33"))
+		assert.Equal(t, byte(0), ip[8], prefix)
+		assert.Equal(t, net.ParseIP("192.0.2.33").To4(), dns64.address(ip), prefix)
+	}
+
+	// RFC 6052 section 2.4
+	dns64, _ := parseDns64(loadIni(t, "dns64_prefix = 2001:db8:122:300::/56").Section(""))
+	assert.Equal(t, net.ParseIP("2001:db8:122:3c0:0:221::"), dns64.synthesize(net.ParseIP("192.0.2.33")))
+	assert.Nil(t, dns64.address(net.ParseIP("2001:db8:123::1")))
+
+	for _, prefix := range []string{"192.0.2.0/24", "2001:db8::/72", "2001:db8::/33", "64:ff9b:0:0:ff00::/96"} {
+		_, err := parseDns64(loadIni(t, "dns64_prefix = "+prefix).Section(""))
+		assert.Error(t, err, prefix)
+	}
+	_, err := parseDns64(loadIni(t, "dns64_exclude = 10.0.0.1").Section(""))
+	assert.Error(t, err)
+}
+
+func TestDns64SinglePass(t *testing.T) {
+	config := dns64Config(t, `blacklist = blocked.example
+hosts = `+writeHosts(t, "93.184.216.40 nas.example\n"))
+
+	// the synthesized answer counts as one query
+	response := queryDns64(t, config, "v4only.example", TypeAAAA)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, uint64(1), config.stats.report(config.blocklists, 10).Queries)
+
+	// a blocked name gets no addresses from its A records
+	response = queryDns64(t, config, "blocked.example", TypeAAAA)
+	assert.Equal(t, RcodeRefused, response.header.rcode)
+	assert.Empty(t, response.answers)
+	assert.Equal(t, uint64(1), config.stats.report(config.blocklists, 10).Blocked)
+
+	// local names are synthesized too
+	response = queryDns64(t, config, "nas.example", TypeAAAA)
+	assert.Equal(t, net.ParseIP("64:ff9b::93.184.216.40"), net.IP(response.answers[0].rdata))
+}
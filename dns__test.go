@@ -55,6 +55,39 @@ func TestDecodeRequest(t *testing.T) {
 	assert.Equal(t, uint16(0x0001), dnsRequest.question.qclass)
 }
 
+func TestProcessMalformedRequest(t *testing.T) {
+	config := testConfig(t, "nameserver = 127.0.0.1:1\n")
+	query := BinaryString(`
+		db42 0100 0001 0000 0000 0000 0377 7777
+		0c6e 6f72 7468 6561 7374 6572 6e03 6564
+		7500 0001 0001
+	`)
+	malformed := [][]byte{
+		// one answer announced, none sent
+		append(append([]byte{}, query[:6]...), append([]byte{0, 1, 0, 0, 0, 0}, query[12:]...)...),
+		// a question cut short
+		query[:20],
+		// a label longer than the packet
+		append(append([]byte{}, query[:12]...), 0x3f, 'w', 'w', 'w'),
+		// an answer whose name points to itself
+		append(append(append([]byte{}, query[:6]...), append([]byte{0, 1, 0, 0, 0, 0}, query[12:]...)...), 0xc0, byte(len(query)), 0, 1, 0, 1, 0, 0, 0, 0, 0, 0),
+		// no question at all
+		query[:12],
+	}
+	for _, packet := range malformed {
+		response, err := process(packet, nil, udpAddr("192.168.1.5"), config)
+		assert.Error(t, err)
+		header := DecodeHeader(response)
+		assert.Equal(t, uint16(0xdb42), header.id)
+		assert.True(t, header.qr)
+		assert.Equal(t, RcodeFormatError, header.rcode)
+	}
+
+	response, err := process(query[:5], nil, udpAddr("192.168.1.5"), config)
+	assert.Error(t, err)
+	assert.Nil(t, response)
+}
+
 func TestEncodeRequest(t *testing.T) {
 	payload := "db42 0100 0001 0000 0000 0000 0377 7777" +
 		"0c6e 6f72 7468 6561 7374 6572 6e03 6564" +
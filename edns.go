@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// See also: https://datatracker.ietf.org/doc/html/rfc6891 and https://datatracker.ietf.org/doc/html/rfc8914
+
+const TypeOPT uint16 = 41
+
+const optionExtendedError uint16 = 15
+
+// Extended DNS Error codes
+const (
+	EdeOther                uint16 = 0
+	EdeStaleAnswer          uint16 = 3
+	EdeForgedAnswer         uint16 = 4
+	EdeBlocked              uint16 = 15
+	EdeCensored             uint16 = 16
+	EdeFiltered             uint16 = 17
+	EdeProhibited           uint16 = 18
+	EdeNotAuthoritative     uint16 = 20
+	EdeNotSupported         uint16 = 21
+	EdeNoReachableAuthority uint16 = 22
+	EdeNetworkError         uint16 = 23
+)
+
+/*
++---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+|                          OPTION-CODE                          |
++---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+|                         OPTION-LENGTH                         |
++---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+/                          OPTION-DATA                          /
++---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+*/
+type EdnsOption struct {
+	code uint16
+	data []byte
+}
+
+func EncodeEdnsOptions(options []EdnsOption) []byte {
+	var data []byte
+	for _, option := range options {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint16(header[0:2], option.code)
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(option.data)))
+		data = append(append(data, header...), option.data...)
+	}
+	return data
+}
+
+func DecodeEdnsOptions(data []byte) []EdnsOption {
+	var options []EdnsOption
+	for len(data) >= 4 {
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			break
+		}
+		options = append(options, EdnsOption{
+			code: binary.BigEndian.Uint16(data[0:2]),
+			data: data[4 : 4+length],
+		})
+		data = data[4+length:]
+	}
+	return options
+}
+
+func findOpt(records []DnsAnswer) *DnsAnswer {
+	for i := range records {
+		if records[i].atype == TypeOPT {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+// The OPT pseudo-record keeps the requestor's UDP payload size in the CLASS field
+// and the extended RCODE, version and flags in the TTL field.
+func optRecord(options []EdnsOption) DnsAnswer {
+	return DnsAnswer{
+		name:   "",
+		atype:  TypeOPT,
+		aclass: maxBufferSize,
+		ttl:    0,
+		rdata:  EncodeEdnsOptions(options),
+	}
+}
+
+func extendedErrorOption(code uint16, text string) EdnsOption {
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	return EdnsOption{code: optionExtendedError, data: append(data, text...)}
+}
+
+// withExtendedError attaches an Extended DNS Error to the response,
+// unless the client didn't advertise EDNS support in its request.
+func withExtendedError(request DnsRequest, response DnsPacket, code uint16, text string) DnsPacket {
+	if findOpt(request.additionals) == nil {
+		return response
+	}
+	if opt := findOpt(response.additionals); opt != nil {
+		options := append(DecodeEdnsOptions(opt.rdata), extendedErrorOption(code, text))
+		opt.rdata = EncodeEdnsOptions(options)
+		return response
+	}
+	response.additionals = append(response.additionals, optRecord([]EdnsOption{extendedErrorOption(code, text)}))
+	return response
+}
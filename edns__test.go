@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeRequestWithOpt(t *testing.T) {
+	// dig +edns www.example.com
+	data := BinaryString(`
+		1a2b 0120 0001 0000 0000 0001 0377 7777
+		0765 7861 6d70 6c65 0363 6f6d 0000 0100
+		0100 0029 1000 0000 0000 0000
+	`)
+	request := DecodeRequest(data)
+
+	assert.Equal(t, "www.example.com", request.question.qname)
+	opt := findOpt(request.additionals)
+	assert.NotNil(t, opt)
+	assert.Equal(t, uint16(4096), opt.aclass)
+	assert.Equal(t, data, EncodeRequest(request))
+}
+
+func TestExtendedErrorRequiresEdns(t *testing.T) {
+	request := testRequest("vk.com", TypeA)
+	response := withExtendedError(request, rejectResponse(request), EdeBlocked, "blocked")
+
+	assert.Empty(t, response.additionals)
+}
+
+func TestExtendedErrorOnBlockedAnswer(t *testing.T) {
+	config := testConfig(t, `blacklist = vk.com`)
+	request := testRequest("www.vk.com", TypeA)
+	request.additionals = []DnsAnswer{optRecord(nil)}
+
+	packet, err := process(EncodeRequest(request), nil, nil, config)
+	assert.NoError(t, err)
+
+	response := DecodePacket(packet)
+	opt := findOpt(response.additionals)
+	assert.NotNil(t, opt)
+	options := DecodeEdnsOptions(opt.rdata)
+	assert.Len(t, options, 1)
+	assert.Equal(t, optionExtendedError, options[0].code)
+	assert.Equal(t, EdeBlocked, binary.BigEndian.Uint16(options[0].data[0:2]))
+	assert.Equal(t, "blocked by blacklist:vk.com", string(options[0].data[2:]))
+}
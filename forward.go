@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ForwardRule sends the queries of a domain and its subdomains to name servers of its own.
+type ForwardRule struct {
+	domain      string
+	nameservers []string
+}
+
+// parseForwardRule reads a domain followed by name servers, with an optional port:
+//
+//	corp.example.com 10.0.0.1 10.0.0.2
+//	consul 127.0.0.1:8600
+func parseForwardRule(line string) (*ForwardRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("forward rule %q has no name server", line)
+	}
+	for _, nameserver := range fields[1:] {
+		if !isServerAddress(nameserver) {
+			return nil, fmt.Errorf("forward rule %q: invalid name server %q", line, nameserver)
+		}
+	}
+	return &ForwardRule{domain: normalizeName(fields[0]), nameservers: fields[1:]}, nil
+}
+
+// isServerAddress tells whether a value is an IP address with an optional port.
+func isServerAddress(value string) bool {
+	host, _, err := net.SplitHostPort(value)
+	if err != nil {
+		host = value
+	}
+	return net.ParseIP(host) != nil
+}
+
+func parseForwardRules(lines []string) ([]*ForwardRule, error) {
+	var rules []*ForwardRule
+	for _, line := range filter(lines, isNotEmpty) {
+		rule, err := parseForwardRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matchForwardRule returns the rule of the longest domain containing the hostname.
+func matchForwardRule(rules []*ForwardRule, hostname string) *ForwardRule {
+	hostname = strings.ToLower(hostname)
+	var longest *ForwardRule
+	for _, rule := range rules {
+		if isSubdomain(hostname, rule.domain) && (longest == nil || len(rule.domain) > len(longest.domain)) {
+			longest = rule
+		}
+	}
+	return longest
+}
+
+// upstreams are the name servers for a query of the group: those of the forward rule of
+// the name when there is one, the name servers of the group otherwise.
+func (config Config) upstreams(hostname string, group *ClientGroup) []string {
+	if rule := matchForwardRule(config.forwardRules, hostname); rule != nil {
+		return rule.nameservers
+	}
+	return group.nameservers
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchForwardRule(t *testing.T) {
+	rules, err := parseForwardRules([]string{
+		"example.com 10.0.0.1",
+		"corp.example.com 10.0.0.2 [fd00::2]:5353",
+		"consul 127.0.0.1:8600",
+		"",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"10.0.0.2", "[fd00::2]:5353"}, matchForwardRule(rules, "dc1.CORP.example.com").nameservers)
+	assert.Equal(t, []string{"10.0.0.1"}, matchForwardRule(rules, "www.example.com").nameservers)
+	assert.Equal(t, []string{"127.0.0.1:8600"}, matchForwardRule(rules, "web.service.consul").nameservers)
+	assert.Nil(t, matchForwardRule(rules, "notconsul"))
+	assert.Nil(t, matchForwardRule(rules, "vk.com"))
+
+	_, err = parseForwardRules([]string{"consul"})
+	assert.Error(t, err)
+	_, err = parseForwardRules([]string{"consul dns.local"})
+	assert.Error(t, err)
+}
+
+func TestNameserverAddress(t *testing.T) {
+	assert.Equal(t, "10.0.0.1:53", nameserverAddress("10.0.0.1"))
+	assert.Equal(t, "127.0.0.1:8600", nameserverAddress("127.0.0.1:8600"))
+	assert.Equal(t, "[fd00::1]:53", nameserverAddress("fd00::1"))
+	assert.Equal(t, "[fd00::1]:5353", nameserverAddress("[fd00::1]:5353"))
+}
+
+func TestConditionalForwarding(t *testing.T) {
+	answer := func(ip string) func(request DnsRequest) DnsPacket {
+		return func(request DnsRequest) DnsPacket {
+			return addressResponse(request, 60, []net.IP{net.ParseIP(ip)})
+		}
+	}
+	general := startUpstream(t, answer("192.0.2.1"))
+	consul := startUpstream(t, answer("10.1.1.1"))
+	config := testConfig(t, "nameserver = "+general+"\nforward = consul "+consul)
+
+	packet, err := process(EncodeRequest(testRequest("web.service.consul", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Equal(t, net.IP{10, 1, 1, 1}, net.IP(DecodePacket(packet).answers[0].rdata))
+
+	packet, err = process(EncodeRequest(testRequest("www.example.com", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Equal(t, net.IP{192, 0, 2, 1}, net.IP(DecodePacket(packet).answers[0].rdata))
+}
+
+func TestRewriteChasesForwardedDomain(t *testing.T) {
+	general := startUpstream(t, func(request DnsRequest) DnsPacket {
+		return newResponse(request, RcodeNameError)
+	})
+	corp := startUpstream(t, func(request DnsRequest) DnsPacket {
+		return addressResponse(request, 60, []net.IP{net.ParseIP("10.0.0.7")})
+	})
+	config := testConfig(t, "nameserver = "+general+"\nforward = corp.lan "+corp+"\nrewrites = wiki.example.com wiki.corp.lan")
+
+	packet, err := process(EncodeRequest(testRequest("wiki.example.com", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	response := DecodePacket(packet)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Len(t, response.answers, 2)
+	assert.Equal(t, net.IP{10, 0, 0, 7}, net.IP(response.answers[1].rdata))
+}
@@ -2,10 +2,15 @@ module godns
 
 go 1.17
 
+require (
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.17.0
+	gopkg.in/ini.v1 v1.66.2
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
-	gopkg.in/ini.v1 v1.66.2 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHostsTTL      = 300
+	defaultHostsInterval = 5 * time.Second
+)
+
+// Hosts answers from hosts files, "192.168.1.10 nas.lan nas" per line, reloaded when they change.
+type Hosts struct {
+	paths []string
+
+	mutex     sync.RWMutex
+	names     map[string][]net.IP // name to addresses
+	addresses map[string][]string // address to names, the canonical name first
+	versions  []string            // size and modification time of the files last loaded
+}
+
+func NewHosts(paths []string) *Hosts {
+	return &Hosts{
+		paths:     paths,
+		names:     make(map[string][]net.IP),
+		addresses: make(map[string][]string),
+	}
+}
+
+func (hosts *Hosts) isEnabled() bool {
+	return hosts != nil && len(hosts.paths) > 0
+}
+
+// load reads all the files, the records in use are kept when one of them is invalid.
+func (hosts *Hosts) load() error {
+	names := make(map[string][]net.IP)
+	addresses := make(map[string][]string)
+	versions := make([]string, len(hosts.paths))
+	for i, path := range hosts.paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err == nil {
+			versions[i] = fmt.Sprint(info.Size(), info.ModTime().UnixNano())
+			err = parseHosts(file, names, addresses)
+		}
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	hosts.mutex.Lock()
+	defer hosts.mutex.Unlock()
+	hosts.names, hosts.addresses, hosts.versions = names, addresses, versions
+	return nil
+}
+
+// isChanged compares the size and modification time of the files with the ones last loaded.
+func (hosts *Hosts) isChanged() bool {
+	hosts.mutex.RLock()
+	defer hosts.mutex.RUnlock()
+	for i, path := range hosts.paths {
+		info, err := os.Stat(path)
+		if err != nil || i >= len(hosts.versions) || hosts.versions[i] != fmt.Sprint(info.Size(), info.ModTime().UnixNano()) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files when they change.
+func (hosts *Hosts) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !hosts.isChanged() {
+			continue
+		}
+		if err := hosts.load(); err != nil {
+			fmt.Println("Failed to reload hosts files:", err)
+		} else {
+			fmt.Println("Reloaded hosts files:", strings.Join(hosts.paths, ", "))
+		}
+	}
+}
+
+func parseHosts(reader io.Reader, names map[string][]net.IP, addresses map[string][]string) error {
+	scanner := bufio.NewScanner(reader)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// zones of scoped addresses such as fe80::1%eth0 do not matter in answers
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("line %d: expected an address and names", number)
+		}
+		for _, field := range fields[1:] {
+			name := normalizeName(field)
+			names[name] = append(names[name], ip)
+			addresses[ip.String()] = append(addresses[ip.String()], name)
+		}
+	}
+	return scanner.Err()
+}
+
+// lookup answers a query from the files, ok is false when they know nothing of the name.
+// A known name asked for a type it lacks gets an empty answer.
+func (hosts *Hosts) lookup(qname string, qtype uint16) (answers []DnsAnswer, ok bool) {
+	hosts.mutex.RLock()
+	defer hosts.mutex.RUnlock()
+
+	name := strings.ToLower(qname)
+	if qtype == TypePTR {
+		if ip := reverseAddress(name); ip != nil {
+			targets, ok := hosts.addresses[ip.String()]
+			for _, target := range targets {
+				answers = append(answers, DnsAnswer{name: qname, atype: TypePTR, aclass: ClassIN, rdata: EncodeName(target)})
+			}
+			return answers, ok
+		}
+	}
+	addresses, ok := hosts.names[name]
+	if !ok {
+		return nil, false
+	}
+	switch qtype {
+	case TypeA, TypeAAAA:
+		answers = addressRecords(qname, qtype, 0, addresses)
+	case TypeANY:
+		answers = append(addressRecords(qname, TypeA, 0, addresses), addressRecords(qname, TypeAAAA, 0, addresses)...)
+	}
+	return answers, true
+}
+
+// hostsResponse answers from the records of the hosts files, NODATA when there are none of the type.
+func hostsResponse(request DnsRequest, answers []DnsAnswer, ttl uint32) DnsPacket {
+	if len(answers) == 0 {
+		return nodataResponse(request, ttl)
+	}
+	response := newResponse(request, RcodeSuccess)
+	for _, answer := range answers {
+		answer.ttl = ttl
+		response.answers = append(response.answers, answer)
+	}
+	return response
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const lanHosts = `
+# LAN devices
+192.168.1.10  nas.lan nas   # storage
+fd00::10      nas.lan
+192.168.1.20  Printer.LAN
+fe80::1%eth0  router.lan
+`
+
+func writeHosts(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "hosts")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestHostsLookup(t *testing.T) {
+	hosts := NewHosts([]string{writeHosts(t, lanHosts)})
+	assert.NoError(t, hosts.load())
+
+	answers, ok := hosts.lookup("NAS.lan", TypeA)
+	assert.True(t, ok)
+	assert.Equal(t, []DnsAnswer{addressRecord("NAS.lan", 0, net.ParseIP("192.168.1.10"))}, answers)
+
+	answers, ok = hosts.lookup("nas.lan", TypeAAAA)
+	assert.True(t, ok)
+	assert.Equal(t, []DnsAnswer{addressRecord("nas.lan", 0, net.ParseIP("fd00::10"))}, answers)
+
+	answers, ok = hosts.lookup("nas.lan", TypeANY)
+	assert.True(t, ok)
+	assert.Len(t, answers, 2)
+
+	answers, ok = hosts.lookup("printer.lan", TypeMX)
+	assert.True(t, ok)
+	assert.Empty(t, answers)
+
+	answers, ok = hosts.lookup("router.lan", TypeAAAA)
+	assert.True(t, ok)
+	assert.Len(t, answers, 1)
+
+	_, ok = hosts.lookup("example.com", TypeA)
+	assert.False(t, ok)
+}
+
+func TestHostsReverseLookup(t *testing.T) {
+	hosts := NewHosts([]string{writeHosts(t, lanHosts)})
+	assert.NoError(t, hosts.load())
+
+	answers, ok := hosts.lookup("10.1.168.192.in-addr.arpa", TypePTR)
+	assert.True(t, ok)
+	assert.Len(t, answers, 2)
+	name, _ := DecodeNameAt(answers[0].rdata, 0)
+	assert.Equal(t, "nas.lan", name)
+
+	answers, ok = hosts.lookup(reverseName(net.ParseIP("fd00::10")), TypePTR)
+	assert.True(t, ok)
+	assert.Len(t, answers, 1)
+
+	_, ok = hosts.lookup("1.1.168.192.in-addr.arpa", TypePTR)
+	assert.False(t, ok)
+}
+
+func TestReverseNames(t *testing.T) {
+	assert.Equal(t, "10.1.168.192.in-addr.arpa", reverseName(net.ParseIP("192.168.1.10")))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", reverseName(net.ParseIP("2001:db8::1")))
+	for _, address := range []string{"192.168.1.10", "2001:db8::1", "fd00:1234:5678:9abc:def0:1:2:3"} {
+		assert.True(t, net.ParseIP(address).Equal(reverseAddress(reverseName(net.ParseIP(address)))), address)
+	}
+	assert.Nil(t, reverseAddress("1.168.192.in-addr.arpa"))
+	assert.Nil(t, reverseAddress("example.com"))
+}
+
+func TestHostsReload(t *testing.T) {
+	path := writeHosts(t, "192.168.1.10 nas.lan\n")
+	hosts := NewHosts([]string{path})
+	assert.NoError(t, hosts.load())
+	assert.False(t, hosts.isChanged())
+
+	assert.NoError(t, os.WriteFile(path, []byte("192.168.1.11 nas.lan\n"), 0o644))
+	later := time.Now().Add(time.Second)
+	assert.NoError(t, os.Chtimes(path, later, later))
+	assert.True(t, hosts.isChanged())
+	assert.NoError(t, hosts.load())
+	answers, _ := hosts.lookup("nas.lan", TypeA)
+	assert.Equal(t, net.IP{192, 168, 1, 11}, net.IP(answers[0].rdata))
+
+	assert.NoError(t, os.WriteFile(path, []byte("garbage\n"), 0o644))
+	assert.Error(t, hosts.load())
+	answers, _ = hosts.lookup("nas.lan", TypeA)
+	assert.Len(t, answers, 1)
+}
+
+func TestHostsAnswerInProcess(t *testing.T) {
+	config := testConfig(t, "hosts = "+writeHosts(t, lanHosts)+"\nhosts_ttl = 60")
+
+	packet, err := process(EncodeRequest(testRequest("nas.lan", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	response := DecodePacket(packet)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, uint32(60), response.answers[0].ttl)
+
+	packet, err = process(EncodeRequest(testRequest("printer.lan", TypeAAAA)), nil, nil, config)
+	assert.NoError(t, err)
+	response = DecodePacket(packet)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Empty(t, response.answers)
+	assert.Len(t, response.authorities, 1)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// See also: https://www.unicode.org/reports/tr46 and https://www.unicode.org/reports/tr39
+
+// idnaProfile maps names as a resolver does (UTS 46, IDNA 2008 non-transitional) but allows
+// the underscores and other characters of ASCII names found in the wild.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.BidiRule(),
+	idna.StrictDomainName(false),
+)
+
+// toASCII converts the labels of an internationalized name to A-labels, "пример.рф" becomes
+// "xn--e1afmkfd.xn--p1ai". A leading "*." wildcard is kept.
+func toASCII(name string) (string, error) {
+	if isASCII(name) {
+		return strings.ToLower(name), nil
+	}
+	if strings.HasPrefix(name, "*.") {
+		converted, err := idnaProfile.ToASCII(name[2:])
+		return "*." + converted, err
+	}
+	return idnaProfile.ToASCII(name)
+}
+
+// toUnicode converts the A-labels of a name to Unicode for display, names which do not convert are kept.
+func toUnicode(name string) string {
+	if !strings.Contains(name, "xn--") {
+		return name
+	}
+	converted, err := idnaProfile.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return converted
+}
+
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// confusables maps characters to the Latin letters they are mistaken for, a small subset
+// of the confusables of UTS 39 covering the usual spoofing alphabets.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'ѕ': 's', 'т': 't', 'у': 'y', 'х': 'x', 'ԁ': 'd', 'ԛ': 'q',
+	'ԝ': 'w', 'ӏ': 'l', 'ё': 'e', 'ї': 'i',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	// Latin with diacritics and look-alike ASCII
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ç': 'c', 'è': 'e', 'é': 'e',
+	'ê': 'e', 'ë': 'e', 'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i', 'ı': 'i', 'ñ': 'n', 'ò': 'o',
+	'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o', 'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u',
+	'ý': 'y', 'ÿ': 'y', 'ḿ': 'm', 'ɡ': 'g', 'ʟ': 'l', 'ɩ': 'i',
+	'0': 'o', '1': 'l', '3': 'e', '5': 's',
+}
+
+// skeleton reduces a name to the letters a reader sees, two names with the same skeleton
+// are easily confused: "раураl.com" in Cyrillic and "paypa1.com" both read as "paypal.com".
+func skeleton(name string) string {
+	name = strings.ReplaceAll(toUnicode(strings.ToLower(name)), "rn", "m")
+	var sb strings.Builder
+	for _, c := range name {
+		if mapped, ok := confusables[c]; ok {
+			c = mapped
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// isLookalike reports whether the hostname, or one of its parents, reads as the domain
+// without being the domain or one of its subdomains.
+func isLookalike(hostname string, domain string) bool {
+	if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+		return false
+	}
+	target := skeleton(domain)
+	name := skeleton(hostname)
+	return name == target || strings.HasSuffix(name, "."+target)
+}
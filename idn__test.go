@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToASCII(t *testing.T) {
+	name, err := toASCII("Пример.РФ")
+	assert.NoError(t, err)
+	assert.Equal(t, "xn--e1afmkfd.xn--p1ai", name)
+
+	name, err = toASCII("*.bücher.de")
+	assert.NoError(t, err)
+	assert.Equal(t, "*.xn--bcher-kva.de", name)
+
+	name, err = toASCII("_dmarc.Example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "_dmarc.example.com", name)
+
+	assert.Equal(t, "пример.рф", toUnicode("xn--e1afmkfd.xn--p1ai"))
+}
+
+func TestUnicodeRulesMatchPunycode(t *testing.T) {
+	config := testConfig(t, "blacklist = пример.рф")
+	assert.True(t, config.isBlacklisted("www.xn--e1afmkfd.xn--p1ai"))
+	assert.False(t, config.isBlacklisted("example.com"))
+}
+
+func TestLookalikeRule(t *testing.T) {
+	config := testConfig(t, "blacklist = ~paypal.com")
+	cyrillic, err := toASCII("раураl.com")
+	assert.NoError(t, err)
+
+	assert.True(t, config.isBlacklisted(cyrillic))
+	assert.True(t, config.isBlacklisted("paypa1.com"))
+	assert.True(t, config.isBlacklisted("login.paypa1.com"))
+	assert.False(t, config.isBlacklisted("paypal.com"))
+	assert.False(t, config.isBlacklisted("www.paypal.com"))
+	assert.False(t, config.isBlacklisted("ebay.com"))
+	assert.Equal(t, "blacklist:~paypal.com", config.matchBlacklist("paypa1.com").String())
+}
+
+func TestDisplayUnicode(t *testing.T) {
+	assert.Equal(t, "xn--p1ai", testConfig(t, "").displayName("xn--p1ai"))
+	assert.Equal(t, "рф", testConfig(t, "display_unicode = true").displayName("xn--p1ai"))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A compiled blocklist index holds the names of a list, each reversed byte by byte and sorted
+// so that a lookup is a binary search done in place in the mapped file:
+//
+//	magic    [8]byte  "GODNSIDX"
+//	version  uint32
+//	count    uint32
+//	checksum uint32   CRC-32 (Castagnoli) of the offsets and the names
+//	offsets  [count+1]uint32, start of each name relative to the names
+//	names    reversed names, "*.example.com" is stored as "moc.elpmaxe.*"
+//
+// Integers are big endian as everywhere in DNS.
+
+const (
+	indexMagic      = "GODNSIDX"
+	indexVersion    = 1
+	indexHeaderSize = 20
+)
+
+var indexTable = crc32.MakeTable(crc32.Castagnoli)
+
+type BlockIndex struct {
+	data  []byte
+	count int
+	names int // offset of the names in data
+	unmap func() error
+}
+
+// compileIndex builds an index of the names, duplicates are removed.
+func compileIndex(names []string) []byte {
+	reversed := make([]string, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			reversed = append(reversed, reverseString(name))
+		}
+	}
+	sort.Strings(reversed)
+
+	body := make([]byte, 4*(len(reversed)+1))
+	offset := 0
+	for i, name := range reversed {
+		binary.BigEndian.PutUint32(body[4*i:], uint32(offset))
+		offset += len(name)
+	}
+	binary.BigEndian.PutUint32(body[4*len(reversed):], uint32(offset))
+	for _, name := range reversed {
+		body = append(body, name...)
+	}
+
+	header := make([]byte, indexHeaderSize)
+	copy(header, indexMagic)
+	binary.BigEndian.PutUint32(header[8:], indexVersion)
+	binary.BigEndian.PutUint32(header[12:], uint32(len(reversed)))
+	binary.BigEndian.PutUint32(header[16:], crc32.Checksum(body, indexTable))
+	return append(header, body...)
+}
+
+// openIndex checks the header and the checksum of an index held in memory.
+func openIndex(data []byte, source string) (*BlockIndex, error) {
+	if len(data) < indexHeaderSize || string(data[:8]) != indexMagic {
+		return nil, fmt.Errorf("%s: not a blocklist index", source)
+	}
+	if version := binary.BigEndian.Uint32(data[8:]); version != indexVersion {
+		return nil, fmt.Errorf("%s: unsupported index version %d", source, version)
+	}
+	count := int(binary.BigEndian.Uint32(data[12:]))
+	names := indexHeaderSize + 4*(count+1)
+	if names > len(data) || names+int(binary.BigEndian.Uint32(data[names-4:])) != len(data) {
+		return nil, fmt.Errorf("%s: truncated index", source)
+	}
+	if crc32.Checksum(data[indexHeaderSize:], indexTable) != binary.BigEndian.Uint32(data[16:]) {
+		return nil, fmt.Errorf("%s: index checksum mismatch", source)
+	}
+	return &BlockIndex{data: data, count: count, names: names}, nil
+}
+
+// loadIndex maps an index file in memory, shared with the other processes mapping it.
+func loadIndex(path string) (*BlockIndex, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index, err := openIndex(data, path)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	index.unmap = unmap
+	return index, nil
+}
+
+func (index *BlockIndex) close() error {
+	if index.unmap == nil {
+		return nil
+	}
+	return index.unmap()
+}
+
+func (index *BlockIndex) name(i int) []byte {
+	offsets := index.data[indexHeaderSize:]
+	start := binary.BigEndian.Uint32(offsets[4*i:])
+	end := binary.BigEndian.Uint32(offsets[4*i+4:])
+	return index.data[index.names+int(start) : index.names+int(end)]
+}
+
+func (index *BlockIndex) contains(reversed []byte) bool {
+	i := sort.Search(index.count, func(i int) bool {
+		return bytes.Compare(index.name(i), reversed) >= 0
+	})
+	return i < index.count && bytes.Equal(index.name(i), reversed)
+}
+
+// match finds the entry covering the hostname with the semantics of the rules of the lists:
+// "example.com" covers the name and its subdomains, "*.example.com" only the subdomains.
+func (index *BlockIndex) match(hostname string) (string, bool) {
+	if index.contains([]byte("*")) {
+		return "*", true
+	}
+	reversed := []byte(reverseString(hostname))
+	for end := len(reversed); end > 0; {
+		if index.contains(reversed[:end]) {
+			return reverseString(string(reversed[:end])), true
+		}
+		parent := bytes.LastIndexByte(reversed[:end], '.')
+		if parent < 0 {
+			break
+		}
+		if index.contains(append(append([]byte{}, reversed[:parent]...), '.', '*')) {
+			return "*." + reverseString(string(reversed[:parent])), true
+		}
+		end = parent
+	}
+	return "", false
+}
+
+// readListFile reads the names of a list file, one per line, "#" starts a comment.
+// Rules with options, lookalike rules and addresses cannot be compiled.
+func readListFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(file)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		_, _, cidrErr := net.ParseCIDR(fields[0])
+		if len(fields) > 1 || strings.HasPrefix(fields[0], "~") || cidrErr == nil || net.ParseIP(fields[0]) != nil {
+			return nil, fmt.Errorf("%s:%d: only plain names can be compiled, found %q", path, number, strings.TrimSpace(line))
+		}
+		name, err := toASCII(strings.TrimSuffix(fields[0], "."))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid name %q: %v", path, number, fields[0], err)
+		}
+		names = append(names, name)
+	}
+	return names, scanner.Err()
+}
+
+// compileLists is the compile command: godns compile output.idx list.txt...
+func compileLists(output string, paths []string) error {
+	var names []string
+	for _, path := range paths {
+		list, err := readListFile(path)
+		if err != nil {
+			return err
+		}
+		names = append(names, list...)
+	}
+	temporary := output + ".tmp"
+	if err := os.WriteFile(temporary, compileIndex(names), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, output)
+}
+
+func reverseString(value string) string {
+	reversed := make([]byte, len(value))
+	for i := 0; i < len(value); i++ {
+		reversed[len(value)-1-i] = value[i]
+	}
+	return string(reversed)
+}
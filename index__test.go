@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexMatch(t *testing.T) {
+	index, err := openIndex(compileIndex([]string{"vk.com", "*.ok.ru", "doubleclick.net", "vk.com"}), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, index.count)
+
+	for hostname, expected := range map[string]string{
+		"vk.com":                 "vk.com",
+		"m.vk.com":               "vk.com",
+		"www.ok.ru":              "*.ok.ru",
+		"ad.g.doubleclick.net":   "doubleclick.net",
+		"ok.ru":                  "",
+		"notvk.com":              "",
+		"com":                    "",
+		"doubleclick.net.evil.x": "",
+	} {
+		domain, ok := index.match(hostname)
+		assert.Equal(t, expected != "", ok, hostname)
+		assert.Equal(t, expected, domain, hostname)
+	}
+
+	index, err = openIndex(compileIndex([]string{"*"}), "test")
+	assert.NoError(t, err)
+	domain, ok := index.match("anything.example")
+	assert.True(t, ok)
+	assert.Equal(t, "*", domain)
+}
+
+func TestIndexRejectsCorruption(t *testing.T) {
+	data := compileIndex([]string{"vk.com"})
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	_, err := openIndex(corrupted, "test")
+	assert.EqualError(t, err, "test: index checksum mismatch")
+
+	_, err = openIndex(data[:len(data)-1], "test")
+	assert.EqualError(t, err, "test: truncated index")
+
+	outdated := append([]byte{}, data...)
+	outdated[11] = 9
+	_, err = openIndex(outdated, "test")
+	assert.EqualError(t, err, "test: unsupported index version 9")
+
+	_, err = openIndex([]byte("vk.com\n"), "test")
+	assert.Error(t, err)
+}
+
+func TestCompiledBlocklist(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "ads.txt")
+	assert.NoError(t, os.WriteFile(list, []byte("# ads\ndoubleclick.net\n*.tracker.example # comment\nпример.рф.\n\n"), 0o644))
+	index := filepath.Join(dir, "ads.idx")
+	assert.NoError(t, compileLists(index, []string{list}))
+
+	config := testConfig(t, "[blocklist.ads]\nindex = "+index)
+	assert.Equal(t, "ads:doubleclick.net", config.matchBlacklist("ad.doubleclick.net").String())
+	assert.True(t, config.isBlacklisted("a.tracker.example"))
+	assert.False(t, config.isBlacklisted("tracker.example"))
+	assert.True(t, config.isBlacklisted("xn--e1afmkfd.xn--p1ai"))
+	assert.NoError(t, config.blocklist("ads").index.close())
+
+	assert.NoError(t, os.WriteFile(list, []byte("vk.com mode=nxdomain\n"), 0o644))
+	assert.Error(t, compileLists(index, []string{list}))
+}
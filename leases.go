@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LeasesAuto    = "auto"
+	LeasesDnsmasq = "dnsmasq"
+	LeasesIsc     = "isc"
+)
+
+const defaultLocalDomain = "lan"
+
+// Lease is an address handed out by a DHCP server to a client which sent its hostname.
+type Lease struct {
+	hostname string
+	ip       net.IP
+	expires  time.Time // zero for leases which never expire
+}
+
+func (lease Lease) isActive(now time.Time) bool {
+	return lease.expires.IsZero() || now.Before(lease.expires)
+}
+
+// Leases publishes the hostnames of the active leases of a DHCP lease file under the local
+// domain, "laptop" leasing 192.168.1.23 is laptop.lan. The file is reloaded when it changes.
+type Leases struct {
+	path   string
+	format string
+	domain string
+
+	mutex   sync.RWMutex
+	leases  []Lease
+	version string // size and modification time of the file last loaded
+}
+
+func NewLeases(path string, format string, domain string) (*Leases, error) {
+	if format != LeasesAuto && format != LeasesDnsmasq && format != LeasesIsc {
+		return nil, fmt.Errorf("unknown lease file format %q", format)
+	}
+	return &Leases{path: path, format: format, domain: normalizeName(domain)}, nil
+}
+
+func (leases *Leases) isEnabled() bool {
+	return leases != nil && leases.path != ""
+}
+
+func (leases *Leases) load() error {
+	data, err := os.ReadFile(leases.path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(leases.path)
+	if err != nil {
+		return err
+	}
+
+	format := leases.format
+	if format == LeasesAuto {
+		format = LeasesDnsmasq
+		if bytes.Contains(data, []byte("lease ")) && bytes.Contains(data, []byte("{")) {
+			format = LeasesIsc
+		}
+	}
+	var parsed []Lease
+	if format == LeasesIsc {
+		parsed, err = parseIscLeases(bytes.NewReader(data))
+	} else {
+		parsed, err = parseDnsmasqLeases(bytes.NewReader(data))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", leases.path, err)
+	}
+
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
+	leases.leases = parsed
+	leases.version = fmt.Sprint(info.Size(), info.ModTime().UnixNano())
+	return nil
+}
+
+func (leases *Leases) isChanged() bool {
+	leases.mutex.RLock()
+	defer leases.mutex.RUnlock()
+	info, err := os.Stat(leases.path)
+	return err != nil || leases.version != fmt.Sprint(info.Size(), info.ModTime().UnixNano())
+}
+
+// watch reloads the file when the DHCP server writes it.
+func (leases *Leases) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !leases.isChanged() {
+			continue
+		}
+		if err := leases.load(); err != nil {
+			fmt.Println("Failed to reload DHCP leases:", err)
+		}
+	}
+}
+
+// lookup answers A, AAAA and PTR queries from the leases active at now, ok is false when
+// no active lease knows the name. The TTL never outlives the lease.
+func (leases *Leases) lookup(qname string, qtype uint16, ttl uint32, now time.Time) (answers []DnsAnswer, ok bool) {
+	if !leases.isEnabled() {
+		return nil, false
+	}
+	leases.mutex.RLock()
+	defer leases.mutex.RUnlock()
+
+	name := strings.ToLower(qname)
+	reverse := reverseAddress(name)
+	for _, lease := range leases.leases {
+		if !lease.isActive(now) {
+			continue
+		}
+		recordTTL := ttl
+		if remaining := lease.expires.Sub(now) / time.Second; !lease.expires.IsZero() && remaining < time.Duration(ttl) {
+			recordTTL = uint32(remaining)
+		}
+		hostname := lease.hostname + "." + leases.domain
+		switch {
+		case qtype == TypePTR && reverse != nil && reverse.Equal(lease.ip):
+			ok = true
+			answers = append(answers, DnsAnswer{name: qname, atype: TypePTR, aclass: ClassIN, ttl: recordTTL, rdata: EncodeName(hostname)})
+		case name == hostname:
+			ok = true
+			if qtype == TypeANY {
+				answers = append(answers, addressRecord(qname, recordTTL, lease.ip))
+			} else {
+				answers = append(answers, addressRecords(qname, qtype, recordTTL, []net.IP{lease.ip})...)
+			}
+		}
+	}
+	return answers, ok
+}
+
+// leaseHostname keeps the hostnames which make a valid label, lowercased.
+func leaseHostname(hostname string) string {
+	hostname = strings.ToLower(strings.TrimSpace(hostname))
+	if hostname == "" || hostname == "*" || len(hostname) > 63 || hostname[0] == '-' || hostname[len(hostname)-1] == '-' {
+		return ""
+	}
+	for _, c := range hostname {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return ""
+		}
+	}
+	return hostname
+}
+
+// parseDnsmasqLeases reads the lease file of dnsmasq:
+//
+//	1760900000 00:11:22:33:44:55 192.168.1.23 laptop 01:00:11:22:33:44:55
+//	duid 00:01:00:01:2c:4f:5e:6d:00:11:22:33:44:55
+//	1760900000 1234 fd00::23 laptop 00:01:00:01:2c:4f:5e:6d:00:11:22:33:44:55
+//
+// The expiry is in seconds since the epoch, 0 for infinite leases, and "*" an unknown hostname.
+func parseDnsmasqLeases(reader io.Reader) ([]Lease, error) {
+	var leases []Lease
+	scanner := bufio.NewScanner(reader)
+	number := 0
+	for scanner.Scan() {
+		number++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected expiry, hardware address, address and hostname", number)
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		ip := net.ParseIP(fields[2])
+		if err != nil || ip == nil {
+			return nil, fmt.Errorf("line %d: invalid lease", number)
+		}
+		hostname := leaseHostname(fields[3])
+		if hostname == "" {
+			continue
+		}
+		lease := Lease{hostname: hostname, ip: ip}
+		if expiry != 0 {
+			lease.expires = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// parseIscLeases reads the dhcpd.leases file of ISC dhcpd, where later entries of an address
+// supersede the earlier ones:
+//
+//	lease 192.168.1.23 {
+//	  starts 1 2026/10/19 10:00:00;
+//	  ends 1 2026/10/19 22:00:00;
+//	  binding state active;
+//	  client-hostname "laptop";
+//	}
+func parseIscLeases(reader io.Reader) ([]Lease, error) {
+	var leases []Lease
+	index := make(map[string]int)
+	var current *Lease
+	active := true
+
+	scanner := bufio.NewScanner(reader)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if end := strings.IndexByte(line, ';'); end >= 0 {
+			line = line[:end]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "lease" && len(fields) == 3 && fields[2] == "{":
+			ip := net.ParseIP(fields[1])
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: invalid lease address", number)
+			}
+			current, active = &Lease{ip: ip}, true
+		case current == nil:
+			// other declarations such as server-duid or failover peer
+		case fields[0] == "}":
+			position, known := index[current.ip.String()]
+			if !known {
+				position = len(leases)
+				index[current.ip.String()] = position
+				leases = append(leases, Lease{})
+			}
+			if !active {
+				current.hostname = ""
+			}
+			leases[position] = *current
+			current = nil
+		case fields[0] == "ends":
+			expires, err := parseIscTime(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", number, err)
+			}
+			current.expires = expires
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			active = fields[2] == "active"
+		case fields[0] == "client-hostname" && len(fields) == 2:
+			current.hostname = leaseHostname(strings.Trim(fields[1], `"`))
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("unterminated lease of %s", current.ip)
+	}
+
+	valid := leases[:0]
+	for _, lease := range leases {
+		if lease.hostname != "" {
+			valid = append(valid, lease)
+		}
+	}
+	return valid, scanner.Err()
+}
+
+// parseIscTime reads "4 2026/10/19 22:00:00" in UTC, "epoch 1760900000" or "never".
+func parseIscTime(fields []string) (time.Time, error) {
+	switch {
+	case len(fields) == 1 && fields[0] == "never":
+		return time.Time{}, nil
+	case len(fields) >= 2 && fields[0] == "epoch":
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(fields, " "))
+		}
+		return time.Unix(seconds, 0), nil
+	case len(fields) >= 3:
+		return time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(fields, " "))
+}
+
+// leasesResponse answers with the records of the leases, which carry their own TTL.
+func leasesResponse(request DnsRequest, answers []DnsAnswer, ttl uint32) DnsPacket {
+	if len(answers) == 0 {
+		return nodataResponse(request, ttl)
+	}
+	response := newResponse(request, RcodeSuccess)
+	response.answers = answers
+	return response
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const dnsmasqLeases = `1760900000 00:11:22:33:44:55 192.168.1.23 Laptop 01:00:11:22:33:44:55
+0 00:11:22:33:44:66 192.168.1.24 nas *
+1760900000 00:11:22:33:44:77 192.168.1.25 * *
+duid 00:01:00:01:2c:4f:5e:6d:00:11:22:33:44:55
+1760900000 1234 fd00::23 laptop 00:01:00:01:2c:4f:5e:6d:00:11:22:33:44:55
+`
+
+const iscLeases = `# The format of this file is documented in the dhcpd.leases(5) manual page.
+server-duid "\000\001\000\001";
+
+lease 192.168.1.30 {
+  starts 0 2025/10/19 10:00:00;
+  ends 0 2025/10/19 22:00:00;
+  binding state active;
+  client-hostname "phone";
+}
+lease 192.168.1.31 {
+  ends never;
+  binding state active;
+  client-hostname "printer";
+}
+lease 192.168.1.32 {
+  ends epoch 1760900000; # Sun Oct 19 18:53:20 2025
+  binding state free;
+  client-hostname "gone";
+}
+lease 192.168.1.30 {
+  ends 2 2025/10/21 22:00:00;
+  binding state active;
+  client-hostname "phone";
+}
+`
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	leases, err := parseDnsmasqLeases(strings.NewReader(dnsmasqLeases))
+	assert.NoError(t, err)
+	assert.Len(t, leases, 3)
+	assert.Equal(t, "laptop", leases[0].hostname)
+	assert.Equal(t, time.Unix(1760900000, 0), leases[0].expires)
+	assert.True(t, leases[1].expires.IsZero())
+	assert.Equal(t, net.ParseIP("fd00::23"), leases[2].ip)
+
+	_, err = parseDnsmasqLeases(strings.NewReader("garbage\n"))
+	assert.Error(t, err)
+}
+
+func TestParseIscLeases(t *testing.T) {
+	leases, err := parseIscLeases(strings.NewReader(iscLeases))
+	assert.NoError(t, err)
+	assert.Len(t, leases, 2)
+	assert.Equal(t, "phone", leases[0].hostname)
+	assert.Equal(t, time.Date(2025, 10, 21, 22, 0, 0, 0, time.UTC), leases[0].expires)
+	assert.Equal(t, "printer", leases[1].hostname)
+	assert.True(t, leases[1].expires.IsZero())
+
+	_, err = parseIscLeases(strings.NewReader("lease 192.168.1.30 {\n"))
+	assert.Error(t, err)
+}
+
+func TestLeasesLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	assert.NoError(t, os.WriteFile(path, []byte(dnsmasqLeases), 0o644))
+	leases, err := NewLeases(path, LeasesAuto, "home.arpa")
+	assert.NoError(t, err)
+	assert.NoError(t, leases.load())
+	now := time.Unix(1760900000-60, 0)
+
+	answers, ok := leases.lookup("laptop.home.arpa", TypeA, 300, now)
+	assert.True(t, ok)
+	assert.Len(t, answers, 1)
+	assert.Equal(t, uint32(60), answers[0].ttl)
+
+	answers, ok = leases.lookup("laptop.home.arpa", TypeAAAA, 300, now)
+	assert.True(t, ok)
+	assert.Equal(t, net.ParseIP("fd00::23"), net.IP(answers[0].rdata))
+
+	answers, ok = leases.lookup("24.1.168.192.in-addr.arpa", TypePTR, 300, now)
+	assert.True(t, ok)
+	name, _ := DecodeNameAt(answers[0].rdata, 0)
+	assert.Equal(t, "nas.home.arpa", name)
+	assert.Equal(t, uint32(300), answers[0].ttl)
+
+	answers, ok = leases.lookup("nas.home.arpa", TypeMX, 300, now)
+	assert.True(t, ok)
+	assert.Empty(t, answers)
+
+	// expired leases are dropped
+	_, ok = leases.lookup("laptop.home.arpa", TypeA, 300, now.Add(time.Hour))
+	assert.False(t, ok)
+	_, ok = leases.lookup("laptop", TypeA, 300, now)
+	assert.False(t, ok)
+}
+
+func TestLeasesInProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	assert.NoError(t, os.WriteFile(path, []byte(iscLeases), 0o644))
+	config := testConfig(t, "dhcp_leases = "+path)
+	assert.Equal(t, LeasesAuto, config.leases.format)
+
+	packet, err := process(EncodeRequest(testRequest("printer.lan", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Equal(t, net.IP{192, 168, 1, 31}, net.IP(DecodePacket(packet).answers[0].rdata))
+
+	packet, _ = process(EncodeRequest(testRequest("31.1.168.192.in-addr.arpa", TypePTR)), nil, nil, config)
+	name, _ := DecodeNameAt(DecodePacket(packet).answers[0].rdata, 0)
+	assert.Equal(t, "printer.lan", name)
+
+	_, err = parseConfig(loadIni(t, "dhcp_leases = "+path+"\ndhcp_leases_format = kea"))
+	assert.Error(t, err)
+}
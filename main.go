@@ -1,6 +1,20 @@
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "compile" {
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: godns compile output.idx list.txt...")
+			os.Exit(2)
+		}
+		exitOnError(compileLists(os.Args[2], os.Args[3:]), "Failed to compile blocklists: %v\n")
+		return
+	}
+
 	config := readConfig("config.ini")
 	server := NewDnsProxyServer(5300, config)
 	server.run()
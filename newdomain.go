@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type NewDomainAction int
+
+const (
+	NewDomainOff NewDomainAction = iota
+	NewDomainLog
+	NewDomainBlock
+)
+
+var newDomainActionNames = map[string]NewDomainAction{
+	"off":   NewDomainOff,
+	"log":   NewDomainLog,
+	"block": NewDomainBlock,
+}
+
+const (
+	defaultNewDomainAge      = 24 * time.Hour
+	defaultNewDomainLearning = 24 * time.Hour
+	defaultMaxObservedDomain = 100000
+	newDomainSaveInterval    = time.Minute
+)
+
+// ObservedDomain is when a registrable domain was resolved first and last.
+type ObservedDomain struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// observedFile is the content of newly_observed_file, the domains and the start of the learning period.
+type observedFile struct {
+	Started time.Time                  `json:"started"`
+	Domains map[string]*ObservedDomain `json:"domains"`
+}
+
+// NewDomains remembers the registrable domains resolved by the proxy. When more than
+// maxEntries are known the least recently seen ones are forgotten, so that a domain
+// nobody asks for any more may be reported as new again.
+type NewDomains struct {
+	action     NewDomainAction
+	age        time.Duration
+	maxEntries int
+	learning   time.Duration // nothing is blocked for this long after the first query
+
+	mutex   sync.Mutex
+	domains map[string]*ObservedDomain
+	path    string
+	dirty   bool
+	started time.Time
+}
+
+func NewNewDomains(action NewDomainAction, age time.Duration, maxEntries int, path string) *NewDomains {
+	return &NewDomains{
+		action:     action,
+		age:        age,
+		maxEntries: maxEntries,
+		domains:    make(map[string]*ObservedDomain),
+		path:       path,
+	}
+}
+
+func (newDomains *NewDomains) isEnabled() bool {
+	return newDomains != nil && newDomains.action != NewDomainOff
+}
+
+// check reports whether the registrable domain of the hostname was first resolved less than
+// the configured age before now, or never.
+func (newDomains *NewDomains) check(hostname string, now time.Time) (domain string, firstSeen time.Time, isNew bool) {
+	domain = registrableDomain(hostname)
+
+	newDomains.mutex.Lock()
+	defer newDomains.mutex.Unlock()
+
+	if newDomains.started.IsZero() {
+		newDomains.started = now
+		newDomains.dirty = true
+	}
+	observed, ok := newDomains.domains[domain]
+	if !ok {
+		return domain, now, true
+	}
+	return domain, observed.FirstSeen, now.Sub(observed.FirstSeen) < newDomains.age
+}
+
+// isLearning tells whether the domains are still only learned, not blocked.
+func (newDomains *NewDomains) isLearning(now time.Time) bool {
+	newDomains.mutex.Lock()
+	defer newDomains.mutex.Unlock()
+	return newDomains.started.IsZero() || now.Before(newDomains.started.Add(newDomains.learning))
+}
+
+// observe records the registrable domain of a hostname which was resolved.
+func (newDomains *NewDomains) observe(hostname string, now time.Time) {
+	domain := registrableDomain(hostname)
+
+	newDomains.mutex.Lock()
+	defer newDomains.mutex.Unlock()
+
+	observed, ok := newDomains.domains[domain]
+	if !ok {
+		observed = &ObservedDomain{FirstSeen: now, LastSeen: now}
+		newDomains.domains[domain] = observed
+		newDomains.evictLocked()
+	}
+	observed.LastSeen = now
+	newDomains.dirty = true
+}
+
+// observeResponse records the domain of a query when the upstream resolved it, names
+// which do not exist or fail are not seen.
+func (newDomains *NewDomains) observeResponse(hostname string, response []byte, now time.Time) {
+	if !newDomains.isEnabled() || len(response) < 12 || DecodeHeader(response[0:12]).rcode != RcodeSuccess {
+		return
+	}
+	newDomains.observe(hostname, now)
+}
+
+// evictLocked forgets a tenth of the domains, the least recently seen, once there are too many.
+func (newDomains *NewDomains) evictLocked() {
+	if newDomains.maxEntries <= 0 || len(newDomains.domains) <= newDomains.maxEntries {
+		return
+	}
+	names := make([]string, 0, len(newDomains.domains))
+	for name := range newDomains.domains {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return newDomains.domains[names[i]].LastSeen.Before(newDomains.domains[names[j]].LastSeen)
+	})
+	for _, name := range names[:len(names)-newDomains.maxEntries*9/10] {
+		delete(newDomains.domains, name)
+	}
+}
+
+func (newDomains *NewDomains) load() error {
+	newDomains.mutex.Lock()
+	defer newDomains.mutex.Unlock()
+
+	if newDomains.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(newDomains.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var file observedFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Domains == nil {
+		// the files of older versions only hold the domains
+		return json.Unmarshal(data, &newDomains.domains)
+	}
+	newDomains.started = file.Started
+	newDomains.domains = file.Domains
+	return nil
+}
+
+// save writes the domains to the file when they changed since the last save.
+func (newDomains *NewDomains) save() error {
+	newDomains.mutex.Lock()
+	defer newDomains.mutex.Unlock()
+
+	if newDomains.path == "" || !newDomains.dirty {
+		return nil
+	}
+	data, err := json.Marshal(observedFile{Started: newDomains.started, Domains: newDomains.domains})
+	if err != nil {
+		return err
+	}
+	temporary := newDomains.path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary, newDomains.path); err != nil {
+		return err
+	}
+	newDomains.dirty = false
+	return nil
+}
+
+// persist saves the domains periodically, observing every query would be too slow to save each time.
+func (newDomains *NewDomains) persist(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := newDomains.save(); err != nil {
+			fmt.Println("Failed to save observed domains:", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDomainsAge(t *testing.T) {
+	newDomains := NewNewDomains(NewDomainLog, 24*time.Hour, 10, "")
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	domain, firstSeen, isNew := newDomains.check("WWW.Example.com", now)
+	assert.Equal(t, "example.com", domain)
+	assert.Equal(t, now, firstSeen)
+	assert.True(t, isNew)
+	// checking does not record the domain
+	assert.Empty(t, newDomains.domains)
+
+	newDomains.observe("WWW.Example.com", now)
+	_, firstSeen, isNew = newDomains.check("mail.example.com", now.Add(23*time.Hour))
+	assert.Equal(t, now, firstSeen)
+	assert.True(t, isNew)
+
+	_, _, isNew = newDomains.check("example.com", now.Add(24*time.Hour))
+	assert.False(t, isNew)
+}
+
+func TestNewDomainsEviction(t *testing.T) {
+	newDomains := NewNewDomains(NewDomainLog, time.Hour, 10, "")
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		newDomains.observe(string(rune('a'+i))+".com", now.Add(time.Duration(i)*time.Second))
+	}
+	newDomains.observe("k.com", now.Add(time.Minute))
+
+	assert.Len(t, newDomains.domains, 9)
+	assert.NotContains(t, newDomains.domains, "a.com")
+	assert.NotContains(t, newDomains.domains, "b.com")
+	assert.Contains(t, newDomains.domains, "k.com")
+}
+
+func TestNewDomainsPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "observed.json")
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	newDomains := NewNewDomains(NewDomainBlock, time.Hour, 10, path)
+	newDomains.check("example.com", now)
+	newDomains.observe("example.com", now)
+	assert.NoError(t, newDomains.save())
+
+	restored := NewNewDomains(NewDomainBlock, time.Hour, 10, path)
+	restored.learning = time.Hour
+	assert.NoError(t, restored.load())
+	_, firstSeen, isNew := restored.check("example.com", now.Add(2*time.Hour))
+	assert.True(t, firstSeen.Equal(now))
+	assert.False(t, isNew)
+	// the learning period started before the restart
+	assert.False(t, restored.isLearning(now.Add(2*time.Hour)))
+
+	// the files of older versions only hold the domains
+	assert.NoError(t, os.WriteFile(path, []byte(`{"example.net":{"first_seen":"2026-10-19T12:00:00Z","last_seen":"2026-10-19T12:00:00Z"}}`), 0o644))
+	legacy := NewNewDomains(NewDomainBlock, time.Hour, 10, path)
+	assert.NoError(t, legacy.load())
+	assert.Contains(t, legacy.domains, "example.net")
+}
+
+func TestNewDomainsBlock(t *testing.T) {
+	config := testConfig(t, "newly_observed = block\nnewly_observed_learning = 0\nblock_mode = nxdomain")
+	packet, err := process(EncodeRequest(testRequest("fresh.example.com", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeNameError, DecodePacket(packet).header.rcode)
+	// a blocked name is seen, and allowed once old enough
+	assert.Contains(t, config.newDomains.domains, "example.com")
+	assert.False(t, testConfig(t, "").newDomains.isEnabled())
+
+	_, err = parseConfig(loadIni(t, "newly_observed = sometimes"))
+	assert.Error(t, err)
+}
+
+func TestNewDomainsResolved(t *testing.T) {
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		if request.question.qname == "missing.example.com" {
+			return newResponse(request, RcodeNameError)
+		}
+		response := newResponse(request, RcodeSuccess)
+		response.answers = []DnsAnswer{addressRecord(request.question.qname, 300, net.ParseIP("192.0.2.1"))}
+		return response
+	})
+	config := testConfig(t, "newly_observed = block\nnameserver = "+upstream+`
+[client.lan]
+networks = 192.168.1.0/24
+allowlist = allowed.com
+`)
+	config.clock = fixedClock("2026-10-19T12:00:00Z")
+	query := func(qname string) DnsPacket {
+		packet, err := process(EncodeRequest(testRequest(qname, TypeA)), nil, udpAddr("192.168.1.5"), config)
+		assert.NoError(t, err)
+		return DecodePacket(packet)
+	}
+
+	// nothing is blocked while learning, only the resolved names are seen
+	assert.Equal(t, RcodeSuccess, query("www.example.com").header.rcode)
+	assert.Equal(t, RcodeNameError, query("missing.example.com").header.rcode)
+	assert.Contains(t, config.newDomains.domains, "example.com")
+	assert.NotContains(t, config.newDomains.domains, "missing.example.com")
+
+	config.clock = fixedClock("2026-10-20T12:00:00Z")
+	assert.Equal(t, RcodeRefused, query("fresh.example.org").header.rcode)
+	assert.Contains(t, config.newDomains.domains, "example.org")
+	config.clock = fixedClock("2026-10-21T13:00:00Z")
+	assert.Equal(t, RcodeSuccess, query("fresh.example.org").header.rcode)
+	assert.Equal(t, RcodeSuccess, query("allowed.com").header.rcode)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Override temporarily allows a domain and its subdomains, for every client when client is empty.
+type Override struct {
+	Domain  string    `json:"domain"`
+	Client  string    `json:"client,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// Overrides holds the temporary overrides in memory, optionally persisted to a file
+// so that they survive a restart.
+type Overrides struct {
+	mutex   sync.Mutex
+	entries []Override
+	path    string
+}
+
+func NewOverrides(path string) *Overrides {
+	return &Overrides{path: path}
+}
+
+func (overrides *Overrides) allow(domain string, client net.IP, until time.Time) error {
+	overrides.mutex.Lock()
+	defer overrides.mutex.Unlock()
+
+	override := Override{Domain: normalizeName(domain), Expires: until}
+	if client != nil {
+		override.Client = client.String()
+	}
+	overrides.removeLocked(override.Domain, override.Client)
+	overrides.entries = append(overrides.entries, override)
+	return overrides.saveLocked()
+}
+
+func (overrides *Overrides) remove(domain string, client net.IP) error {
+	overrides.mutex.Lock()
+	defer overrides.mutex.Unlock()
+
+	clientName := ""
+	if client != nil {
+		clientName = client.String()
+	}
+	overrides.removeLocked(normalizeName(domain), clientName)
+	return overrides.saveLocked()
+}
+
+func (overrides *Overrides) removeLocked(domain string, client string) {
+	entries := overrides.entries[:0]
+	for _, override := range overrides.entries {
+		if override.Domain != domain || override.Client != client {
+			entries = append(entries, override)
+		}
+	}
+	overrides.entries = entries
+}
+
+// isAllowed reports whether an override in effect at now covers the hostname for the client.
+func (overrides *Overrides) isAllowed(hostname string, client net.IP, now time.Time) bool {
+	if overrides == nil {
+		return false
+	}
+	overrides.mutex.Lock()
+	defer overrides.mutex.Unlock()
+
+	hostname = strings.ToLower(hostname)
+	for _, override := range overrides.entries {
+		if !now.Before(override.Expires) {
+			continue
+		}
+		if override.Client != "" && (client == nil || override.Client != client.String()) {
+			continue
+		}
+		if hostname == override.Domain || strings.HasSuffix(hostname, "."+override.Domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// active returns the overrides in effect at now, sorted by expiry, and forgets the expired ones.
+func (overrides *Overrides) active(now time.Time) []Override {
+	overrides.mutex.Lock()
+	defer overrides.mutex.Unlock()
+
+	entries := overrides.entries[:0]
+	for _, override := range overrides.entries {
+		if now.Before(override.Expires) {
+			entries = append(entries, override)
+		}
+	}
+	overrides.entries = entries
+
+	result := append([]Override{}, entries...)
+	sort.Slice(result, func(i, j int) bool { return result[i].Expires.Before(result[j].Expires) })
+	return result
+}
+
+func (overrides *Overrides) load() error {
+	overrides.mutex.Lock()
+	defer overrides.mutex.Unlock()
+
+	if overrides.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(overrides.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &overrides.entries)
+}
+
+func (overrides *Overrides) saveLocked() error {
+	if overrides.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(overrides.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := overrides.path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, overrides.path)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideExpires(t *testing.T) {
+	overrides := NewOverrides("")
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	assert.NoError(t, overrides.allow("VK.com", nil, now.Add(15*time.Minute)))
+
+	assert.True(t, overrides.isAllowed("www.vk.com", nil, now))
+	assert.True(t, overrides.isAllowed("vk.com", net.ParseIP("10.0.0.1"), now.Add(14*time.Minute)))
+	assert.False(t, overrides.isAllowed("vk.com", nil, now.Add(15*time.Minute)))
+	assert.False(t, overrides.isAllowed("mail.ru", nil, now))
+	assert.Empty(t, overrides.active(now.Add(time.Hour)))
+}
+
+func TestOverrideForOneClient(t *testing.T) {
+	overrides := NewOverrides("")
+	now := time.Now()
+	client := net.ParseIP("192.168.1.5")
+
+	assert.NoError(t, overrides.allow("vk.com", client, now.Add(time.Minute)))
+
+	assert.True(t, overrides.isAllowed("vk.com", client, now))
+	assert.False(t, overrides.isAllowed("vk.com", net.ParseIP("192.168.1.6"), now))
+	assert.False(t, overrides.isAllowed("vk.com", nil, now))
+
+	assert.NoError(t, overrides.remove("vk.com", client))
+	assert.False(t, overrides.isAllowed("vk.com", client, now))
+}
+
+func TestOverridesPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	now := time.Now()
+
+	assert.NoError(t, NewOverrides(path).allow("vk.com", nil, now.Add(time.Hour)))
+
+	restarted := NewOverrides(path)
+	assert.NoError(t, restarted.load())
+	assert.True(t, restarted.isAllowed("vk.com", nil, now))
+}
+
+func TestOverrideBypassesBlacklist(t *testing.T) {
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		response := newResponse(request, RcodeSuccess)
+		response.answers = []DnsAnswer{addressRecord(request.question.qname, 60, net.ParseIP("87.240.132.78"))}
+		return response
+	})
+	config := testConfig(t, "blacklist = vk.com\nnameserver = "+upstream)
+	request := EncodeRequest(testRequest("vk.com", TypeA))
+
+	packet, _ := process(request, nil, udpAddr("10.0.0.1"), config)
+	assert.Equal(t, RcodeRefused, DecodePacket(packet).header.rcode)
+
+	assert.NoError(t, config.overrides.allow("vk.com", net.ParseIP("10.0.0.1"), config.now().Add(time.Minute)))
+
+	packet, err := process(request, nil, udpAddr("10.0.0.1"), config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeSuccess, DecodePacket(packet).header.rcode)
+	assert.Len(t, DecodePacket(packet).answers, 1)
+
+	packet, _ = process(request, nil, udpAddr("10.0.0.2"), config)
+	assert.Equal(t, RcodeRefused, DecodePacket(packet).header.rcode)
+}
+
+// adminRequest is a change request of the admin API, as sent by a script.
+func adminRequest(method string, target string) *http.Request {
+	request := httptest.NewRequest(method, target, nil)
+	request.Header.Set(adminRequestHeader, "1")
+	return request
+}
+
+func TestAdminOverridesApi(t *testing.T) {
+	config := testConfig(t, "blacklist = vk.com")
+	handler := NewDnsProxyServer(0, config).adminHandler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, adminRequest(http.MethodPost, "/overrides?domain=vk.com&duration=10m"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"domain":"vk.com"`)
+	assert.True(t, config.overrides.isAllowed("vk.com", nil, config.now()))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, adminRequest(http.MethodPost, "/overrides?domain=vk.com"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, adminRequest(http.MethodDelete, "/overrides?domain=vk.com"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.False(t, config.overrides.isAllowed("vk.com", nil, config.now()))
+}
+
+func TestAdminCrossSiteRequest(t *testing.T) {
+	config := testConfig(t, "blacklist = vk.com")
+	handler := NewDnsProxyServer(0, config).adminHandler()
+
+	// what a form of a web page can post to the loopback address
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/overrides?domain=vk.com&duration=10m", nil))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.False(t, config.overrides.isAllowed("vk.com", nil, config.now()))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/overrides", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestAdminToken(t *testing.T) {
+	_, err := parseConfig(loadIni(t, "admin_address = :8053"))
+	assert.Error(t, err)
+	_, err = parseConfig(loadIni(t, "admin_address = 192.168.1.2:8053"))
+	assert.Error(t, err)
+	testConfig(t, "admin_address = [::1]:8053")
+	testConfig(t, "admin_address = localhost:8053")
+
+	config := testConfig(t, "admin_address = :8053\nadmin_token = secret-token")
+	handler := NewDnsProxyServer(0, config).adminHandler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/overrides?domain=vk.com&duration=10m", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.False(t, config.overrides.isAllowed("vk.com", nil, config.now()))
+
+	request := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	request.Header.Set("Authorization", "Bearer wrong-token")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodPost, "/overrides?domain=vk.com&duration=10m", nil)
+	request.Header.Set("Authorization", "Bearer secret-token")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, config.overrides.isAllowed("vk.com", nil, config.now()))
+}
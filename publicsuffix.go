@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// See also: https://publicsuffix.org, the list is embedded in golang.org/x/net/publicsuffix
+
+// publicSuffix returns the public suffix of a name, icann tells whether it comes from the ICANN
+// section of the list rather than from the private one. Names of unlisted TLDs are their own suffix.
+func publicSuffix(name string) (suffix string, icann bool) {
+	return publicsuffix.PublicSuffix(strings.ToLower(name))
+}
+
+func isPublicSuffix(name string) bool {
+	name = strings.ToLower(name)
+	suffix, _ := publicSuffix(name)
+	return suffix == name
+}
+
+// registrableDomain returns the eTLD+1 of a name: "www.bbc.co.uk" belongs to "bbc.co.uk".
+// A public suffix is returned as is.
+func registrableDomain(name string) string {
+	name = strings.ToLower(name)
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	return domain
+}
+
+// publicSuffixWarnings reports the rules of the lists which block a whole public suffix,
+// usually a mistake such as "co.uk" or a typo.
+func publicSuffixWarnings(lists []*BlockList) []string {
+	var warnings []string
+	for _, list := range lists {
+		for _, rule := range list.rules {
+			domain := strings.TrimPrefix(rule.domain, "*.")
+			if rule.network != nil || rule.lookalike || domain == "*" || !isPublicSuffix(domain) {
+				continue
+			}
+			warnings = append(warnings, "rule "+rule.String()+" covers the public suffix "+domain+", every domain under it is blocked")
+		}
+	}
+	return warnings
+}
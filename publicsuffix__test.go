@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistrableDomain(t *testing.T) {
+	assert.Equal(t, "bbc.co.uk", registrableDomain("www.news.BBC.co.uk"))
+	assert.Equal(t, "google.com", registrableDomain("mail.google.com"))
+	assert.Equal(t, "example.blogspot.com", registrableDomain("www.example.blogspot.com"))
+	assert.Equal(t, "co.uk", registrableDomain("co.uk"))
+	assert.Equal(t, "nas.lan", registrableDomain("files.nas.lan"))
+}
+
+func TestPublicSuffix(t *testing.T) {
+	suffix, icann := publicSuffix("www.bbc.co.uk")
+	assert.Equal(t, "co.uk", suffix)
+	assert.True(t, icann)
+
+	assert.True(t, isPublicSuffix("co.uk"))
+	assert.True(t, isPublicSuffix("COM"))
+	assert.False(t, isPublicSuffix("vk.com"))
+}
+
+func TestPublicSuffixWarnings(t *testing.T) {
+	config := testConfig(t, `
+blacklist = """
+vk.com
+co.uk
+*.com.ru
+10.0.0.0/8
+"""
+
+[blocklist.typos]
+domains = cm
+`)
+	assert.Equal(t, []string{
+		"rule blacklist:co.uk covers the public suffix co.uk, every domain under it is blocked",
+		"rule blacklist:*.com.ru covers the public suffix com.ru, every domain under it is blocked",
+		"rule typos:cm covers the public suffix cm, every domain under it is blocked",
+	}, config.warnings)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Resource record types, see https://www.iana.org/assignments/dns-parameters
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeDNAME uint16 = 39
+)
+
+const (
+	TypeHINFO uint16 = 13
+	TypeSRV   uint16 = 33
+	TypeDS    uint16 = 43
+	TypeTSIG  uint16 = 250
+	TypeIXFR  uint16 = 251
+	TypeAXFR  uint16 = 252
+	TypeANY   uint16 = 255
+)
+
+var typeNames = map[string]uint16{
+	"A":     TypeA,
+	"NS":    TypeNS,
+	"CNAME": TypeCNAME,
+	"SOA":   TypeSOA,
+	"PTR":   TypePTR,
+	"HINFO": TypeHINFO,
+	"MX":    TypeMX,
+	"TXT":   TypeTXT,
+	"AAAA":  TypeAAAA,
+	"SRV":   TypeSRV,
+	"DNAME": TypeDNAME,
+	"OPT":   TypeOPT,
+	"DS":    TypeDS,
+	"IXFR":  TypeIXFR,
+	"AXFR":  TypeAXFR,
+	"ANY":   TypeANY,
+}
+
+// parseType reads a record type by its mnemonic or in the generic TYPE123 notation of RFC 3597.
+func parseType(name string) (uint16, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if qtype, ok := typeNames[name]; ok {
+		return qtype, nil
+	}
+	if strings.HasPrefix(name, "TYPE") {
+		if value, err := strconv.ParseUint(name[4:], 10, 16); err == nil {
+			return uint16(value), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type %q", name)
+}
+
+func typeName(qtype uint16) string {
+	for name, value := range typeNames {
+		if value == qtype {
+			return name
+		}
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+const ClassIN uint16 = 1
+
+// Classes of the records of UPDATE messages which delete or test for absence, see RFC 2136
+const (
+	ClassNONE uint16 = 254
+	ClassANY  uint16 = 255
+)
+
+// Operation codes, see the opcode field of DnsHeader
+const (
+	OpcodeQuery  uint8 = 0
+	OpcodeNotify uint8 = 4
+	OpcodeUpdate uint8 = 5
+)
+
+// Response codes, see the rcode field of DnsHeader
+const (
+	RcodeSuccess        uint8 = 0
+	RcodeFormatError    uint8 = 1
+	RcodeServerFailure  uint8 = 2
+	RcodeNameError      uint8 = 3
+	RcodeNotImplemented uint8 = 4
+	RcodeRefused        uint8 = 5
+	RcodeYXDomain       uint8 = 6
+	RcodeYXRRSet        uint8 = 7
+	RcodeNXRRSet        uint8 = 8
+	RcodeNotAuth        uint8 = 9
+	RcodeNotZone        uint8 = 10
+)
+
+/*
+SOA RDATA format
+
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+/                     MNAME                     /
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+/                     RNAME                     /
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+|                    SERIAL                     |
+|                    REFRESH                    |
+|                     RETRY                     |
+|                    EXPIRE                     |
+|                    MINIMUM                    |
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+*/
+type SoaData struct {
+	mname   string
+	rname   string
+	serial  uint32
+	refresh uint32
+	retry   uint32
+	expire  uint32
+	minimum uint32
+}
+
+func EncodeSoaData(soa SoaData) []byte {
+	data := append(EncodeName(soa.mname), EncodeName(soa.rname)...)
+	timers := make([]byte, 20)
+	binary.BigEndian.PutUint32(timers[0:4], soa.serial)
+	binary.BigEndian.PutUint32(timers[4:8], soa.refresh)
+	binary.BigEndian.PutUint32(timers[8:12], soa.retry)
+	binary.BigEndian.PutUint32(timers[12:16], soa.expire)
+	binary.BigEndian.PutUint32(timers[16:20], soa.minimum)
+	return append(data, timers...)
+}
+
+func addressRecord(name string, ttl uint32, ip net.IP) DnsAnswer {
+	if ip4 := ip.To4(); ip4 != nil {
+		return DnsAnswer{name: name, atype: TypeA, aclass: ClassIN, ttl: ttl, rdata: []byte(ip4)}
+	}
+	return DnsAnswer{name: name, atype: TypeAAAA, aclass: ClassIN, ttl: ttl, rdata: []byte(ip.To16())}
+}
+
+// addressRecords keeps the addresses of the family asked for by qtype.
+func addressRecords(name string, qtype uint16, ttl uint32, addresses []net.IP) []DnsAnswer {
+	var records []DnsAnswer
+	for _, ip := range addresses {
+		isIPv4 := ip.To4() != nil
+		if (qtype == TypeA && isIPv4) || (qtype == TypeAAAA && !isIPv4) {
+			records = append(records, addressRecord(name, ttl, ip))
+		}
+	}
+	return records
+}
+
+func cnameRecord(name string, ttl uint32, target string) DnsAnswer {
+	return DnsAnswer{name: name, atype: TypeCNAME, aclass: ClassIN, ttl: ttl, rdata: EncodeName(target)}
+}
+
+func soaRecord(name string, ttl uint32, soa SoaData) DnsAnswer {
+	return DnsAnswer{name: name, atype: TypeSOA, aclass: ClassIN, ttl: ttl, rdata: EncodeSoaData(soa)}
+}
+
+// reverseAddress reads the address of a name of in-addr.arpa or ip6.arpa, nil when the name
+// does not stand for a whole address: "10.1.168.192.in-addr.arpa" is 192.168.1.10.
+func reverseAddress(name string) net.IP {
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+	if strings.HasSuffix(name, ".ip6.arpa") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			value, err := strconv.ParseUint(nibble, 16, 8)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			// the first label is the lowest nibble of the last byte
+			position := 31 - i
+			ip[position/2] |= byte(value) << (4 * uint(1-position%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// reverseName is the name of the PTR record of an address.
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var sb strings.Builder
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "%x.%x.", ip[i]&0x0f, ip[i]>>4)
+	}
+	return sb.String() + "ip6.arpa"
+}
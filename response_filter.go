@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// matchResponse inspects upstream answers for CNAME-cloaked trackers and blocked addresses.
+// It returns the matching rule together with the answer that triggered it.
+func (group *ClientGroup) matchResponse(response DnsPacket, qtype uint16, now time.Time) (*BlockRule, string) {
+	for _, answer := range response.answers {
+		switch answer.atype {
+		case TypeCNAME, TypeDNAME:
+			target, _ := DecodeNameAt(answer.rdata, 0)
+			if rule := group.matchBlacklist(target, qtype, now); rule != nil {
+				return rule, target
+			}
+		case TypeA, TypeAAAA:
+			ip := net.IP(answer.rdata)
+			if rule := group.matchBlacklistAddress(ip, now); rule != nil {
+				return rule, ip.String()
+			}
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodePacketWithCompression(t *testing.T) {
+	data := BinaryString(`db42 8180 0001 0001 0000 0000 0377 7777
+		0c6e 6f72 7468 6561 7374 6572 6e03 6564
+		7500 0001 0001 c00c 0001 0001 0000 0258
+		0004 9b21 1144
+	`)
+	packet := DecodePacket(data)
+
+	assert.Equal(t, "www.northeastern.edu", packet.answers[0].name)
+	assert.Equal(t, BinaryString("9b21 1144"), packet.answers[0].rdata)
+}
+
+// www.example.com. CNAME metrics.tracker.net., metrics.tracker.net. A 198.51.100.7
+var cnameResponse = `
+	0001 8180 0001 0002 0000 0000
+	0377 7777 0765 7861 6d70 6c65 0363 6f6d 00 0001 0001
+	c00c 0005 0001 0000 003c 0015
+	076d 6574 7269 6373 0774 7261 636b 6572 036e 6574 00
+	c02d 0001 0001 0000 003c 0004 c633 6407
+`
+
+func TestDecodeCnameTarget(t *testing.T) {
+	packet := DecodePacket(BinaryString(cnameResponse))
+
+	assert.Len(t, packet.answers, 2)
+	target, _ := DecodeNameAt(packet.answers[0].rdata, 0)
+	assert.Equal(t, "metrics.tracker.net", target)
+	assert.Equal(t, "metrics.tracker.net", packet.answers[1].name)
+}
+
+func TestMatchResponseCname(t *testing.T) {
+	config := testConfig(t, `blacklist = tracker.net`)
+
+	rule, answer := config.defaultGroup.matchResponse(DecodePacket(BinaryString(cnameResponse)), TypeA, config.now())
+	assert.NotNil(t, rule)
+	assert.Equal(t, "metrics.tracker.net", answer)
+}
+
+func TestMatchResponseAddress(t *testing.T) {
+	config := testConfig(t, `blacklist = """
+198.51.100.0/24
+"""`)
+
+	rule, answer := config.defaultGroup.matchResponse(DecodePacket(BinaryString(cnameResponse)), TypeA, config.now())
+	assert.NotNil(t, rule)
+	assert.Equal(t, "198.51.100.7", answer)
+	assert.False(t, config.isBlacklisted("198.51.100.7"))
+}
+
+func TestMatchResponseAllowed(t *testing.T) {
+	config := testConfig(t, `blacklist = """
+vk.com
+203.0.113.1
+"""`)
+
+	rule, _ := config.defaultGroup.matchResponse(DecodePacket(BinaryString(cnameResponse)), TypeA, config.now())
+	assert.Nil(t, rule)
+}
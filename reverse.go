@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// See also: https://datatracker.ietf.org/doc/html/rfc6303
+
+// privateReverseZones are the reverse zones of private and special addresses which
+// resolvers answer locally instead of asking the public name servers.
+var privateReverseZones = func() []string {
+	zones := []string{
+		"10.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"0.in-addr.arpa",
+		"127.in-addr.arpa",
+		"254.169.in-addr.arpa",
+		"2.0.192.in-addr.arpa",
+		"100.51.198.in-addr.arpa",
+		"113.0.203.in-addr.arpa",
+		"255.255.255.255.in-addr.arpa",
+		strings.Repeat("0.", 32) + "ip6.arpa",
+		"1." + strings.Repeat("0.", 31) + "ip6.arpa",
+		"d.f.ip6.arpa",
+		"8.e.f.ip6.arpa",
+		"9.e.f.ip6.arpa",
+		"a.e.f.ip6.arpa",
+		"b.e.f.ip6.arpa",
+		"8.b.d.0.1.0.0.2.ip6.arpa",
+	}
+	for i := 16; i < 32; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa", i))
+	}
+	return zones
+}()
+
+const privateReverseTTL = 10800
+
+// privateReverseZone returns the private reverse zone containing the name, "" when there is none.
+func privateReverseZone(name string) string {
+	name = strings.ToLower(name)
+	for _, zone := range privateReverseZones {
+		if isSubdomain(name, zone) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// privateReverseResponse answers from the empty zone of RFC 6303: NXDOMAIN for the names below
+// the apex, the SOA and NS records at the apex.
+func privateReverseResponse(request DnsRequest, zone string) DnsPacket {
+	soa := soaRecord(zone, privateReverseTTL, SoaData{
+		mname:   zone,
+		rname:   "nobody.invalid",
+		serial:  1,
+		refresh: 604800,
+		retry:   86400,
+		expire:  2419200,
+		minimum: privateReverseTTL,
+	})
+	if strings.ToLower(request.question.qname) != zone {
+		response := newResponse(request, RcodeNameError)
+		response.header.aa = true
+		response.authorities = []DnsAnswer{soa}
+		return response
+	}
+
+	response := newResponse(request, RcodeSuccess)
+	response.header.aa = true
+	switch request.question.qtype {
+	case TypeSOA:
+		response.answers = []DnsAnswer{soa}
+	case TypeNS:
+		response.answers = []DnsAnswer{{name: zone, atype: TypeNS, aclass: ClassIN, ttl: privateReverseTTL, rdata: EncodeName(zone)}}
+	default:
+		response.authorities = []DnsAnswer{soa}
+	}
+	return response
+}
+
+// PtrTemplate synthesizes names of private addresses, "ip-{ip}.lan" names 10.0.0.5 "ip-10-0-0-5.lan"
+// and fd00::5 "ip-fd00--5.lan".
+type PtrTemplate struct {
+	prefix string
+	suffix string
+}
+
+func parsePtrTemplate(template string) (*PtrTemplate, error) {
+	if template == "" {
+		return nil, nil
+	}
+	parts := strings.Split(normalizeName(template), "{ip}")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("ptr_template %q must contain {ip} once", template)
+	}
+	return &PtrTemplate{prefix: parts[0], suffix: parts[1]}, nil
+}
+
+func (template *PtrTemplate) name(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return template.prefix + strings.NewReplacer(".", "-", ":", "-").Replace(ip.String()) + template.suffix
+}
+
+// address reads the private address of a synthesized name, nil for other names.
+func (template *PtrTemplate) address(name string) net.IP {
+	name = strings.ToLower(name)
+	if template == nil || !strings.HasPrefix(name, template.prefix) || !strings.HasSuffix(name, template.suffix) ||
+		len(name) <= len(template.prefix)+len(template.suffix) {
+		return nil
+	}
+	dashed := name[len(template.prefix) : len(name)-len(template.suffix)]
+	ip := net.ParseIP(strings.ReplaceAll(dashed, "-", "."))
+	if ip == nil {
+		ip = net.ParseIP(strings.ReplaceAll(dashed, "-", ":"))
+	}
+	if ip == nil || privateReverseZone(reverseName(ip)) == "" {
+		return nil
+	}
+	return ip
+}
+
+// ptrResponse answers a reverse query of a private address with the synthesized name.
+func (template *PtrTemplate) ptrResponse(request DnsRequest, ip net.IP, ttl uint32) DnsPacket {
+	if request.question.qtype != TypePTR && request.question.qtype != TypeANY {
+		return nodataResponse(request, ttl)
+	}
+	response := newResponse(request, RcodeSuccess)
+	response.header.aa = true
+	response.answers = []DnsAnswer{{name: request.question.qname, atype: TypePTR, aclass: ClassIN, ttl: ttl, rdata: EncodeName(template.name(ip))}}
+	return response
+}
+
+// addressResponse answers a query of a synthesized name with its address.
+func (template *PtrTemplate) addressResponse(request DnsRequest, ip net.IP, ttl uint32) DnsPacket {
+	qtype := request.question.qtype
+	if qtype == TypeANY {
+		qtype = addressRecord("", 0, ip).atype
+	}
+	answers := addressRecords(request.question.qname, qtype, ttl, []net.IP{ip})
+	if len(answers) == 0 {
+		return nodataResponse(request, ttl)
+	}
+	response := newResponse(request, RcodeSuccess)
+	response.header.aa = true
+	response.answers = answers
+	return response
+}
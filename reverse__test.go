@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivateReverseZone(t *testing.T) {
+	assert.Equal(t, "10.in-addr.arpa", privateReverseZone("5.0.0.10.in-addr.arpa"))
+	assert.Equal(t, "20.172.in-addr.arpa", privateReverseZone(reverseName(net.ParseIP("172.20.1.1"))))
+	assert.Equal(t, "", privateReverseZone(reverseName(net.ParseIP("172.32.1.1"))))
+	assert.Equal(t, "d.f.ip6.arpa", privateReverseZone(reverseName(net.ParseIP("fd00::5"))))
+	assert.Equal(t, "", privateReverseZone(reverseName(net.ParseIP("8.8.8.8"))))
+	assert.Equal(t, "", privateReverseZone("example.com"))
+}
+
+func TestPrivateReverseResponse(t *testing.T) {
+	config := testConfig(t, "")
+
+	packet, err := process(EncodeRequest(testRequest("5.0.0.10.in-addr.arpa", TypePTR)), nil, nil, config)
+	assert.NoError(t, err)
+	response := DecodePacket(packet)
+	assert.Equal(t, RcodeNameError, response.header.rcode)
+	assert.True(t, response.header.aa)
+	assert.Equal(t, "10.in-addr.arpa", response.authorities[0].name)
+
+	packet, _ = process(EncodeRequest(testRequest("168.192.in-addr.arpa", TypeSOA)), nil, nil, config)
+	response = DecodePacket(packet)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Equal(t, TypeSOA, response.answers[0].atype)
+}
+
+func TestPrivateReverseFromLocalRecords(t *testing.T) {
+	config := testConfig(t, "hosts = "+writeHosts(t, "10.0.0.5 printer.lan\n"))
+
+	packet, err := process(EncodeRequest(testRequest("5.0.0.10.in-addr.arpa", TypePTR)), nil, nil, config)
+	assert.NoError(t, err)
+	response := DecodePacket(packet)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	name, _ := DecodeNameAt(response.answers[0].rdata, 0)
+	assert.Equal(t, "printer.lan", name)
+}
+
+func TestPrivateReverseForwarded(t *testing.T) {
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		response := newResponse(request, RcodeSuccess)
+		response.answers = []DnsAnswer{{name: request.question.qname, atype: TypePTR, aclass: ClassIN, ttl: 60, rdata: EncodeName("dc1.corp.example.com")}}
+		return response
+	})
+	config := testConfig(t, "forward = 10.in-addr.arpa "+upstream)
+
+	packet, err := process(EncodeRequest(testRequest("5.0.0.10.in-addr.arpa", TypePTR)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Len(t, DecodePacket(packet).answers, 1)
+
+	config = testConfig(t, "private_reverse = false\nnameserver = "+upstream)
+	packet, _ = process(EncodeRequest(testRequest("5.0.0.10.in-addr.arpa", TypePTR)), nil, nil, config)
+	assert.Len(t, DecodePacket(packet).answers, 1)
+}
+
+func TestPtrTemplate(t *testing.T) {
+	template, err := parsePtrTemplate("ip-{ip}.LAN")
+	assert.NoError(t, err)
+	assert.Equal(t, "ip-10-0-0-5.lan", template.name(net.ParseIP("10.0.0.5")))
+	assert.Equal(t, "ip-fd00--5.lan", template.name(net.ParseIP("fd00::5")))
+	assert.Equal(t, net.ParseIP("10.0.0.5").To4(), template.address("IP-10-0-0-5.lan").To4())
+	assert.Equal(t, net.ParseIP("fd00::5"), template.address("ip-fd00--5.lan"))
+	assert.Nil(t, template.address("ip-8-8-8-8.lan"))
+	assert.Nil(t, template.address("ip-.lan"))
+	assert.Nil(t, template.address("www.lan"))
+
+	_, err = parsePtrTemplate("host.lan")
+	assert.Error(t, err)
+	template, err = parsePtrTemplate("")
+	assert.NoError(t, err)
+	assert.Nil(t, template.address("ip-10-0-0-5.lan"))
+}
+
+func TestPtrSynthesis(t *testing.T) {
+	config := testConfig(t, "ptr_template = ip-{ip}.lan")
+
+	packet, err := process(EncodeRequest(testRequest("5.0.0.10.in-addr.arpa", TypePTR)), nil, nil, config)
+	assert.NoError(t, err)
+	response := DecodePacket(packet)
+	name, _ := DecodeNameAt(response.answers[0].rdata, 0)
+	assert.Equal(t, "ip-10-0-0-5.lan", name)
+
+	packet, _ = process(EncodeRequest(testRequest("ip-10-0-0-5.lan", TypeA)), nil, nil, config)
+	response = DecodePacket(packet)
+	assert.Equal(t, net.IP{10, 0, 0, 5}, net.IP(response.answers[0].rdata))
+
+	packet, _ = process(EncodeRequest(testRequest("ip-10-0-0-5.lan", TypeAAAA)), nil, nil, config)
+	response = DecodePacket(packet)
+	assert.Empty(t, response.answers)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const defaultRewriteTTL = 300
+
+const maxRewriteHops = 8
+
+// Rewrite answers a name locally, either with fixed addresses or with a CNAME to another name.
+type Rewrite struct {
+	domain    string // an exact name, "*.example.com" matches the subdomains only
+	target    string // CNAME target, empty for address rewrites
+	addresses []net.IP
+}
+
+func (rewrite *Rewrite) matches(hostname string) bool {
+	if strings.HasPrefix(rewrite.domain, "*.") {
+		return strings.HasSuffix(hostname, rewrite.domain[1:])
+	}
+	return hostname == rewrite.domain
+}
+
+// parseRewrite reads a rewrite line, which is a domain followed by either addresses or a CNAME target:
+//
+//	nas.lan 192.168.1.10 fd00::10
+//	www.example.org example.net
+func parseRewrite(line string) (*Rewrite, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("rewrite %q has no target", line)
+	}
+	rewrite := &Rewrite{domain: normalizeName(fields[0])}
+	if net.ParseIP(fields[1]) == nil {
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("rewrite %q has more than one CNAME target", line)
+		}
+		rewrite.target = normalizeName(fields[1])
+		return rewrite, nil
+	}
+	addresses, err := parseAddresses(fields[1:])
+	if err != nil {
+		return nil, err
+	}
+	rewrite.addresses = addresses
+	return rewrite, nil
+}
+
+func parseRewrites(lines []string) ([]*Rewrite, error) {
+	var rewrites []*Rewrite
+	for _, line := range filter(lines, isNotEmpty) {
+		rewrite, err := parseRewrite(line)
+		if err != nil {
+			return nil, err
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites, nil
+}
+
+func (group *ClientGroup) matchRewrite(hostname string) *Rewrite {
+	hostname = strings.ToLower(hostname)
+	for _, rewrite := range group.rewrites {
+		if rewrite.matches(hostname) {
+			return rewrite
+		}
+	}
+	return nil
+}
+
+// rewriteResponse follows the CNAME chain of the rewrites and answers with the addresses
+// at its end. When the chain leaves the local rewrites the rest is resolved upstream, by the
+// name servers of its forward rule if any.
+func rewriteResponse(request DnsRequest, rewrite *Rewrite, group *ClientGroup, config *Config) (DnsPacket, error) {
+	ttl := config.rewriteTTL
+	question := request.question
+	response := newResponse(request, RcodeSuccess)
+	name := question.qname
+	for hops := 0; hops < maxRewriteHops; hops++ {
+		if rewrite.target == "" {
+			response.answers = append(response.answers, addressRecords(name, question.qtype, ttl, rewrite.addresses)...)
+			return response, nil
+		}
+		response.answers = append(response.answers, cnameRecord(name, ttl, rewrite.target))
+		name = rewrite.target
+		if question.qtype == TypeCNAME {
+			return response, nil
+		}
+		if rewrite = group.matchRewrite(name); rewrite == nil {
+			upstream, err := resolve(name, question.qtype, config.upstreams(name, group))
+			if err != nil {
+				return response, err
+			}
+			response.header.rcode = upstream.header.rcode
+			response.answers = append(response.answers, upstream.answers...)
+			return response, nil
+		}
+	}
+	return response, fmt.Errorf("too many rewrites for %s", question.qname)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startUpstream runs a nameserver on a local port answering with the handler.
+func startUpstream(t *testing.T, handler func(request DnsRequest) DnsPacket) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, maxBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(EncodePacket(handler(DecodeRequest(buffer[:n]))), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestParseRewrite(t *testing.T) {
+	rewrite, err := parseRewrite("NAS.lan. 192.168.1.10 fd00::10")
+	assert.NoError(t, err)
+	assert.Equal(t, "nas.lan", rewrite.domain)
+	assert.Len(t, rewrite.addresses, 2)
+
+	rewrite, err = parseRewrite("www.example.org example.net")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.net", rewrite.target)
+
+	_, err = parseRewrite("www.example.org")
+	assert.Error(t, err)
+}
+
+func TestAddressRewrite(t *testing.T) {
+	config := testConfig(t, `
+blacklist = nas.lan
+rewrites = """
+nas.lan 192.168.1.10 fd00::10
+*.dev.lan 192.168.1.20
+"""
+`)
+	packet, err := process(EncodeRequest(testRequest("nas.lan", TypeAAAA)), nil, nil, config)
+	assert.NoError(t, err)
+
+	response := DecodePacket(packet)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, []byte(net.ParseIP("fd00::10")), response.answers[0].rdata)
+	assert.Equal(t, uint32(defaultRewriteTTL), response.answers[0].ttl)
+
+	assert.NotNil(t, config.defaultGroup.matchRewrite("box.dev.lan"))
+	assert.Nil(t, config.defaultGroup.matchRewrite("dev.lan"))
+}
+
+func TestLocalCnameRewriteChain(t *testing.T) {
+	config := testConfig(t, `
+rewrite_ttl = 60
+rewrites = """
+www.example.org app.lan
+app.lan 10.0.0.5
+"""
+`)
+	packet, err := process(EncodeRequest(testRequest("www.example.org", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+
+	response := DecodePacket(packet)
+	assert.Len(t, response.answers, 2)
+	assert.Equal(t, TypeCNAME, response.answers[0].atype)
+	target, _ := DecodeNameAt(response.answers[0].rdata, 0)
+	assert.Equal(t, "app.lan", target)
+	assert.Equal(t, "app.lan", response.answers[1].name)
+	assert.Equal(t, []byte{10, 0, 0, 5}, response.answers[1].rdata)
+	assert.Equal(t, uint32(60), response.answers[1].ttl)
+}
+
+func TestSafeSearchChasesUpstream(t *testing.T) {
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		response := newResponse(request, RcodeSuccess)
+		if request.question.qname == "forcesafesearch.google.com" {
+			response.answers = []DnsAnswer{addressRecord(request.question.qname, 300, net.ParseIP("216.239.38.120"))}
+		}
+		return response
+	})
+	config := testConfig(t, `
+nameserver = `+upstream+`
+
+[client.kids]
+networks = 192.168.60.0/24
+safe_search = true
+`)
+	request := EncodeRequest(testRequest("www.google.com", TypeA))
+
+	packet, err := process(request, nil, udpAddr("192.168.60.2"), config)
+	assert.NoError(t, err)
+	response := DecodePacket(packet)
+	assert.Len(t, response.answers, 2)
+	assert.Equal(t, TypeCNAME, response.answers[0].atype)
+	assert.Equal(t, "forcesafesearch.google.com", response.answers[1].name)
+	assert.Equal(t, []byte{216, 239, 38, 120}, response.answers[1].rdata)
+
+	assert.Nil(t, config.defaultGroup.matchRewrite("www.google.com"))
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// See also: https://datatracker.ietf.org/doc/html/draft-vixie-dnsop-dns-rpz
+
+const (
+	maxRpzNameserverTTL      = time.Hour
+	negativeRpzNameserverTTL = 5 * time.Minute
+	maxRpzNameserverDomains  = 10000
+)
+
+type RpzAction int
+
+const (
+	RpzNxdomain  RpzAction = iota // CNAME .
+	RpzNodata                     // CNAME *.
+	RpzPassthru                   // CNAME rpz-passthru.
+	RpzDrop                       // CNAME rpz-drop.
+	RpzTcpOnly                    // CNAME rpz-tcp-only.
+	RpzLocalData                  // any other records
+)
+
+func (action RpzAction) String() string {
+	return [...]string{"NXDOMAIN", "NODATA", "PASSTHRU", "DROP", "TCP-ONLY", "local-data"}[action]
+}
+
+type RpzRule struct {
+	trigger string
+	action  RpzAction
+	records []DnsAnswer // local data, owned by the trigger
+	zone    *RpzZone
+}
+
+func (rule *RpzRule) String() string {
+	return rule.zone.name + ":" + rule.trigger + " " + rule.action.String()
+}
+
+type rpzAddressRule struct {
+	network *net.IPNet
+	rule    *RpzRule
+}
+
+type RpzZone struct {
+	name     string
+	qnames   map[string]*RpzRule // "*.example.com" triggers are kept with their asterisk
+	nsdnames map[string]*RpzRule
+	ips      []rpzAddressRule
+}
+
+// loadRpzZone reads a policy zone file. Without an origin, the names relative to the zone are
+// resolved against the owner of its SOA, which must then be written in full.
+func loadRpzZone(path string, origin string) (*RpzZone, error) {
+	records, err := parseZoneFile(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	if origin == "" {
+		for _, record := range records {
+			if record.atype == TypeSOA && record.name != "" {
+				return loadRpzZone(path, record.name)
+			}
+		}
+	}
+	return newRpzZone(records)
+}
+
+// parseRpzSource reads an entry of the rpz setting, a file optionally followed by the origin of the zone.
+func parseRpzSource(value string) (*RpzZone, error) {
+	fields := strings.Fields(value)
+	switch len(fields) {
+	case 1:
+		return loadRpzZone(fields[0], "")
+	case 2:
+		return loadRpzZone(fields[0], fields[1])
+	}
+	return nil, fmt.Errorf("expected a file and an optional origin in %q", value)
+}
+
+// newRpzZone builds the policy from the records of a zone, the origin is the owner of its SOA.
+func newRpzZone(records []DnsAnswer) (*RpzZone, error) {
+	zone := &RpzZone{
+		qnames:   make(map[string]*RpzRule),
+		nsdnames: make(map[string]*RpzRule),
+	}
+	for _, record := range records {
+		if record.atype == TypeSOA {
+			zone.name = record.name
+			break
+		}
+	}
+	if zone.name == "" {
+		return nil, fmt.Errorf("policy zone without SOA record")
+	}
+
+	addressRules := make(map[string]*RpzRule)
+	for _, record := range records {
+		if record.atype == TypeSOA || record.atype == TypeNS || !strings.HasSuffix(record.name, "."+zone.name) {
+			continue
+		}
+		owner := strings.TrimSuffix(record.name, "."+zone.name)
+		switch {
+		case strings.HasSuffix(owner, ".rpz-ip"):
+			rule := addressRules[owner]
+			if rule == nil {
+				network, err := parseRpzAddress(strings.TrimSuffix(owner, ".rpz-ip"))
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", record.name, err)
+				}
+				rule = &RpzRule{trigger: network.String(), zone: zone}
+				addressRules[owner] = rule
+				zone.ips = append(zone.ips, rpzAddressRule{network: network, rule: rule})
+			}
+			rule.add(record)
+		case strings.HasSuffix(owner, ".rpz-nsdname"):
+			trigger := strings.TrimSuffix(owner, ".rpz-nsdname")
+			zone.rule(zone.nsdnames, trigger).add(record)
+		case strings.Contains(owner, ".rpz-"):
+			// other triggers such as rpz-client-ip are not supported
+		default:
+			zone.rule(zone.qnames, owner).add(record)
+		}
+	}
+	return zone, nil
+}
+
+func (zone *RpzZone) rule(rules map[string]*RpzRule, trigger string) *RpzRule {
+	rule, ok := rules[trigger]
+	if !ok {
+		rule = &RpzRule{trigger: trigger, zone: zone}
+		rules[trigger] = rule
+	}
+	return rule
+}
+
+// add reads the action of the rule from a record of its trigger.
+func (rule *RpzRule) add(record DnsAnswer) {
+	if record.atype == TypeCNAME {
+		target, _ := DecodeNameAt(record.rdata, 0)
+		actions := map[string]RpzAction{
+			"":             RpzNxdomain,
+			"*":            RpzNodata,
+			"rpz-passthru": RpzPassthru,
+			"rpz-drop":     RpzDrop,
+			"rpz-tcp-only": RpzTcpOnly,
+		}
+		if action, ok := actions[target]; ok {
+			rule.action = action
+			return
+		}
+	}
+	rule.action = RpzLocalData
+	rule.records = append(rule.records, record)
+}
+
+// parseRpzAddress reads the reversed notation of the triggers: "24.0.2.0.192" is 192.0.2.0/24
+// and "48.zz.1.db8.2001" is 2001:db8:1::/48.
+func parseRpzAddress(value string) (*net.IPNet, error) {
+	labels := strings.Split(value, ".")
+	if _, err := strconv.Atoi(labels[0]); err != nil {
+		return nil, fmt.Errorf("invalid prefix length in %q", value)
+	}
+	for i, j := 1, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	if len(labels) == 5 {
+		if _, network, err := net.ParseCIDR(strings.Join(labels[1:], ".") + "/" + labels[0]); err == nil {
+			return network, nil
+		}
+	}
+	for i := range labels[1:] {
+		if labels[1+i] == "zz" {
+			labels[1+i] = ""
+		}
+	}
+	address := strings.Join(labels[1:], ":")
+	if strings.HasPrefix(address, ":") {
+		address = ":" + address
+	}
+	if strings.HasSuffix(address, ":") {
+		address += ":"
+	}
+	_, network, err := net.ParseCIDR(address + "/" + labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid address trigger %q", value)
+	}
+	return network, nil
+}
+
+func matchRpzName(rules map[string]*RpzRule, hostname string) *RpzRule {
+	if rule, ok := rules[hostname]; ok {
+		return rule
+	}
+	// the closest wildcard wins
+	for name := hostname; strings.Contains(name, "."); {
+		name = name[strings.Index(name, ".")+1:]
+		if rule, ok := rules["*."+name]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matchQname checks the policy zones in order against the query name.
+func matchQname(zones []*RpzZone, hostname string) *RpzRule {
+	hostname = strings.ToLower(hostname)
+	for _, zone := range zones {
+		if rule := matchRpzName(zone.qnames, hostname); rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matchRpzResponse checks the addresses of the answers against RPZ-IP triggers and the name
+// servers of the queried domain against RPZ-NSDNAME triggers.
+func matchRpzResponse(zones []*RpzZone, response DnsPacket, nameservers []string) *RpzRule {
+	for _, zone := range zones {
+		for _, answer := range response.answers {
+			if answer.atype != TypeA && answer.atype != TypeAAAA {
+				continue
+			}
+			for _, address := range zone.ips {
+				if address.network.Contains(net.IP(answer.rdata)) {
+					return address.rule
+				}
+			}
+		}
+		for _, nameserver := range nameservers {
+			if rule := matchRpzName(zone.nsdnames, nameserver); rule != nil {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+func hasNsdnameTriggers(zones []*RpzZone) bool {
+	for _, zone := range zones {
+		if len(zone.nsdnames) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RpzNameservers caches the name servers of the domains for the RPZ-NSDNAME triggers: recursive
+// upstreams seldom list them in the authority section of their answers.
+type RpzNameservers struct {
+	mutex   sync.Mutex
+	domains map[string]rpzNameserverEntry
+}
+
+type rpzNameserverEntry struct {
+	names   []string
+	expires time.Time
+}
+
+func NewRpzNameservers() *RpzNameservers {
+	return &RpzNameservers{domains: make(map[string]rpzNameserverEntry)}
+}
+
+// nameservers are the name servers of the queried domain when the zones have RPZ-NSDNAME
+// triggers: those of the authority section of the response, or else the NS records of the
+// registrable domain of the name, asked to the upstreams and cached for their TTL.
+func (cache *RpzNameservers) nameservers(zones []*RpzZone, hostname string, response DnsPacket, upstreams []string, now time.Time) []string {
+	if !hasNsdnameTriggers(zones) {
+		return nil
+	}
+	var names []string
+	for _, authority := range response.authorities {
+		if authority.atype == TypeNS {
+			name, _ := DecodeNameAt(authority.rdata, 0)
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		return names
+	}
+
+	domain := registrableDomain(hostname)
+	cache.mutex.Lock()
+	entry, ok := cache.domains[domain]
+	cache.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.names
+	}
+
+	nsResponse, err := resolve(domain, TypeNS, upstreams)
+	if err != nil {
+		fmt.Println("Unable to find the name servers of", domain, "for the policy zones:", err)
+		return nil
+	}
+	ttl := negativeRpzNameserverTTL
+	for _, answer := range nsResponse.answers {
+		if answer.atype != TypeNS {
+			continue
+		}
+		if len(names) == 0 {
+			ttl = maxRpzNameserverTTL
+		}
+		if answerTTL := time.Duration(answer.ttl) * time.Second; answerTTL < ttl {
+			ttl = answerTTL
+		}
+		name, _ := DecodeNameAt(answer.rdata, 0)
+		names = append(names, name)
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if len(cache.domains) >= maxRpzNameserverDomains {
+		for cached, entry := range cache.domains {
+			if !now.Before(entry.expires) {
+				delete(cache.domains, cached)
+			}
+		}
+		for cached := range cache.domains {
+			if len(cache.domains) < maxRpzNameserverDomains {
+				break
+			}
+			delete(cache.domains, cached)
+		}
+	}
+	cache.domains[domain] = rpzNameserverEntry{names: names, expires: now.Add(ttl)}
+	return names
+}
+
+// isPassthru tells whether the rule lets the answer through: rpz-passthru always, rpz-tcp-only
+// over TCP, where the client retries after the truncated answer.
+func (rule *RpzRule) isPassthru(tcp bool) bool {
+	return rule.action == RpzPassthru || rule.action == RpzTcpOnly && tcp
+}
+
+// zonesBefore are the policy zones taking precedence over the zone of the rule.
+func (rule *RpzRule) zonesBefore(zones []*RpzZone) []*RpzZone {
+	for i, zone := range zones {
+		if zone == rule.zone {
+			return zones[:i]
+		}
+	}
+	return zones
+}
+
+// rpzResponse applies the action of a rule, a nil response means the query is dropped.
+func rpzResponse(request DnsRequest, rule *RpzRule, ttl uint32) *DnsPacket {
+	var response DnsPacket
+	switch rule.action {
+	case RpzDrop:
+		return nil
+	case RpzNxdomain:
+		response = blockResponse(request, BlockResponse{mode: BlockNxdomain, ttl: ttl})
+	case RpzNodata:
+		response = nodataResponse(request, ttl)
+	case RpzTcpOnly:
+		// only over UDP, isPassthru lets the queries over TCP through
+		response = newResponse(request, RcodeSuccess)
+		response.header.tc = true
+	case RpzLocalData:
+		response = newResponse(request, RcodeSuccess)
+		qtype := request.question.qtype
+		for _, record := range rule.records {
+			if record.atype == qtype || record.atype == TypeCNAME || qtype == TypeANY {
+				record.name = request.question.qname
+				response.answers = append(response.answers, record)
+			}
+		}
+		if len(response.answers) == 0 {
+			response = nodataResponse(request, ttl)
+		}
+	}
+	return &response
+}
+
+// encodeRpzResponse answers a query caught by a policy, nil when the query is dropped.
+func encodeRpzResponse(request DnsRequest, rule *RpzRule, ttl uint32) []byte {
+	response := rpzResponse(request, rule, ttl)
+	if response == nil {
+		return nil
+	}
+	switch rule.action {
+	case RpzNxdomain, RpzNodata:
+		*response = withExtendedError(request, *response, EdeBlocked, "blocked by rpz "+rule.zone.name+":"+rule.trigger)
+	case RpzLocalData:
+		*response = withExtendedError(request, *response, EdeForgedAnswer, "rewritten by rpz "+rule.zone.name+":"+rule.trigger)
+	}
+	return EncodePacket(*response)
+}
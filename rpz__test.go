@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const policyZone = `
+$TTL 60
+$ORIGIN rpz.vendor.example.
+@                       SOA localhost. hostmaster.localhost. 1 3600 600 86400 60
+                        NS  localhost.
+malware.test            CNAME .
+*.malware.test          CNAME .
+empty.test              CNAME *.
+vk.com                  CNAME rpz-passthru.
+silent.test             CNAME rpz-drop.
+big.test                CNAME rpz-tcp-only.
+garden.test             A   10.0.0.1
+24.0.2.0.192.rpz-ip     CNAME .
+48.zz.1.db8.2001.rpz-ip CNAME *.
+ns.evil.test.rpz-nsdname CNAME .
+`
+
+func testRpzConfig(t *testing.T, source string) *Config {
+	config := testConfig(t, source)
+	records, err := parseZone(strings.NewReader(policyZone), "")
+	assert.NoError(t, err)
+	zone, err := newRpzZone(records)
+	assert.NoError(t, err)
+	config.rpzZones = []*RpzZone{zone}
+	return config
+}
+
+func TestRpzTriggers(t *testing.T) {
+	config := testRpzConfig(t, "")
+	zones := config.rpzZones
+
+	assert.Equal(t, RpzNxdomain, matchQname(zones, "malware.test").action)
+	assert.Equal(t, RpzNxdomain, matchQname(zones, "a.b.malware.test").action)
+	assert.Equal(t, RpzNodata, matchQname(zones, "empty.test").action)
+	assert.Equal(t, RpzPassthru, matchQname(zones, "vk.com").action)
+	assert.Equal(t, RpzDrop, matchQname(zones, "silent.test").action)
+	assert.Equal(t, RpzTcpOnly, matchQname(zones, "big.test").action)
+	assert.Equal(t, RpzLocalData, matchQname(zones, "garden.test").action)
+	assert.Nil(t, matchQname(zones, "www.vk.com"))
+
+	network, err := parseRpzAddress("48.zz.1.db8.2001")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8:1::/48", network.String())
+	assert.Equal(t, "192.0.2.0/24", zones[0].ips[0].network.String())
+}
+
+func TestRpzActions(t *testing.T) {
+	config := testRpzConfig(t, "")
+	query := func(name string, qtype uint16) []byte {
+		packet, err := process(EncodeRequest(testRequest(name, qtype)), nil, nil, config)
+		assert.NoError(t, err)
+		return packet
+	}
+
+	assert.Equal(t, RcodeNameError, DecodePacket(query("x.malware.test", TypeA)).header.rcode)
+	assert.Nil(t, query("silent.test", TypeA))
+	assert.True(t, DecodePacket(query("big.test", TypeA)).header.tc)
+
+	response := DecodePacket(query("garden.test", TypeA))
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, []byte{10, 0, 0, 1}, response.answers[0].rdata)
+	assert.Empty(t, DecodePacket(query("garden.test", TypeAAAA)).answers)
+}
+
+func TestRpzPrecedesBlacklist(t *testing.T) {
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		response := newResponse(request, RcodeSuccess)
+		response.answers = []DnsAnswer{addressRecord(request.question.qname, 60, net.ParseIP("192.0.2.10"))}
+		return response
+	})
+	config := testRpzConfig(t, "blacklist = vk.com\nnameserver = "+upstream)
+
+	// passthru exempts the name from the blacklist and from the answer triggers
+	packet, err := process(EncodeRequest(testRequest("vk.com", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Len(t, DecodePacket(packet).answers, 1)
+
+	// the answer address is caught by the rpz-ip trigger
+	packet, err = process(EncodeRequest(testRequest("www.example.com", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeNameError, DecodePacket(packet).header.rcode)
+}
+
+func TestRpzNsdnameTrigger(t *testing.T) {
+	config := testRpzConfig(t, "")
+	response := DnsPacket{authorities: []DnsAnswer{{name: "example.com", atype: TypeNS, aclass: ClassIN, rdata: EncodeName("ns.evil.test")}}}
+
+	nameservers := config.rpzNameservers.nameservers(config.rpzZones, "www.example.com", response, nil, config.now())
+	rule := matchRpzResponse(config.rpzZones, response, nameservers)
+	assert.NotNil(t, rule)
+	assert.Equal(t, "ns.evil.test", rule.trigger)
+}
+
+func TestRpzNsdnameLookup(t *testing.T) {
+	var lookups int32
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		response := newResponse(request, RcodeSuccess)
+		switch request.question.qtype {
+		case TypeNS:
+			atomic.AddInt32(&lookups, 1)
+			nameserver := "ns.good.test"
+			if request.question.qname == "evil-hosted.com" {
+				nameserver = "ns.evil.test"
+			}
+			response.answers = []DnsAnswer{{name: request.question.qname, atype: TypeNS, aclass: ClassIN, ttl: 300, rdata: EncodeName(nameserver)}}
+		case TypeA:
+			response.answers = []DnsAnswer{addressRecord(request.question.qname, 60, net.ParseIP("198.51.100.1"))}
+		}
+		return response
+	})
+	config := testRpzConfig(t, "nameserver = "+upstream)
+	query := func(qname string) DnsPacket {
+		packet, err := process(EncodeRequest(testRequest(qname, TypeA)), nil, nil, config)
+		assert.NoError(t, err)
+		return DecodePacket(packet)
+	}
+
+	// the answers carry no authority section, the name servers are asked for
+	assert.Equal(t, RcodeNameError, query("www.evil-hosted.com").header.rcode)
+	assert.Equal(t, RcodeNameError, query("mail.evil-hosted.com").header.rcode)
+	assert.Len(t, query("www.example.org").answers, 1)
+	// and cached by domain
+	assert.Equal(t, int32(2), atomic.LoadInt32(&lookups))
+}
+
+func TestRpzAnswerTriggersWithoutFilterResponses(t *testing.T) {
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		response := newResponse(request, RcodeSuccess)
+		response.answers = []DnsAnswer{addressRecord(request.question.qname, 60, net.ParseIP("192.0.2.10"))}
+		return response
+	})
+	config := testRpzConfig(t, "filter_responses = false\nnameserver = "+upstream)
+
+	packet, err := process(EncodeRequest(testRequest("www.example.com", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeNameError, DecodePacket(packet).header.rcode)
+
+	// a passthru of a later zone does not exempt from the triggers of an earlier one
+	records, err := parseZone(strings.NewReader("$ORIGIN allow.example.\n@ SOA localhost. hostmaster.localhost. 1 3600 600 86400 60\nwww.example.com CNAME rpz-passthru.\n"), "")
+	assert.NoError(t, err)
+	allow, err := newRpzZone(records)
+	assert.NoError(t, err)
+	config.rpzZones = append(config.rpzZones, allow)
+	packet, err = process(EncodeRequest(testRequest("www.example.com", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeNameError, DecodePacket(packet).header.rcode)
+
+	config.rpzZones = []*RpzZone{allow, config.rpzZones[0]}
+	packet, err = process(EncodeRequest(testRequest("www.example.com", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	assert.Len(t, DecodePacket(packet).answers, 1)
+}
+
+func TestRpzTcpOnly(t *testing.T) {
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		response := newResponse(request, RcodeSuccess)
+		response.answers = []DnsAnswer{addressRecord(request.question.qname, 60, net.ParseIP("198.51.100.1"))}
+		return response
+	})
+	config := testRpzConfig(t, "nameserver = "+upstream)
+
+	packet, err := process(EncodeRequest(testRequest("big.test", TypeA)), nil, udpAddr("10.0.0.1"), config)
+	assert.NoError(t, err)
+	assert.True(t, DecodePacket(packet).header.tc)
+
+	packet, err = process(EncodeRequest(testRequest("big.test", TypeA)), nil, tcpAddr("10.0.0.1"), config)
+	assert.NoError(t, err)
+	assert.False(t, DecodePacket(packet).header.tc)
+	assert.Len(t, DecodePacket(packet).answers, 1)
+}
+
+func TestRpzOrigin(t *testing.T) {
+	dir := t.TempDir()
+	relative := filepath.Join(dir, "relative.rpz")
+	assert.NoError(t, os.WriteFile(relative, []byte("$TTL 60\n@ SOA localhost. hostmaster.localhost. 1 3600 600 86400 60\nmalware.test CNAME .\n"), 0o644))
+	soaOwner := filepath.Join(dir, "soa.rpz")
+	assert.NoError(t, os.WriteFile(soaOwner, []byte("$TTL 60\nrpz.soa. SOA localhost. hostmaster.localhost. 1 3600 600 86400 60\nphishing.test CNAME .\n"), 0o644))
+
+	config := testConfig(t, fmt.Sprintf("rpz = %s rpz.local, %s", relative, soaOwner))
+	assert.Equal(t, "rpz.local", config.rpzZones[0].name)
+	assert.Equal(t, RpzNxdomain, matchQname(config.rpzZones, "malware.test").action)
+	assert.Equal(t, "rpz.soa", config.rpzZones[1].name)
+	assert.Equal(t, RpzNxdomain, matchQname(config.rpzZones, "phishing.test").action)
+
+	_, err := parseConfig(loadIni(t, "rpz = "+relative))
+	assert.Error(t, err)
+}
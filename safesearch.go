@@ -0,0 +1,39 @@
+package main
+
+import "strings"
+
+// Safe search is enforced by answering the search domains with a CNAME to the hosts
+// of the search engines which always filter explicit results.
+var safeSearchRewrites = mustParseRewrites(`
+google.com forcesafesearch.google.com
+www.google.com forcesafesearch.google.com
+www.google.co.uk forcesafesearch.google.com
+www.google.de forcesafesearch.google.com
+www.google.fr forcesafesearch.google.com
+www.google.es forcesafesearch.google.com
+www.google.it forcesafesearch.google.com
+www.google.nl forcesafesearch.google.com
+www.google.pl forcesafesearch.google.com
+www.google.ru forcesafesearch.google.com
+www.google.ca forcesafesearch.google.com
+www.google.com.au forcesafesearch.google.com
+www.google.com.br forcesafesearch.google.com
+www.google.co.in forcesafesearch.google.com
+www.google.co.jp forcesafesearch.google.com
+www.youtube.com restrict.youtube.com
+m.youtube.com restrict.youtube.com
+youtubei.googleapis.com restrict.youtube.com
+youtube.googleapis.com restrict.youtube.com
+www.youtube-nocookie.com restrict.youtube.com
+www.bing.com strict.bing.com
+duckduckgo.com safe.duckduckgo.com
+www.duckduckgo.com safe.duckduckgo.com
+`)
+
+func mustParseRewrites(source string) []*Rewrite {
+	rewrites, err := parseRewrites(strings.Split(source, "\n"))
+	if err != nil {
+		panic(err)
+	}
+	return rewrites
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Schedule is a weekly time window in which a rule or a list is active.
+// A window ending before it starts spans midnight and belongs to the day it starts on.
+type Schedule struct {
+	name     string
+	days     [7]bool // indexed by time.Weekday
+	from     int     // minutes since midnight, inclusive
+	to       int     // minutes since midnight, exclusive
+	location *time.Location
+	within   *Schedule // must be active as well, the own schedule of a list scheduled again by a client group
+}
+
+type Clock func() time.Time
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// isActive reports whether now falls into the schedule, a nil schedule is always active.
+func (schedule *Schedule) isActive(now time.Time) bool {
+	if schedule == nil {
+		return true
+	}
+	return schedule.contains(now) && schedule.within.isActive(now)
+}
+
+func (schedule *Schedule) contains(now time.Time) bool {
+	now = now.In(schedule.location)
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	if schedule.from <= schedule.to {
+		return schedule.days[day] && minute >= schedule.from && minute < schedule.to
+	}
+	if minute >= schedule.from {
+		return schedule.days[day]
+	}
+	return minute < schedule.to && schedule.days[(day+6)%7]
+}
+
+func parseSchedule(section *ini.Section) (*Schedule, error) {
+	schedule := &Schedule{name: strings.TrimPrefix(section.Name(), "schedule.")}
+
+	days, err := parseDays(section.Key("days").MustString("sun-sat"))
+	if err != nil {
+		return nil, err
+	}
+	schedule.days = days
+
+	if schedule.from, err = parseTimeOfDay(section.Key("from").MustString("00:00")); err != nil {
+		return nil, err
+	}
+	if schedule.to, err = parseTimeOfDay(section.Key("to").MustString("24:00")); err != nil {
+		return nil, err
+	}
+
+	schedule.location, err = time.LoadLocation(section.Key("timezone").MustString("Local"))
+	if err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// parseDays reads a list of days and ranges of days such as "mon-fri" or "mon,wed,sat-sun".
+func parseDays(value string) (days [7]bool, err error) {
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(strings.ToLower(strings.TrimSpace(part)), "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return days, fmt.Errorf("invalid day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return days, fmt.Errorf("invalid day %q", bounds[1])
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return hours*60 + minutes, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const schedulesConfig = `
+blacklist = """
+vk.com
+mail.ru @night
+"""
+
+[schedule.workhours]
+days = mon-fri
+from = 09:00
+to = 17:00
+timezone = Europe/Berlin
+
+[schedule.night]
+from = 22:00
+to = 06:00
+timezone = UTC
+
+[blocklist.social]
+domains = facebook.com
+
+[blocklist.games]
+schedule = workhours
+domains = steampowered.com
+
+[client.office]
+networks = 10.0.0.0/8
+blocklists = blacklist, social@workhours, games
+
+[schedule.lunch]
+from = 12:00
+to = 13:00
+timezone = UTC
+
+[client.canteen]
+networks = 10.0.0.0/24
+blocklists = games@lunch
+`
+
+func fixedClock(value string) Clock {
+	now, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return func() time.Time { return now }
+}
+
+func TestScheduleWindow(t *testing.T) {
+	config := testConfig(t, schedulesConfig)
+	workhours := config.schedules["workhours"]
+
+	// 2026-10-19 is a Monday, Berlin is UTC+2 in October
+	assert.True(t, workhours.isActive(fixedClock("2026-10-19T07:00:00Z")()))
+	assert.True(t, workhours.isActive(fixedClock("2026-10-19T14:59:00Z")()))
+	assert.False(t, workhours.isActive(fixedClock("2026-10-19T15:00:00Z")()))
+	assert.False(t, workhours.isActive(fixedClock("2026-10-19T06:59:00Z")()))
+	assert.False(t, workhours.isActive(fixedClock("2026-10-18T10:00:00Z")()))
+}
+
+func TestScheduleSpanningMidnight(t *testing.T) {
+	config := testConfig(t, schedulesConfig)
+	night := config.schedules["night"]
+
+	assert.True(t, night.isActive(fixedClock("2026-10-19T23:30:00Z")()))
+	assert.True(t, night.isActive(fixedClock("2026-10-20T05:59:00Z")()))
+	assert.False(t, night.isActive(fixedClock("2026-10-20T06:00:00Z")()))
+	assert.False(t, night.isActive(fixedClock("2026-10-20T12:00:00Z")()))
+}
+
+func TestParseDays(t *testing.T) {
+	days, err := parseDays("sat-mon, wed")
+	assert.NoError(t, err)
+	assert.Equal(t, [7]bool{true, true, false, true, false, false, true}, days)
+
+	_, err = parseDays("someday")
+	assert.Error(t, err)
+}
+
+func TestScheduledRules(t *testing.T) {
+	config := testConfig(t, schedulesConfig)
+
+	config.clock = fixedClock("2026-10-19T23:30:00Z")
+	assert.True(t, config.isBlacklisted("mail.ru"))
+	assert.True(t, config.isBlacklisted("vk.com"))
+
+	config.clock = fixedClock("2026-10-19T12:00:00Z")
+	assert.False(t, config.isBlacklisted("mail.ru"))
+	assert.True(t, config.isBlacklisted("vk.com"))
+}
+
+func TestScheduledListsForClientGroup(t *testing.T) {
+	config := testConfig(t, schedulesConfig)
+	office := config.clientGroup(udpAddr("10.1.1.1"), testRequest("facebook.com", TypeA))
+	monday := fixedClock("2026-10-19T10:00:00Z")()
+	sunday := fixedClock("2026-10-18T10:00:00Z")()
+
+	assert.NotNil(t, office.matchBlacklist("facebook.com", TypeA, monday))
+	assert.Nil(t, office.matchBlacklist("facebook.com", TypeA, sunday))
+	assert.NotNil(t, office.matchBlacklist("store.steampowered.com", TypeA, monday))
+	assert.Nil(t, office.matchBlacklist("store.steampowered.com", TypeA, sunday))
+
+	// the schedule only applies to the office, other clients get the list at all times
+	assert.NotNil(t, config.defaultGroup.matchBlacklist("facebook.com", TypeA, sunday))
+}
+
+func TestListScheduledTwice(t *testing.T) {
+	config := testConfig(t, schedulesConfig)
+	canteen := config.clientGroup(udpAddr("10.0.0.1"), testRequest("steampowered.com", TypeA))
+	assert.Equal(t, "canteen", canteen.name)
+
+	// both the working days of the list and the lunch break of the group
+	assert.NotNil(t, canteen.matchBlacklist("steampowered.com", TypeA, fixedClock("2026-10-19T12:30:00Z")()))
+	assert.Nil(t, canteen.matchBlacklist("steampowered.com", TypeA, fixedClock("2026-10-19T10:00:00Z")()))
+	assert.Nil(t, canteen.matchBlacklist("steampowered.com", TypeA, fixedClock("2026-10-18T12:30:00Z")()))
+	// the schedule of the list stays untouched for the other groups
+	assert.Nil(t, config.blocklist("games").schedule.within)
+}
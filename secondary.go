@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// A secondary zone is a read-only copy of a zone of other name servers, its primaries, which is
+// transferred from them and kept up to date with the timers of its SOA, RFC 1034 section 4.3.5.
+
+const (
+	transferTimeout      = 30 * time.Second
+	defaultSecondaryWait = time.Minute // between attempts until the first transfer
+)
+
+// parseSecondaryZone reads a zone section naming the primaries instead of a file:
+//
+//	[zone.branch.corp]
+//	primaries = 192.168.2.1, 192.168.2.2:5353
+//	primary_key = xfr-key
+func parseSecondaryZone(section *ini.Section, origin string, keys map[string]*TsigKey) (*Zone, error) {
+	zone := &Zone{
+		origin:   normalizeName(origin),
+		records:  make(map[string][]DnsAnswer),
+		names:    make(map[string]bool),
+		notified: make(chan bool, 1),
+	}
+	for _, primary := range filter(section.Key("primaries").Strings(","), isNotEmpty) {
+		if !isServerAddress(primary) {
+			return nil, fmt.Errorf("primaries: invalid address %q", primary)
+		}
+		zone.primaries = append(zone.primaries, primary)
+	}
+	if len(zone.primaries) == 0 {
+		return nil, fmt.Errorf("primaries: no address")
+	}
+	if section.HasKey("file") || section.HasKey("allow_update") {
+		return nil, fmt.Errorf("a secondary zone has no file and cannot be updated")
+	}
+	if name := section.Key("primary_key").String(); name != "" {
+		zone.primaryKey = keys[normalizeName(name)]
+		if zone.primaryKey == nil {
+			return nil, fmt.Errorf("primary_key: unknown TSIG key %q", name)
+		}
+	}
+	return zone, nil
+}
+
+func (zone *Zone) isSecondary() bool {
+	return len(zone.primaries) > 0
+}
+
+// isServing tells whether the zone has data to answer with: a secondary zone has none before
+// its first transfer and after it expired.
+func (zone *Zone) isServing() bool {
+	zone.mutex.RLock()
+	defer zone.mutex.RUnlock()
+	return zone.soa.rdata != nil && !zone.expired
+}
+
+// timers reads the refresh, retry and expire intervals of the SOA.
+func (zone *Zone) timers() (refresh time.Duration, retry time.Duration, expire time.Duration) {
+	soa := zone.currentSoa()
+	if soa.rdata == nil {
+		return defaultSecondaryWait, defaultSecondaryWait, 0
+	}
+	timers := soa.rdata[len(soa.rdata)-16:]
+	return time.Duration(binary.BigEndian.Uint32(timers[0:4])) * time.Second,
+		time.Duration(binary.BigEndian.Uint32(timers[4:8])) * time.Second,
+		time.Duration(binary.BigEndian.Uint32(timers[8:12])) * time.Second
+}
+
+// maintain keeps a secondary zone up to date: the serial of the primaries is checked every refresh
+// interval, every retry interval after a failure and when a primary sends a NOTIFY. The zone expires
+// when no primary could be reached for the expire interval.
+func (zone *Zone) maintain(config *Config) {
+	for {
+		refresh, retry, expire := zone.timers()
+		wait := refresh
+		if err := zone.refresh(config); err != nil {
+			fmt.Println("Failed to refresh zone:", zone.origin, "error:", err)
+			wait = retry
+			zone.mutex.Lock()
+			if zone.soa.rdata != nil && !zone.expired && config.now().Sub(zone.refreshed) > expire {
+				fmt.Println("Zone expired:", zone.origin)
+				zone.expired = true
+			}
+			zone.mutex.Unlock()
+		}
+		select {
+		case <-time.After(wait):
+		case <-zone.notified:
+		}
+	}
+}
+
+// refresh asks the primaries in turn for the serial of the zone, and transfers the zone from the
+// first one answering when its serial is greater. IXFR is tried first once the zone is loaded.
+func (zone *Zone) refresh(config *Config) error {
+	var err error
+	for _, primary := range zone.primaries {
+		if err = zone.refreshFrom(primary, config); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (zone *Zone) refreshFrom(primary string, config *Config) error {
+	soa := zone.currentSoa()
+	loaded := soa.rdata != nil
+	if loaded {
+		serial, err := querySerial(primary, zone.origin)
+		if err != nil {
+			return err
+		}
+		if !serialGreater(serial, soaSerial(soa)) {
+			zone.markRefreshed(config.now())
+			return nil
+		}
+	}
+
+	qtype := TypeAXFR
+	if loaded {
+		qtype = TypeIXFR
+	}
+	records, err := fetchTransfer(primary, zone.origin, qtype, soa, zone.primaryKey, config.now())
+	if err != nil {
+		return err
+	}
+	if len(records) > 2 && records[1].atype == TypeSOA {
+		err = zone.applyIxfr(records, config.now())
+	} else if len(records) > 1 {
+		err = zone.replace(records[:len(records)-1])
+	}
+	if err != nil {
+		return fmt.Errorf("%s from %s: %v", typeName(qtype), primary, err)
+	}
+	zone.markRefreshed(config.now())
+	fmt.Println("Transferred zone:", zone.origin, typeName(qtype), "primary:", primary, "serial:", soaSerial(zone.currentSoa()))
+	zone.notify(config)
+	return nil
+}
+
+func (zone *Zone) markRefreshed(now time.Time) {
+	zone.mutex.Lock()
+	defer zone.mutex.Unlock()
+	zone.refreshed = now
+	zone.expired = false
+}
+
+// replace swaps the records of the zone for those of a full transfer.
+func (zone *Zone) replace(records []DnsAnswer) error {
+	for i := range records {
+		records[i].name = strings.ToLower(records[i].name)
+	}
+	transferred, err := newZone(zone.origin, records)
+	if err != nil {
+		return err
+	}
+	zone.mutex.Lock()
+	defer zone.mutex.Unlock()
+	zone.soa, zone.records, zone.names = transferred.soa, transferred.records, transferred.names
+	zone.changes = nil
+	return nil
+}
+
+// applyIxfr applies the changes of an incremental transfer, made of the current SOA, for each change
+// the SOA before it, the records it deleted, the SOA after it and the records it added, and the
+// current SOA again.
+func (zone *Zone) applyIxfr(records []DnsAnswer, now time.Time) error {
+	var changes []*ZoneChange
+	var change *ZoneChange
+	deleting := false
+	for _, record := range records[1 : len(records)-1] {
+		record.name = strings.ToLower(record.name)
+		switch {
+		case record.atype == TypeSOA && !deleting:
+			change = &ZoneChange{from: soaSerial(record), time: now, deleted: []DnsAnswer{record}}
+			changes = append(changes, change)
+			deleting = true
+		case record.atype == TypeSOA:
+			change.to = soaSerial(record)
+			change.added = []DnsAnswer{record}
+			deleting = false
+		case change == nil:
+			return fmt.Errorf("malformed incremental transfer")
+		case deleting:
+			change.deleted = append(change.deleted, record)
+		default:
+			change.added = append(change.added, record)
+		}
+	}
+	if deleting {
+		return fmt.Errorf("malformed incremental transfer")
+	}
+
+	zone.mutex.Lock()
+	defer zone.mutex.Unlock()
+	if len(changes) > 0 && changes[0].from != soaSerial(zone.soa) {
+		return fmt.Errorf("changes start at serial %d but the zone is at serial %d", changes[0].from, soaSerial(zone.soa))
+	}
+	for _, change := range changes {
+		zone.apply(change)
+		zone.remember(change)
+	}
+	return nil
+}
+
+// querySerial asks a primary for the SOA of the zone over UDP. Only the transfers are signed,
+// primaries answer SOA queries like any other query.
+func querySerial(primary string, origin string) (uint32, error) {
+	request := EncodePacket(DnsPacket{
+		header:    DnsHeader{id: uint16(rand.Intn(0x10000))},
+		questions: []DnsQuestion{{qname: origin, qtype: TypeSOA, qclass: ClassIN}},
+	})
+	response, err := proxyTo(request, primary)
+	if err != nil {
+		return 0, err
+	}
+	answer, err := SafeDecodePacket(response)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkTransferResponse(request, answer); err != nil {
+		return 0, err
+	}
+	if soa := findRecord(answer.answers, TypeSOA); soa != nil && answer.header.aa {
+		return soaSerial(*soa), nil
+	}
+	return 0, fmt.Errorf("%s is not authoritative for %s", primary, origin)
+}
+
+// fetchTransfer transfers a zone from a primary over TCP and returns the records of all the
+// messages of the response. An IXFR gives the SOA the zone has.
+func fetchTransfer(primary string, origin string, qtype uint16, soa DnsAnswer, key *TsigKey, now time.Time) ([]DnsAnswer, error) {
+	conn, err := net.DialTimeout("tcp", nameserverAddress(primary), upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(transferTimeout))
+
+	query := DnsPacket{
+		header:    DnsHeader{id: uint16(rand.Intn(0x10000))},
+		questions: []DnsQuestion{{qname: origin, qtype: qtype, qclass: ClassIN}},
+	}
+	if qtype == TypeIXFR {
+		query.authorities = []DnsAnswer{soa}
+	}
+	verifier := &tsigVerifier{key: key}
+	request := verifier.signRequest(EncodePacket(query), now)
+	if err := writeTCPMessage(conn, request); err != nil {
+		return nil, err
+	}
+
+	var records []DnsAnswer
+	for !isTransferComplete(records, qtype, soa) {
+		packet, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		message, err := verifier.verify(packet)
+		if err != nil {
+			return nil, err
+		}
+		response, err := SafeDecodePacket(message)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkTransferResponse(request, response); err != nil {
+			return nil, err
+		}
+		if len(records) == 0 && (len(response.answers) == 0 || response.answers[0].atype != TypeSOA) {
+			return nil, fmt.Errorf("transfer does not start with the SOA")
+		}
+		records = append(records, response.answers...)
+	}
+	return records, verifier.complete()
+}
+
+func checkTransferResponse(request []byte, response DnsPacket) error {
+	if response.header.id != binary.BigEndian.Uint16(request[0:2]) || !response.header.qr {
+		return fmt.Errorf("unexpected response")
+	}
+	if response.header.rcode != RcodeSuccess {
+		return fmt.Errorf("rcode %d", response.header.rcode)
+	}
+	return nil
+}
+
+// isTransferComplete tells whether the records received make a whole transfer. A full transfer
+// ends with its first record, the SOA. An incremental one ends when the SOA comes back where the
+// SOA before a change is expected, or right away when the zone is up to date.
+func isTransferComplete(records []DnsAnswer, qtype uint16, soa DnsAnswer) bool {
+	if len(records) == 0 {
+		return false
+	}
+	serial := soaSerial(records[0])
+	if len(records) == 1 {
+		return qtype == TypeIXFR && !serialGreater(serial, soaSerial(soa))
+	}
+	if records[1].atype != TypeSOA {
+		last := records[len(records)-1]
+		return last.atype == TypeSOA && soaSerial(last) == serial
+	}
+	deleting := true
+	for _, record := range records[1:] {
+		if record.atype != TypeSOA {
+			continue
+		}
+		if deleting && soaSerial(record) == serial {
+			return true
+		}
+		deleting = !deleting
+	}
+	return false
+}
+
+// handleNotify answers a NOTIFY of a primary of a secondary zone, which is refreshed right away.
+func handleNotify(packet []byte, remoteAddr net.Addr, config *Config) []byte {
+	now := config.now()
+	// the primaries are known by their own address, never by a client subnet option
+	clientIP, _ := clientIdentity(remoteAddr, DnsRequest{}, false, nil)
+	message, err := SafeDecodePacket(packet)
+	if err != nil || len(message.questions) != 1 || message.questions[0].qtype != TypeSOA {
+		message.header = DecodeHeader(packet[0:12])
+		return EncodePacket(notifyResponse(message, RcodeFormatError))
+	}
+	unsigned, tsig, err := splitTsig(packet)
+	if err != nil {
+		return EncodePacket(notifyResponse(message, RcodeFormatError))
+	}
+	zoneName := message.questions[0].qname
+
+	var key *TsigKey
+	if tsig != nil {
+		var tsigError uint16
+		key, tsigError = verifyTsig(config.tsigKeys, unsigned, *tsig, now)
+		if tsigError != 0 {
+			fmt.Println("Rejected notify:", zoneName, "client:", clientIP, "key:", tsig.keyName, "TSIG error:", tsigError)
+			return signResponse(EncodePacket(notifyResponse(message, RcodeNotAuth)), key, *tsig, tsigError, now)
+		}
+	}
+
+	rcode := RcodeSuccess
+	zone := findZone(config.zones, zoneName)
+	switch {
+	case zone == nil || zone.origin != normalizeName(zoneName) || !zone.isSecondary():
+		rcode = RcodeNotAuth
+	case !zone.isPrimary(clientIP) || zone.primaryKey != nil && key != zone.primaryKey:
+		rcode = RcodeRefused
+	default:
+		fmt.Println("Notified of a change:", zone.origin, "primary:", clientIP)
+		select {
+		case zone.notified <- true:
+		default:
+			// a refresh is already pending
+		}
+	}
+	if rcode != RcodeSuccess {
+		fmt.Println("Rejected notify:", zoneName, "client:", clientIP, "rcode:", rcode)
+	}
+
+	response := EncodePacket(notifyResponse(message, rcode))
+	if key != nil {
+		response = signResponse(response, key, *tsig, 0, now)
+	}
+	return response
+}
+
+func notifyResponse(message DnsPacket, rcode uint8) DnsPacket {
+	response := updateResponse(message, rcode)
+	response.header.aa = true
+	return response
+}
+
+// isPrimary tells whether an address is the one of a primary of the zone.
+func (zone *Zone) isPrimary(ip net.IP) bool {
+	for _, primary := range zone.primaries {
+		host, _, err := net.SplitHostPort(primary)
+		if err != nil {
+			host = primary
+		}
+		if net.ParseIP(host).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startPrimary serves the zones of a configuration over UDP and TCP on the same port.
+func startPrimary(t *testing.T, config *Config) string {
+	var listener net.Listener
+	var conn net.PacketConn
+	for attempt := 0; conn == nil && attempt < 10; attempt++ {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		if conn, err = net.ListenPacket("udp", listener.Addr().String()); err != nil {
+			listener.Close()
+		}
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		conn.Close()
+	})
+
+	server := DnsProxyServer{config: config}
+	go func() {
+		for {
+			tcpConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serveTCP(tcpConn)
+		}
+	}()
+	go server.serveUDP(conn)
+	return listener.Addr().String()
+}
+
+func secondaryConfig(t *testing.T, primary string, extra string) *Config {
+	config := testConfig(t, fmt.Sprintf(`
+[tsig.xfr-key]
+secret = %s
+[zone.lan]
+primaries = %s
+%s
+`, xfrSecret, primary, extra))
+	config.clock = fixedClock("2026-10-19T12:00:00Z")
+	return config
+}
+
+func TestSecondaryZone(t *testing.T) {
+	primary := transferConfig(t, "")
+	config := secondaryConfig(t, startPrimary(t, primary), "")
+	zone := config.zones[0]
+
+	assert.Equal(t, RcodeServerFailure, queryZone(config, "printer.lan", TypeA).header.rcode)
+
+	assert.NoError(t, zone.refresh(config))
+	response := queryZone(config, "printer.lan", TypeA)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.True(t, response.header.aa)
+	assert.Equal(t, []byte{192, 168, 1, 20}, response.answers[0].rdata)
+
+	// the changes of the primary come incrementally
+	sendUpdate(t, primary, signedUpdate(primary, "ddns-key", nil, []DnsAnswer{lanAddress("laptop.lan", "192.168.1.23")}))
+	sendUpdate(t, primary, signedUpdate(primary, "ddns-key", nil, []DnsAnswer{{name: "printer.lan", atype: TypeA, aclass: ClassANY}}))
+	assert.NoError(t, zone.refresh(config))
+	assert.Equal(t, uint32(102), soaSerial(zone.currentSoa()))
+	assert.Len(t, zone.changes, 2)
+	assert.Equal(t, RcodeSuccess, queryZone(config, "laptop.lan", TypeA).header.rcode)
+	assert.Equal(t, RcodeNameError, queryZone(config, "printer.lan", TypeA).header.rcode)
+
+	// nothing to transfer
+	assert.NoError(t, zone.refresh(config))
+	assert.Len(t, zone.changes, 2)
+
+	// read-only
+	response = sendUpdate(t, config, updateMessage(nil, []DnsAnswer{lanAddress("phone.lan", "192.168.1.30")}))
+	assert.Equal(t, RcodeRefused, response.header.rcode)
+}
+
+func TestSecondaryZoneWithTsig(t *testing.T) {
+	primary := transferConfig(t, "transfer_keys = xfr-key")
+	address := startPrimary(t, primary)
+
+	unsigned := secondaryConfig(t, address, "")
+	assert.Error(t, unsigned.zones[0].refresh(unsigned))
+
+	config := secondaryConfig(t, address, "primary_key = xfr-key")
+	assert.NoError(t, config.zones[0].refresh(config))
+	assert.Equal(t, RcodeSuccess, queryZone(config, "printer.lan", TypeA).header.rcode)
+}
+
+func TestSecondaryNotify(t *testing.T) {
+	config := secondaryConfig(t, "127.0.0.1:5300", "")
+	zone := config.zones[0]
+	notify := EncodePacket(DnsPacket{
+		header:    DnsHeader{id: 7, opcode: OpcodeNotify, aa: true},
+		questions: []DnsQuestion{{qname: "lan", qtype: TypeSOA, qclass: ClassIN}},
+	})
+
+	response, err := process(notify, nil, udpAddr("10.0.0.8"), config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeRefused, DecodePacket(response).header.rcode)
+	assert.Len(t, zone.notified, 0)
+
+	response, err = process(notify, nil, udpAddr("127.0.0.1"), config)
+	assert.NoError(t, err)
+	decoded := DecodePacket(response)
+	assert.Equal(t, RcodeSuccess, decoded.header.rcode)
+	assert.Equal(t, OpcodeNotify, decoded.header.opcode)
+	assert.True(t, decoded.header.qr)
+	assert.Len(t, zone.notified, 1)
+
+	// nor is the address of a primary taken from a client subnet option
+	config.trustClientSubnet = true
+	spoofed := DecodePacket(notify)
+	spoofed.additionals = []DnsAnswer{optRecord([]EdnsOption{{code: optionClientSubnet, data: []byte{0, 1, 32, 0, 127, 0, 0, 1}}})}
+	response, err = process(EncodePacket(spoofed), nil, udpAddr("10.0.0.8"), config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeRefused, DecodePacket(response).header.rcode)
+	assert.Len(t, zone.notified, 1)
+
+	// a primary zone is not refreshed
+	primary := transferConfig(t, "")
+	response, err = process(notify, nil, udpAddr("127.0.0.1"), primary)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeNotAuth, DecodePacket(response).header.rcode)
+}
+
+func TestTransferCompletion(t *testing.T) {
+	soa := func(serial uint32) DnsAnswer {
+		return soaRecord("lan", 300, SoaData{mname: "ns.lan", rname: "hostmaster.lan", serial: serial})
+	}
+	printer := lanAddress("printer.lan", "192.168.1.20")
+
+	assert.False(t, isTransferComplete(nil, TypeAXFR, DnsAnswer{}))
+	assert.False(t, isTransferComplete([]DnsAnswer{soa(5), printer}, TypeAXFR, DnsAnswer{}))
+	assert.True(t, isTransferComplete([]DnsAnswer{soa(5), printer, soa(5)}, TypeAXFR, DnsAnswer{}))
+
+	assert.True(t, isTransferComplete([]DnsAnswer{soa(5)}, TypeIXFR, soa(5)))
+	assert.False(t, isTransferComplete([]DnsAnswer{soa(5)}, TypeIXFR, soa(3)))
+	// split where the SOA after the last change ends a message
+	ixfr := []DnsAnswer{soa(5), soa(3), printer, soa(4), soa(4), soa(5)}
+	assert.False(t, isTransferComplete(ixfr, TypeIXFR, soa(3)))
+	assert.True(t, isTransferComplete(append(ixfr, printer, soa(5)), TypeIXFR, soa(3)))
+}
+
+func TestParseSecondaryZone(t *testing.T) {
+	_, err := parseConfig(loadIni(t, "[zone.lan]\nprimaries = primary.lan\n"))
+	assert.Error(t, err)
+	_, err = parseConfig(loadIni(t, "[zone.lan]\nprimaries = 192.168.2.1\nallow_update = ddns-key\n"))
+	assert.Error(t, err)
+	_, err = parseConfig(loadIni(t, "[zone.lan]\nprimaries = 192.168.2.1\nprimary_key = missing\n"))
+	assert.Error(t, err)
+
+	config := testConfig(t, "[zone.lan]\nprimaries = 192.168.2.1, 192.168.2.2:5353\n")
+	assert.True(t, config.zones[0].isSecondary())
+	assert.True(t, config.zones[0].isPrimary(net.ParseIP("192.168.2.2")))
+	refresh, retry, _ := config.zones[0].timers()
+	assert.Equal(t, defaultSecondaryWait, refresh)
+	assert.Equal(t, defaultSecondaryWait, retry)
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"strings"
+	"time"
 )
 
 type DnsProxyServer struct {
@@ -22,6 +27,15 @@ func NewDnsProxyServer(port int, config *Config) DnsProxyServer {
 
 const maxBufferSize = 512
 
+// maxRequestSize is the most a UDP request can carry, signed updates easily exceed 512 bytes.
+const maxRequestSize = 65535
+
+const maxUpstreamSize = 65535
+
+const upstreamTimeout = 5 * time.Second
+
+const tcpIdleTimeout = 30 * time.Second
+
 func (server DnsProxyServer) run() {
 	addr := new(net.UDPAddr)
 	addr.Port = server.port
@@ -31,38 +45,335 @@ func (server DnsProxyServer) run() {
 
 	defer conn.Close()
 
-	buffer := make([]byte, maxBufferSize)
+	if server.config.adminAddress != "" {
+		go server.runAdmin()
+	}
+	if server.config.statsInterval > 0 {
+		go server.logStats(server.config.statsInterval)
+	}
+	if server.config.hosts.isEnabled() {
+		go server.config.hosts.watch(defaultHostsInterval)
+	}
+	if server.config.leases.isEnabled() {
+		go server.config.leases.watch(defaultHostsInterval)
+	}
+	if server.config.newDomains.isEnabled() {
+		go server.config.newDomains.persist(newDomainSaveInterval)
+	}
+	// also where the clients retry the truncated answers, of rpz-tcp-only among others
+	go server.runTCP()
+	for _, zone := range server.config.zones {
+		if zone.isSecondary() {
+			go zone.maintain(server.config)
+		} else {
+			zone.notify(server.config)
+		}
+	}
 
 	fmt.Println("DNS server is running on port", server.port)
+	exitOnError(server.serveUDP(conn), "Failed to read from socket: %v")
+}
+
+// serveUDP answers the queries of a UDP socket until it fails.
+func (server DnsProxyServer) serveUDP(conn net.PacketConn) error {
+	buffer := make([]byte, maxRequestSize)
 	for {
 		n, addr, err := conn.ReadFrom(buffer)
-		exitOnError(err, "Failed to read from socket: %v")
+		if err != nil {
+			return err
+		}
 
 		fmt.Printf("packet-received: bytes=%d from=%s\n", n, addr.String())
-		response, err := process(buffer, conn, addr, server.config)
+		if n < 12 {
+			// too short for a header, nothing to answer
+			continue
+		}
+		response, _ := process(buffer[:n], conn, addr, server.config)
 		if response != nil {
 			conn.WriteTo(response, addr)
 		}
 	}
 }
 
+// runTCP answers queries over TCP, zone transfers among them.
+func (server DnsProxyServer) runTCP() {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: server.port})
+	exitOnError(err, "Failed to open TCP socket: %v")
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Failed to accept TCP connection:", err)
+			continue
+		}
+		go server.serveTCP(conn)
+	}
+}
+
+// serveTCP answers the queries of a connection until the client closes it or stays idle.
+func (server DnsProxyServer) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		packet, err := readTCPMessage(conn)
+		if err != nil || len(packet) < 12 {
+			return
+		}
+		fmt.Printf("tcp-packet-received: bytes=%d from=%s\n", len(packet), conn.RemoteAddr().String())
+		request, err := SafeDecodePacket(packet)
+		if err != nil {
+			fmt.Println("Malformed request:", err, "from:", conn.RemoteAddr())
+			writeTCPMessage(conn, formatErrorResponse(packet))
+			return
+		}
+		var responses [][]byte
+		if len(request.questions) == 1 && isTransfer(request.questions[0].qtype) {
+			responses = transfer(packet, conn.RemoteAddr(), server.config, true)
+		} else if response, _ := process(packet, nil, conn.RemoteAddr(), server.config); response != nil {
+			responses = [][]byte{response}
+		}
+		for _, response := range responses {
+			if err := writeTCPMessage(conn, response); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readTCPMessage reads a message preceded by its length on two bytes, RFC 1035 section 4.2.2.
+func readTCPMessage(reader io.Reader) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length))
+	_, err := io.ReadFull(reader, message)
+	return message, err
+}
+
+func writeTCPMessage(writer io.Writer, message []byte) error {
+	data := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(data, uint16(len(message)))
+	_, err := writer.Write(append(data, message...))
+	return err
+}
+
 func process(packet []byte, conn net.PacketConn, remoteAddr net.Addr, config *Config) ([]byte, error) {
-	dnsRequest := DecodeRequest(packet)
+	dnsRequest, err := SafeDecodeRequest(packet)
+	if err != nil {
+		fmt.Println("Malformed request:", err, "from:", remoteAddr)
+		return formatErrorResponse(packet), err
+	}
+	if dnsRequest.header.opcode == OpcodeQuery && dnsRequest.question.qtype == TypePTR && config.clientGroup(remoteAddr, dnsRequest).dns64 {
+		if ip := config.dns64.address(reverseAddress(dnsRequest.question.qname)); ip != nil {
+			return config.dns64.resolvePtr(dnsRequest, ip, conn, remoteAddr, config)
+		}
+	}
+	return processQuery(dnsRequest, packet, conn, remoteAddr, config)
+}
+
+// processQuery answers a message as it is, process maps the reverse names of the DNS64 prefix.
+func processQuery(dnsRequest DnsRequest, packet []byte, conn net.PacketConn, remoteAddr net.Addr, config *Config) ([]byte, error) {
+	group := config.clientGroup(remoteAddr, dnsRequest)
+	config.stats.query()
 
-	if config.isBlacklisted(dnsRequest.question.qname) {
-		fmt.Println("Blacklisted address:", dnsRequest.question.qname)
-		response := rejectResponse(dnsRequest)
-		return EncodePacket(response), nil
+	clientIP, _ := clientIdentity(remoteAddr, dnsRequest, config.trustClientSubnet, nil)
+	if dnsRequest.header.opcode == OpcodeUpdate {
+		return handleUpdate(packet, clientIP, config), nil
+	}
+	if dnsRequest.header.opcode == OpcodeNotify {
+		return handleNotify(packet, remoteAddr, config), nil
+	}
+	if isTransfer(dnsRequest.question.qtype) && findZone(config.zones, dnsRequest.question.qname) != nil {
+		return transfer(packet, remoteAddr, config, false)[0], nil
+	}
+	view := config.view(clientIP)
+	group = view.scope(group)
+
+	if response, ok, err := answerLocally(dnsRequest, view, group, config); ok {
+		return config.dns64.complete(dnsRequest, group, response, err, func(aRequest DnsRequest) ([]byte, error) {
+			response, _, err := answerLocally(aRequest, view, group, config)
+			return response, err
+		}, config)
+	}
+
+	// the A records of the DNS64 clients come from the same upstreams, with the same checks
+	forwardQuery := func(filterResponses bool, rpzZones []*RpzZone) ([]byte, error) {
+		response, err := forward(dnsRequest, packet, group, clientIP, config, filterResponses, rpzZones, isTCP(remoteAddr))
+		return config.dns64.complete(dnsRequest, group, response, err, func(aRequest DnsRequest) ([]byte, error) {
+			return forward(aRequest, EncodeRequest(aRequest), group, clientIP, config, filterResponses, rpzZones, isTCP(remoteAddr))
+		}, config)
+	}
+
+	if config.overrides.isAllowed(dnsRequest.question.qname, clientIP, config.now()) {
+		fmt.Println("Temporarily allowed address:", config.displayName(dnsRequest.question.qname), "client:", clientIP)
+		return forwardQuery(false, config.rpzZones)
+	}
+
+	if rule := matchQname(config.rpzZones, dnsRequest.question.qname); rule != nil {
+		fmt.Println("Policy zone match:", config.displayName(dnsRequest.question.qname), "rule:", rule)
+		if rule.isPassthru(isTCP(remoteAddr)) {
+			// only the answer triggers of the zones before still apply
+			return forwardQuery(false, rule.zonesBefore(config.rpzZones))
+		}
+		return encodeRpzResponse(dnsRequest, rule, config.rpzTTL), nil
+	}
+
+	if config.analyzer.isEnabled() && !group.isAllowed(dnsRequest.question.qname) {
+		verdict, suspicious := config.analyzer.analyze(dnsRequest.question.qname, clientIP.String(), config.now())
+		if suspicious {
+			switch config.analyzer.action {
+			case AnalyzerLog:
+				fmt.Println("Suspicious query:", config.displayName(dnsRequest.question.qname), "client:", clientIP, verdict)
+			case AnalyzerAlert:
+				config.analyzer.alert(verdict)
+			case AnalyzerBlock:
+				fmt.Println("Blocked suspicious query:", config.displayName(dnsRequest.question.qname), "client:", clientIP, verdict)
+				return EncodePacket(policyResponse(dnsRequest, group, config, "suspicious name, "+verdict.String())), nil
+			}
+		}
+	}
+
+	if rule := group.matchBlacklist(dnsRequest.question.qname, dnsRequest.question.qtype, config.now()); rule != nil {
+		fmt.Println("Blacklisted address:", config.displayName(dnsRequest.question.qname), typeName(dnsRequest.question.qtype), "domain:", config.displayName(registrableDomain(dnsRequest.question.qname)), "group:", group.name, "rule:", rule, "mode:", group.blockResponse(rule).mode)
+		config.stats.block(rule, clientIP, dnsRequest.question.qname)
+		return EncodePacket(blockedResponse(dnsRequest, group, rule)), nil
 	} else {
-		fmt.Println("Whitelisted address:", dnsRequest.question.qname)
-		return proxyTo(packet, config.nameserver)
+		if config.newDomains.isEnabled() && !group.isAllowed(dnsRequest.question.qname) {
+			// the domain is only seen once resolved, by forward
+			domain, firstSeen, isNew := config.newDomains.check(dnsRequest.question.qname, config.now())
+			if isNew {
+				learning := config.newDomains.isLearning(config.now())
+				fmt.Println("Newly observed domain:", config.displayName(domain), "first seen:", firstSeen.Format(time.RFC3339), "client:", clientIP, "learning:", learning)
+				if config.newDomains.action == NewDomainBlock && !learning {
+					// seen from now on, so that it is allowed once old enough
+					config.newDomains.observe(dnsRequest.question.qname, config.now())
+					return EncodePacket(policyResponse(dnsRequest, group, config, "newly observed domain "+domain)), nil
+				}
+			}
+		}
+		fmt.Println("Whitelisted address:", config.displayName(dnsRequest.question.qname), "group:", group.name)
+		return forwardQuery(config.filterResponses, config.rpzZones)
+	}
+}
+
+// answerLocally answers from the local data: the rewrites, hosts files, leases and zones, and the
+// synthesized and private reverse names, or tells that the query goes upstream.
+func answerLocally(dnsRequest DnsRequest, view *View, group *ClientGroup, config *Config) ([]byte, bool, error) {
+	if rewrite := group.matchRewrite(dnsRequest.question.qname); rewrite != nil {
+		fmt.Println("Rewritten address:", config.displayName(dnsRequest.question.qname), "group:", group.name)
+		response, err := rewriteResponse(dnsRequest, rewrite, group, config)
+		if err != nil {
+			fmt.Println("Rewrite failure:", err)
+			response.header.rcode = RcodeServerFailure
+		}
+		return EncodePacket(response), true, err
+	}
+
+	if answers, ok := config.hosts.lookup(dnsRequest.question.qname, dnsRequest.question.qtype); ok {
+		fmt.Println("Local address:", config.displayName(dnsRequest.question.qname), typeName(dnsRequest.question.qtype), "group:", group.name)
+		return EncodePacket(hostsResponse(dnsRequest, answers, config.hostsTTL)), true, nil
+	}
+
+	if answers, ok := config.leases.lookup(dnsRequest.question.qname, dnsRequest.question.qtype, config.hostsTTL, config.now()); ok {
+		fmt.Println("Leased address:", config.displayName(dnsRequest.question.qname), typeName(dnsRequest.question.qtype), "group:", group.name)
+		return EncodePacket(leasesResponse(dnsRequest, answers, config.hostsTTL)), true, nil
+	}
+
+	if zone := view.findZone(config.zones, dnsRequest.question.qname); zone != nil {
+		fmt.Println("Authoritative answer:", config.displayName(dnsRequest.question.qname), typeName(dnsRequest.question.qtype), "zone:", zone.origin)
+		return EncodePacket(zone.answer(dnsRequest)), true, nil
+	}
+
+	if ip := config.ptrTemplate.address(dnsRequest.question.qname); ip != nil {
+		fmt.Println("Synthesized address:", dnsRequest.question.qname, typeName(dnsRequest.question.qtype), ip)
+		return EncodePacket(config.ptrTemplate.addressResponse(dnsRequest, ip, config.ptrTTL)), true, nil
 	}
+
+	if zone := privateReverseZone(dnsRequest.question.qname); zone != "" && matchForwardRule(config.forwardRules, dnsRequest.question.qname) == nil {
+		if ip := reverseAddress(dnsRequest.question.qname); ip != nil && config.ptrTemplate != nil {
+			fmt.Println("Synthesized name:", dnsRequest.question.qname, typeName(dnsRequest.question.qtype), ip)
+			return EncodePacket(config.ptrTemplate.ptrResponse(dnsRequest, ip, config.ptrTTL)), true, nil
+		}
+		if config.privateReverse {
+			fmt.Println("Private reverse name:", dnsRequest.question.qname, typeName(dnsRequest.question.qtype), "zone:", zone)
+			return EncodePacket(privateReverseResponse(dnsRequest, zone)), true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// forward asks the upstreams, then checks their answer against the RPZ-IP and RPZ-NSDNAME
+// triggers of the policy zones, and against the lists of the group when filterResponses is set.
+func forward(request DnsRequest, packet []byte, group *ClientGroup, clientIP net.IP, config *Config, filterResponses bool, rpzZones []*RpzZone, tcp bool) ([]byte, error) {
+	nameservers := config.upstreams(request.question.qname, group)
+	response, err := proxyToAny(packet, nameservers)
+	if err != nil {
+		fmt.Println("Upstream failure:", err)
+		failure := newResponse(request, RcodeServerFailure)
+		failure = withExtendedError(request, failure, EdeNoReachableAuthority, "upstream "+strings.Join(nameservers, ", ")+" unreachable")
+		return EncodePacket(failure), err
+	}
+
+	resolved := func() ([]byte, error) {
+		config.newDomains.observeResponse(request.question.qname, response, config.now())
+		return response, nil
+	}
+	if !filterResponses && len(rpzZones) == 0 {
+		return resolved()
+	}
+	upstream, err := SafeDecodePacket(response)
+	if err != nil {
+		fmt.Println("Unable to inspect upstream response:", err)
+		return resolved()
+	}
+	rpzNameservers := config.rpzNameservers.nameservers(rpzZones, request.question.qname, upstream, nameservers, config.now())
+	if rule := matchRpzResponse(rpzZones, upstream, rpzNameservers); rule != nil {
+		fmt.Println("Policy zone match in answer for", config.displayName(request.question.qname), "rule:", rule)
+		if rule.isPassthru(tcp) {
+			return resolved()
+		}
+		return encodeRpzResponse(request, rule, config.rpzTTL), nil
+	}
+	if !filterResponses {
+		return resolved()
+	}
+	if rule, answer := group.matchResponse(upstream, request.question.qtype, config.now()); rule != nil {
+		fmt.Println("Blacklisted answer:", config.displayName(answer), "for", config.displayName(request.question.qname), "group:", group.name, "rule:", rule)
+		config.stats.block(rule, clientIP, request.question.qname)
+		return EncodePacket(blockedResponse(request, group, rule)), nil
+	}
+	return resolved()
+}
+
+// isTCP tells whether a query came over TCP, where truncated answers are no use.
+func isTCP(remoteAddr net.Addr) bool {
+	_, ok := remoteAddr.(*net.TCPAddr)
+	return ok
+}
+
+func blockedResponse(request DnsRequest, group *ClientGroup, rule *BlockRule) DnsPacket {
+	response := blockResponse(request, group.blockResponse(rule))
+	if group.isDefault() {
+		return withExtendedError(request, response, EdeBlocked, "blocked by "+rule.String())
+	}
+	return withExtendedError(request, response, EdeFiltered, "filtered by "+rule.String()+" for "+group.name)
+}
+
+// policyResponse blocks a query caught by a policy other than the lists, as the group blocks its lists.
+func policyResponse(request DnsRequest, group *ClientGroup, config *Config, reason string) DnsPacket {
+	block := config.blockResponse
+	if group.response != nil {
+		block = *group.response
+	}
+	response := blockResponse(request, block)
+	return withExtendedError(request, response, EdeBlocked, reason)
 }
 
 func rejectResponse(request DnsRequest) DnsPacket {
 	header := request.header
 	header.qr = true
-	header.ancount = 0
 	header.rcode = uint8(0b0101)
 
 	questions := make([]DnsQuestion, 1)
@@ -74,20 +385,58 @@ func rejectResponse(request DnsRequest) DnsPacket {
 	return response
 }
 
+// resolve sends a query of its own to the nameservers.
+func resolve(name string, qtype uint16, nameservers []string) (DnsPacket, error) {
+	request := DnsRequest{
+		header:   DnsHeader{id: uint16(rand.Intn(0x10000)), rd: true},
+		question: DnsQuestion{qname: name, qtype: qtype, qclass: ClassIN},
+	}
+	response, err := proxyToAny(EncodeRequest(request), nameservers)
+	if err != nil {
+		return DnsPacket{}, err
+	}
+	return SafeDecodePacket(response)
+}
+
+// proxyToAny tries the nameservers in order until one of them answers.
+func proxyToAny(packet []byte, nameservers []string) (response []byte, err error) {
+	err = fmt.Errorf("no nameserver configured")
+	for _, nameserver := range nameservers {
+		response, err = proxyTo(packet, nameserver)
+		if err == nil {
+			return response, nil
+		}
+	}
+	return nil, err
+}
+
 func proxyTo(packet []byte, relayAddress string) (response []byte, err error) {
-	conn, err := net.Dial("udp", relayAddress+":53")
+	conn, err := net.Dial("udp", nameserverAddress(relayAddress))
 	if err != nil {
 		return nil, err
 	}
 
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
 
 	_, err = conn.Write(packet)
-	_, err = conn.Read(packet)
+	if err != nil {
+		return nil, err
+	}
+	response = make([]byte, maxUpstreamSize)
+	n, err := conn.Read(response)
 
 	if err != nil {
 		return nil, err
 	} else {
-		return packet, nil
+		return response[:n], nil
+	}
+}
+
+// nameserverAddress adds the default DNS port to nameservers configured without one.
+func nameserverAddress(nameserver string) string {
+	if _, _, err := net.SplitHostPort(nameserver); err == nil {
+		return nameserver
 	}
+	return net.JoinHostPort(nameserver, "53")
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStatsInterval = time.Hour
+	defaultStatsTop      = 10
+	maxTrackedClients    = 1000
+	maxTrackedDomains    = 1000
+	defaultUnusedLimit   = 100
+	maxUnusedLimit       = 1000
+)
+
+// Stats counts the queries blocked by the lists. Rules and lists are few and counted exactly,
+// clients and domains are counted in top-K sketches.
+type Stats struct {
+	mutex   sync.Mutex
+	since   time.Time
+	queries uint64
+	blocked uint64
+	rules   map[string]uint64
+	lists   map[string]uint64
+	clients *TopK
+	domains *TopK // registrable domains
+}
+
+type StatsEntry struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error,omitempty"` // the count may be overestimated by up to this much
+}
+
+type StatsReport struct {
+	Since       time.Time    `json:"since"`
+	Queries     uint64       `json:"queries"`
+	Blocked     uint64       `json:"blocked"`
+	Rules       []StatsEntry `json:"rules"`
+	Lists       []StatsEntry `json:"lists"`
+	Clients     []StatsEntry `json:"clients"`
+	Domains     []StatsEntry `json:"domains"`
+	UnusedRules int          `json:"unused_rules"` // listed by unusedRules
+}
+
+// UnusedRulesPage is a page of the rules which never blocked anything, out of total.
+type UnusedRulesPage struct {
+	Total int      `json:"total"`
+	Rules []string `json:"rules"`
+}
+
+func NewStats(now time.Time) *Stats {
+	return &Stats{
+		since:   now,
+		rules:   make(map[string]uint64),
+		lists:   make(map[string]uint64),
+		clients: NewTopK(maxTrackedClients),
+		domains: NewTopK(maxTrackedDomains),
+	}
+}
+
+func (stats *Stats) query() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.queries++
+}
+
+// block records a query of the client blocked by the rule, the client is unknown when nil.
+func (stats *Stats) block(rule *BlockRule, client net.IP, hostname string) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.blocked++
+	stats.rules[rule.String()]++
+	stats.lists[rule.list.name]++
+	if client != nil {
+		stats.clients.add(client.String())
+	}
+	stats.domains.add(registrableDomain(hostname))
+}
+
+// report returns the counters with the top entries of each kind, along with the number of
+// rules of the lists which never blocked anything.
+func (stats *Stats) report(lists []*BlockList, top int) StatsReport {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	report := StatsReport{
+		Since:   stats.since,
+		Queries: stats.queries,
+		Blocked: stats.blocked,
+		Rules:   topEntries(stats.rules, top),
+		Lists:   topEntries(stats.lists, top),
+		Clients: stats.clients.top(top),
+		Domains: stats.domains.top(top),
+	}
+	stats.eachUnusedLocked(lists, func(rule *BlockRule) { report.UnusedRules++ })
+	return report
+}
+
+// unusedRules returns up to limit of the rules which never blocked anything, from offset
+// in the order of the lists.
+func (stats *Stats) unusedRules(lists []*BlockList, offset, limit int) UnusedRulesPage {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	page := UnusedRulesPage{Rules: []string{}}
+	stats.eachUnusedLocked(lists, func(rule *BlockRule) {
+		if page.Total >= offset && len(page.Rules) < limit {
+			page.Rules = append(page.Rules, rule.String())
+		}
+		page.Total++
+	})
+	return page
+}
+
+func (stats *Stats) eachUnusedLocked(lists []*BlockList, f func(rule *BlockRule)) {
+	for _, list := range lists {
+		for _, rule := range list.rules {
+			if stats.rules[rule.String()] == 0 {
+				f(rule)
+			}
+		}
+	}
+}
+
+func (stats *Stats) reset(now time.Time) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.since = now
+	stats.queries, stats.blocked = 0, 0
+	stats.rules = make(map[string]uint64)
+	stats.lists = make(map[string]uint64)
+	stats.clients = NewTopK(maxTrackedClients)
+	stats.domains = NewTopK(maxTrackedDomains)
+}
+
+// summary is the report in one log line.
+func (report StatsReport) summary() string {
+	format := func(entries []StatsEntry) string {
+		var parts []string
+		for _, entry := range entries {
+			parts = append(parts, fmt.Sprintf("%s=%d", entry.Name, entry.Count))
+		}
+		return strings.Join(parts, " ")
+	}
+	return fmt.Sprintf("queries: %d blocked: %d rules: [%s] lists: [%s] clients: [%s] domains: [%s] unused rules: %d",
+		report.Queries, report.Blocked, format(report.Rules), format(report.Lists),
+		format(report.Clients), format(report.Domains), report.UnusedRules)
+}
+
+func (server DnsProxyServer) logStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		report := server.config.stats.report(server.config.blocklists, defaultStatsTop)
+		fmt.Println("Stats since", report.Since.Format(time.RFC3339), report.summary())
+	}
+}
+
+func topEntries(counts map[string]uint64, top int) []StatsEntry {
+	entries := make([]StatsEntry, 0, len(counts))
+	for name, count := range counts {
+		entries = append(entries, StatsEntry{Name: name, Count: count})
+	}
+	return sortEntries(entries, top)
+}
+
+func sortEntries(entries []StatsEntry, top int) []StatsEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > top {
+		entries = entries[:top]
+	}
+	return entries
+}
+
+// TopK finds the most frequent keys in bounded memory with the Space-Saving algorithm:
+// a new key takes the place of the least frequent one and inherits its count as error.
+// See also: Metwally, Agrawal, El Abbadi, "Efficient Computation of Frequent and Top-k Elements in Data Streams"
+type TopK struct {
+	capacity int
+	counts   map[string]*StatsEntry
+}
+
+func NewTopK(capacity int) *TopK {
+	return &TopK{capacity: capacity, counts: make(map[string]*StatsEntry)}
+}
+
+func (topK *TopK) add(key string) {
+	if entry, ok := topK.counts[key]; ok {
+		entry.Count++
+		return
+	}
+	if len(topK.counts) < topK.capacity {
+		topK.counts[key] = &StatsEntry{Name: key, Count: 1}
+		return
+	}
+	var least *StatsEntry
+	for _, entry := range topK.counts {
+		if least == nil || entry.Count < least.Count {
+			least = entry
+		}
+	}
+	delete(topK.counts, least.Name)
+	topK.counts[key] = &StatsEntry{Name: key, Count: least.Count + 1, Error: least.Count}
+}
+
+func (topK *TopK) top(top int) []StatsEntry {
+	entries := make([]StatsEntry, 0, len(topK.counts))
+	for _, entry := range topK.counts {
+		entries = append(entries, *entry)
+	}
+	return sortEntries(entries, top)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsCountBlocks(t *testing.T) {
+	config := testConfig(t, `
+blacklist = """
+vk.com
+ok.ru
+unused.example
+"""
+
+[blocklist.ads]
+domains = doubleclick.net
+`)
+	for _, name := range []string{"vk.com", "www.vk.com", "m.vk.com", "ad.doubleclick.net"} {
+		_, err := process(EncodeRequest(testRequest(name, TypeA)), nil, udpAddr("10.0.0.1"), config)
+		assert.NoError(t, err)
+	}
+	process(EncodeRequest(testRequest("ok.ru", TypeA)), nil, udpAddr("10.0.0.2"), config)
+
+	report := config.stats.report(config.blocklists, 2)
+	assert.Equal(t, uint64(5), report.Queries)
+	assert.Equal(t, uint64(5), report.Blocked)
+	assert.Equal(t, []StatsEntry{{Name: "blacklist:vk.com", Count: 3}, {Name: "ads:doubleclick.net", Count: 1}}, report.Rules)
+	assert.Equal(t, []StatsEntry{{Name: "blacklist", Count: 4}, {Name: "ads", Count: 1}}, report.Lists)
+	assert.Equal(t, []StatsEntry{{Name: "10.0.0.1", Count: 4}, {Name: "10.0.0.2", Count: 1}}, report.Clients)
+	assert.Equal(t, []StatsEntry{{Name: "vk.com", Count: 3}, {Name: "doubleclick.net", Count: 1}}, report.Domains)
+	assert.Equal(t, 1, report.UnusedRules)
+	assert.Equal(t, UnusedRulesPage{Total: 1, Rules: []string{"blacklist:unused.example"}}, config.stats.unusedRules(config.blocklists, 0, 10))
+
+	config.stats.reset(config.now())
+	assert.Equal(t, uint64(0), config.stats.report(config.blocklists, 10).Blocked)
+}
+
+func TestTopKKeepsFrequentKeys(t *testing.T) {
+	topK := NewTopK(3)
+	for i := 0; i < 100; i++ {
+		topK.add("noisy")
+		topK.add("client-" + strconv.Itoa(i))
+	}
+	top := topK.top(1)
+	assert.Equal(t, "noisy", top[0].Name)
+	assert.Equal(t, uint64(100), top[0].Count)
+	assert.Len(t, topK.counts, 3)
+}
+
+func TestAdminStatsApi(t *testing.T) {
+	config := testConfig(t, "blacklist = vk.com")
+	process(EncodeRequest(testRequest("vk.com", TypeA)), nil, udpAddr("10.0.0.1"), config)
+	handler := NewDnsProxyServer(0, config).adminHandler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stats?top=5", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var report StatsReport
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, uint64(1), report.Blocked)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stats?top=x", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, adminRequest(http.MethodDelete, "/stats"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, uint64(0), config.stats.report(config.blocklists, 5).Blocked)
+}
+
+func TestAdminUnusedRulesPages(t *testing.T) {
+	config := testConfig(t, `
+blacklist = """
+a.com
+b.com
+c.com
+d.com
+e.com
+"""
+`)
+	process(EncodeRequest(testRequest("c.com", TypeA)), nil, udpAddr("10.0.0.1"), config)
+	handler := NewDnsProxyServer(0, config).adminHandler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stats/unused?offset=1&limit=2", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var page UnusedRulesPage
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+	assert.Equal(t, UnusedRulesPage{Total: 4, Rules: []string{"blacklist:b.com", "blacklist:d.com"}}, page)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stats/unused?limit=100000", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// See also: https://datatracker.ietf.org/doc/html/rfc5936 for AXFR,
+// https://datatracker.ietf.org/doc/html/rfc1995 for IXFR
+// and https://datatracker.ietf.org/doc/html/rfc1996 for NOTIFY
+
+const (
+	maxZoneChanges         = 1000 // kept for IXFR, clients older than that get a full transfer
+	maxTransferMessageSize = 16384
+	notifyRetries          = 3
+)
+
+// allowsTransfer tells whether a client may transfer the zone: its address must be in one of
+// the networks, and its request signed with one of the keys when the zone has keys.
+func (zone *Zone) allowsTransfer(ip net.IP, key *TsigKey) bool {
+	for _, network := range zone.transferNetworks {
+		if network.Contains(ip) {
+			return len(zone.transferKeys) == 0 || isOneOfKeys(key, zone.transferKeys)
+		}
+	}
+	return false
+}
+
+func (zone *Zone) currentSoa() DnsAnswer {
+	zone.mutex.RLock()
+	defer zone.mutex.RUnlock()
+	return zone.soa
+}
+
+// axfrRecords are the records of a full transfer: the SOA, the other records by owner and the SOA again.
+func (zone *Zone) axfrRecords() []DnsAnswer {
+	zone.mutex.RLock()
+	defer zone.mutex.RUnlock()
+
+	owners := make([]string, 0, len(zone.records))
+	for owner := range zone.records {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	records := []DnsAnswer{zone.soa}
+	for _, owner := range owners {
+		for _, record := range zone.records[owner] {
+			if record.atype != TypeSOA {
+				records = append(records, record)
+			}
+		}
+	}
+	return append(records, zone.soa)
+}
+
+// ixfrRecords are the records of an incremental transfer from a serial: the current SOA, for each
+// change the SOA before it, the records it deleted, the SOA after it and the records it added,
+// and the current SOA again. A client up to date only gets the current SOA. ok is false when the
+// changes since the serial are not known.
+func (zone *Zone) ixfrRecords(serial uint32) (records []DnsAnswer, ok bool) {
+	zone.mutex.RLock()
+	defer zone.mutex.RUnlock()
+
+	if !serialGreater(soaSerial(zone.soa), serial) {
+		return []DnsAnswer{zone.soa}, true
+	}
+	for i, change := range zone.changes {
+		if change.from != serial {
+			continue
+		}
+		records = []DnsAnswer{zone.soa}
+		for _, change := range zone.changes[i:] {
+			oldSoa, deleted := splitSoa(change.deleted)
+			newSoa, added := splitSoa(change.added)
+			records = append(append(records, oldSoa), deleted...)
+			records = append(append(records, newSoa), added...)
+		}
+		return append(records, zone.soa), true
+	}
+	return nil, false
+}
+
+// splitSoa separates the SOA from the other records of a change.
+func splitSoa(records []DnsAnswer) (DnsAnswer, []DnsAnswer) {
+	var soa DnsAnswer
+	others := make([]DnsAnswer, 0, len(records))
+	for _, record := range records {
+		if record.atype == TypeSOA {
+			soa = record
+		} else {
+			others = append(others, record)
+		}
+	}
+	return soa, others
+}
+
+// isTransfer tells whether a query asks for a zone transfer.
+func isTransfer(qtype uint16) bool {
+	return qtype == TypeAXFR || qtype == TypeIXFR
+}
+
+// transfer answers the AXFR and IXFR queries of a hosted zone, over TCP in as many messages as
+// needed. Over UDP an IXFR only gets the current SOA, which tells the client whether to transfer
+// over TCP, and an AXFR is refused.
+func transfer(packet []byte, remoteAddr net.Addr, config *Config, tcp bool) [][]byte {
+	now := config.now()
+	message, err := SafeDecodePacket(packet)
+	if err != nil || len(message.questions) != 1 {
+		message.header = DecodeHeader(packet[0:12])
+		return [][]byte{EncodePacket(transferResponse(message, RcodeFormatError))}
+	}
+	unsigned, tsig, err := splitTsig(packet)
+	if err != nil {
+		return [][]byte{EncodePacket(transferResponse(message, RcodeFormatError))}
+	}
+	question := message.questions[0]
+	clientIP, _ := clientIdentity(remoteAddr, DnsRequest{}, false, nil)
+
+	var key *TsigKey
+	if tsig != nil {
+		var tsigError uint16
+		key, tsigError = verifyTsig(config.tsigKeys, unsigned, *tsig, now)
+		if tsigError != 0 {
+			fmt.Println("Rejected transfer:", question.qname, "client:", clientIP, "key:", tsig.keyName, "TSIG error:", tsigError)
+			return [][]byte{signResponse(EncodePacket(transferResponse(message, RcodeNotAuth)), key, *tsig, tsigError, now)}
+		}
+	}
+
+	var records []DnsAnswer
+	rcode := RcodeSuccess
+	zone := findZone(config.zones, question.qname)
+	switch {
+	case zone == nil || zone.origin != normalizeName(question.qname):
+		rcode = RcodeNotAuth
+	case !zone.allowsTransfer(clientIP, key):
+		rcode = RcodeRefused
+	case !zone.isServing():
+		rcode = RcodeServerFailure
+	case question.qtype == TypeIXFR && (len(message.authorities) != 1 || message.authorities[0].atype != TypeSOA):
+		rcode = RcodeFormatError
+	case question.qtype == TypeAXFR && !tcp:
+		rcode = RcodeRefused
+	case question.qtype == TypeIXFR && !tcp:
+		records = []DnsAnswer{zone.currentSoa()}
+	case question.qtype == TypeIXFR:
+		var ok bool
+		if records, ok = zone.ixfrRecords(soaSerial(message.authorities[0])); !ok {
+			records = zone.axfrRecords()
+		}
+	default:
+		records = zone.axfrRecords()
+	}
+	if rcode == RcodeSuccess {
+		fmt.Println("Zone transfer:", zone.origin, typeName(question.qtype), "client:", clientIP, "records:", len(records))
+	} else {
+		fmt.Println("Rejected transfer:", question.qname, typeName(question.qtype), "client:", clientIP, "rcode:", rcode)
+	}
+
+	messages := transferMessages(message, rcode, records)
+	if key != nil {
+		messages = signTransfer(messages, key, *tsig, now)
+	}
+	return messages
+}
+
+func transferResponse(message DnsPacket, rcode uint8) DnsPacket {
+	response := updateResponse(message, rcode)
+	response.header.aa = rcode == RcodeSuccess
+	return response
+}
+
+// transferMessages spreads the records over messages of up to maxTransferMessageSize bytes,
+// only the first one repeats the question.
+func transferMessages(request DnsPacket, rcode uint8, records []DnsAnswer) [][]byte {
+	var messages [][]byte
+	response := transferResponse(request, rcode)
+	size := len(EncodePacket(response))
+	for _, record := range records {
+		recordSize := len(EncodeAnswer(record))
+		if len(response.answers) > 0 && size+recordSize > maxTransferMessageSize {
+			messages = append(messages, EncodePacket(response))
+			response.questions = nil
+			response.answers = nil
+			size = len(EncodePacket(response))
+		}
+		response.answers = append(response.answers, record)
+		size += recordSize
+	}
+	return append(messages, EncodePacket(response))
+}
+
+// notify tells the secondaries that the zone changed, in the background. Those which do not
+// acknowledge it are tried again a few times.
+func (zone *Zone) notify(config *Config) {
+	soa := zone.currentSoa()
+	var key *TsigKey
+	if len(zone.transferKeys) > 0 {
+		key = config.tsigKeys[zone.transferKeys[0]]
+	}
+	for _, secondary := range zone.secondaries {
+		go func(secondary string) {
+			var err error
+			for attempt := 0; attempt < notifyRetries; attempt++ {
+				if err = sendNotify(zone.origin, soa, secondary, key, config.now()); err == nil {
+					fmt.Println("Notified secondary:", secondary, "zone:", zone.origin, "serial:", soaSerial(soa))
+					return
+				}
+			}
+			fmt.Println("Failed to notify secondary:", secondary, "zone:", zone.origin, "error:", err)
+		}(secondary)
+	}
+}
+
+func sendNotify(origin string, soa DnsAnswer, secondary string, key *TsigKey, now time.Time) error {
+	id := uint16(rand.Intn(0x10000))
+	request := EncodePacket(DnsPacket{
+		header:    DnsHeader{id: id, opcode: OpcodeNotify, aa: true},
+		questions: []DnsQuestion{{qname: origin, qtype: TypeSOA, qclass: ClassIN}},
+		answers:   []DnsAnswer{soa},
+	})
+	if key != nil {
+		request, _ = signRequest(request, key, now)
+	}
+	response, err := proxyTo(request, secondary)
+	if err != nil {
+		return err
+	}
+	if len(response) < 12 {
+		return fmt.Errorf("truncated response")
+	}
+	header := DecodeHeader(response[0:12])
+	if header.id != id || !header.qr || header.opcode != OpcodeNotify {
+		return fmt.Errorf("unexpected response")
+	}
+	if header.rcode != RcodeSuccess {
+		return fmt.Errorf("rcode %d", header.rcode)
+	}
+	return nil
+}
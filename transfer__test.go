@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const xfrSecret = "eGZyLXNlY3JldC1zaGFyZWQtd2l0aC10aGUtc2Vjb25kYXJpZXM="
+
+func transferConfig(t *testing.T, extra string) *Config {
+	dir := t.TempDir()
+	lan := filepath.Join(dir, "lan.zone")
+	assert.NoError(t, os.WriteFile(lan, []byte(lanZone), 0o644))
+
+	// large enough to take several messages
+	var big strings.Builder
+	big.WriteString("$ORIGIN big.lan.\n$TTL 300\n@ SOA ns.lan. hostmaster.lan. 7 3600 600 86400 60\n@ NS ns.lan.\n")
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&big, "host-%d A 10.%d.%d.1\n", i, i/250, i%250)
+	}
+	bigPath := filepath.Join(dir, "big.zone")
+	assert.NoError(t, os.WriteFile(bigPath, []byte(big.String()), 0o644))
+
+	config := testConfig(t, fmt.Sprintf(`
+[tsig.ddns-key]
+secret = %s
+[tsig.xfr-key]
+secret = %s
+[zone.lan]
+file = %s
+allow_update = ddns-key
+allow_transfer = 192.168.2.0/24, 127.0.0.0/8
+%s
+[zone.big.lan]
+file = %s
+allow_transfer = 192.168.2.0/24
+transfer_keys = xfr-key
+`, updateSecret, xfrSecret, lan, extra, bigPath))
+	config.clock = fixedClock("2026-10-19T12:00:00Z")
+	return config
+}
+
+func transferRequest(zone string, qtype uint16, serial uint32) []byte {
+	request := DnsPacket{
+		header:    DnsHeader{id: 0x5151},
+		questions: []DnsQuestion{{qname: zone, qtype: qtype, qclass: ClassIN}},
+	}
+	if qtype == TypeIXFR {
+		request.authorities = []DnsAnswer{soaRecord(zone, 0, SoaData{mname: "ns." + zone, rname: "hostmaster." + zone, serial: serial})}
+	}
+	return EncodePacket(request)
+}
+
+func transferRecords(t *testing.T, messages [][]byte) []DnsAnswer {
+	var records []DnsAnswer
+	for _, message := range messages {
+		response := DecodePacket(message)
+		assert.Equal(t, RcodeSuccess, response.header.rcode)
+		records = append(records, response.answers...)
+	}
+	return records
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestAxfr(t *testing.T) {
+	config := transferConfig(t, "")
+
+	messages := transfer(transferRequest("lan", TypeAXFR, 0), tcpAddr("192.168.2.53"), config, true)
+	records := transferRecords(t, messages)
+	assert.Len(t, records, 5)
+	assert.Equal(t, TypeSOA, records[0].atype)
+	assert.Equal(t, TypeSOA, records[len(records)-1].atype)
+	assert.True(t, DecodePacket(messages[0]).header.aa)
+
+	messages = transfer(transferRequest("lan", TypeAXFR, 0), tcpAddr("10.0.0.8"), config, true)
+	assert.Equal(t, RcodeRefused, DecodePacket(messages[0]).header.rcode)
+
+	messages = transfer(transferRequest("printer.lan", TypeAXFR, 0), tcpAddr("192.168.2.53"), config, true)
+	assert.Equal(t, RcodeNotAuth, DecodePacket(messages[0]).header.rcode)
+
+	// not over UDP
+	response, err := process(transferRequest("lan", TypeAXFR, 0), nil, udpAddr("192.168.2.53"), config)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeRefused, DecodePacket(response).header.rcode)
+}
+
+func TestIxfr(t *testing.T) {
+	config := transferConfig(t, "")
+	sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{lanAddress("laptop.lan", "192.168.1.23")}))
+	sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{
+		{name: "printer.lan", atype: TypeA, aclass: ClassANY},
+		lanAddress("phone.lan", "192.168.1.30"),
+	}))
+
+	records := transferRecords(t, transfer(transferRequest("lan", TypeIXFR, 100), tcpAddr("192.168.2.53"), config, true))
+	serials := []uint32{}
+	for _, record := range records {
+		if record.atype == TypeSOA {
+			serials = append(serials, soaSerial(record))
+		}
+	}
+	assert.Equal(t, []uint32{102, 100, 101, 101, 102, 102}, serials)
+	assert.Len(t, records, 9)
+
+	records = transferRecords(t, transfer(transferRequest("lan", TypeIXFR, 101), tcpAddr("192.168.2.53"), config, true))
+	assert.Len(t, records, 6)
+
+	// up to date
+	records = transferRecords(t, transfer(transferRequest("lan", TypeIXFR, 102), tcpAddr("192.168.2.53"), config, true))
+	assert.Len(t, records, 1)
+
+	// unknown serial, a full transfer
+	records = transferRecords(t, transfer(transferRequest("lan", TypeIXFR, 42), tcpAddr("192.168.2.53"), config, true))
+	assert.Len(t, records, 6)
+
+	// over UDP the current SOA tells whether to transfer over TCP
+	response, err := process(transferRequest("lan", TypeIXFR, 100), nil, udpAddr("192.168.2.53"), config)
+	assert.NoError(t, err)
+	assert.Len(t, DecodePacket(response).answers, 1)
+	assert.Equal(t, uint32(102), soaSerial(DecodePacket(response).answers[0]))
+}
+
+func TestIxfrAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	config := updateConfig(t, dir)
+	sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{lanAddress("laptop.lan", "192.168.1.23")}))
+
+	reloaded := updateConfig(t, dir)
+	records, ok := reloaded.zones[0].ixfrRecords(100)
+	assert.True(t, ok)
+	assert.Len(t, records, 5)
+}
+
+func TestTransferWithTsig(t *testing.T) {
+	config := transferConfig(t, "")
+	key := config.tsigKeys["xfr-key"]
+
+	messages := transfer(transferRequest("big.lan", TypeAXFR, 0), tcpAddr("192.168.2.53"), config, true)
+	assert.Equal(t, RcodeRefused, DecodePacket(messages[0]).header.rcode)
+
+	request, requestTsig := signRequest(transferRequest("big.lan", TypeAXFR, 0), key, config.now())
+	messages = transfer(request, tcpAddr("192.168.2.53"), config, true)
+	assert.Greater(t, len(messages), 1)
+
+	priorMac := requestTsig.mac
+	count := 0
+	for i, message := range messages {
+		unsigned, tsig, err := splitTsig(message)
+		assert.NoError(t, err)
+		variables := tsig.timers()
+		if i == 0 {
+			variables = tsig.variables()
+		}
+		assert.Equal(t, key.sign(priorMac, unsigned, variables), tsig.mac)
+		priorMac = tsig.mac
+		count += len(DecodePacket(unsigned).answers)
+	}
+	assert.Equal(t, 2003, count)
+
+	// signed with another key
+	request, _ = signRequest(transferRequest("big.lan", TypeAXFR, 0), config.tsigKeys["ddns-key"], config.now())
+	messages = transfer(request, tcpAddr("192.168.2.53"), config, true)
+	assert.Equal(t, RcodeRefused, DecodePacket(messages[0]).header.rcode)
+}
+
+func TestTransferOverTcp(t *testing.T) {
+	config := transferConfig(t, "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			DnsProxyServer{config: config}.serveTCP(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	assert.NoError(t, writeTCPMessage(conn, transferRequest("lan", TypeAXFR, 0)))
+	response, err := readTCPMessage(conn)
+	assert.NoError(t, err)
+	assert.Len(t, DecodePacket(response).answers, 5)
+
+	// the connection stays open for queries
+	assert.NoError(t, writeTCPMessage(conn, EncodeRequest(testRequest("printer.lan", TypeA))))
+	response, err = readTCPMessage(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{192, 168, 1, 20}, DecodePacket(response).answers[0].rdata)
+}
+
+func TestMalformedRequestOverTcp(t *testing.T) {
+	config := transferConfig(t, "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			DnsProxyServer{config: config}.serveTCP(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// one answer announced, none sent
+	packet := EncodeRequest(testRequest("printer.lan", TypeA))
+	packet[7] = 1
+	assert.NoError(t, writeTCPMessage(conn, packet))
+	response, err := readTCPMessage(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeFormatError, DecodeHeader(response).rcode)
+
+	// then the connection is closed
+	_, err = readTCPMessage(conn)
+	assert.Error(t, err)
+}
+
+func TestNotify(t *testing.T) {
+	notified := make(chan DnsRequest, 1)
+	secondary := startUpstream(t, func(request DnsRequest) DnsPacket {
+		notified <- request
+		return newResponse(request, RcodeSuccess)
+	})
+	config := transferConfig(t, "notify = "+secondary)
+	sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{lanAddress("laptop.lan", "192.168.1.23")}))
+
+	select {
+	case request := <-notified:
+		assert.Equal(t, OpcodeNotify, request.header.opcode)
+		assert.True(t, request.header.aa)
+		assert.Equal(t, "lan", request.question.qname)
+		assert.Equal(t, TypeSOA, request.question.qtype)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the secondary was not notified")
+	}
+}
+
+func TestParseZoneTransfers(t *testing.T) {
+	config := transferConfig(t, "")
+	assert.Len(t, config.zones[0].transferNetworks, 2)
+	assert.Len(t, config.zones[1].transferKeys, 1)
+
+	path := filepath.Join(t.TempDir(), "lan.zone")
+	assert.NoError(t, os.WriteFile(path, []byte(lanZone), 0o644))
+	_, err := parseConfig(loadIni(t, fmt.Sprintf("[zone.lan]\nfile = %s\nnotify = secondary.lan\n", path)))
+	assert.Error(t, err)
+	_, err = parseConfig(loadIni(t, fmt.Sprintf("[zone.lan]\nfile = %s\nallow_transfer = 192.168.2.53\n", path)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// See also: https://datatracker.ietf.org/doc/html/rfc8945
+
+const (
+	TsigHmacSha256   = "hmac-sha256"
+	defaultTsigFudge = 300
+)
+
+// TSIG errors, carried in the TSIG record of a response whose rcode is NOTAUTH
+const (
+	TsigBadSig  uint16 = 16
+	TsigBadKey  uint16 = 17
+	TsigBadTime uint16 = 18
+)
+
+// TsigKey is a secret shared with the clients which sign their messages with it.
+type TsigKey struct {
+	name      string
+	algorithm string
+	secret    []byte
+}
+
+// parseTsigKey reads a key from its section, [tsig.ddns-key] is the key named ddns-key.
+func parseTsigKey(section *ini.Section) (*TsigKey, error) {
+	key := &TsigKey{
+		name:      normalizeName(strings.TrimPrefix(section.Name(), "tsig.")),
+		algorithm: strings.ToLower(section.Key("algorithm").MustString(TsigHmacSha256)),
+	}
+	if key.algorithm != TsigHmacSha256 {
+		return nil, fmt.Errorf("unsupported algorithm %q, expected %s", key.algorithm, TsigHmacSha256)
+	}
+	secret, err := base64.StdEncoding.DecodeString(section.Key("secret").String())
+	if err != nil || len(secret) == 0 {
+		return nil, fmt.Errorf("secret must be encoded in base64")
+	}
+	key.secret = secret
+	return key, nil
+}
+
+// Tsig is the record signing a message, the last of its additional records.
+type Tsig struct {
+	keyName    string
+	algorithm  string
+	timeSigned uint64 // seconds since the epoch on 48 bits
+	fudge      uint16 // seconds of clock skew allowed
+	mac        []byte
+	originalID uint16
+	error      uint16
+	other      []byte
+}
+
+func decodeTsig(record DnsAnswer) (Tsig, error) {
+	rdata := record.rdata
+	algorithm, offset := DecodeNameAt(rdata, 0)
+	if offset+10 > len(rdata) {
+		return Tsig{}, fmt.Errorf("truncated TSIG record")
+	}
+	tsig := Tsig{
+		keyName:    record.name,
+		algorithm:  algorithm,
+		timeSigned: uint64(binary.BigEndian.Uint16(rdata[offset:]))<<32 | uint64(binary.BigEndian.Uint32(rdata[offset+2:])),
+		fudge:      binary.BigEndian.Uint16(rdata[offset+6:]),
+	}
+	macEnd := offset + 10 + int(binary.BigEndian.Uint16(rdata[offset+8:]))
+	if macEnd+6 > len(rdata) {
+		return Tsig{}, fmt.Errorf("truncated TSIG record")
+	}
+	tsig.mac = rdata[offset+10 : macEnd]
+	tsig.originalID = binary.BigEndian.Uint16(rdata[macEnd:])
+	tsig.error = binary.BigEndian.Uint16(rdata[macEnd+2:])
+	otherEnd := macEnd + 6 + int(binary.BigEndian.Uint16(rdata[macEnd+4:]))
+	if otherEnd != len(rdata) {
+		return Tsig{}, fmt.Errorf("truncated TSIG record")
+	}
+	tsig.other = rdata[macEnd+6 : otherEnd]
+	return tsig, nil
+}
+
+func (tsig Tsig) encode() DnsAnswer {
+	rdata := EncodeName(tsig.algorithm)
+	fields := make([]byte, 10)
+	putTime48(fields[0:6], tsig.timeSigned)
+	binary.BigEndian.PutUint16(fields[6:8], tsig.fudge)
+	binary.BigEndian.PutUint16(fields[8:10], uint16(len(tsig.mac)))
+	rdata = append(append(rdata, fields...), tsig.mac...)
+	trailer := make([]byte, 6)
+	binary.BigEndian.PutUint16(trailer[0:2], tsig.originalID)
+	binary.BigEndian.PutUint16(trailer[2:4], tsig.error)
+	binary.BigEndian.PutUint16(trailer[4:6], uint16(len(tsig.other)))
+	rdata = append(append(rdata, trailer...), tsig.other...)
+	return DnsAnswer{name: tsig.keyName, atype: TypeTSIG, aclass: ClassANY, rdata: rdata}
+}
+
+// variables are the fields of the record covered by the MAC along with the message,
+// the names in their canonical form.
+func (tsig Tsig) variables() []byte {
+	data := EncodeName(strings.ToLower(tsig.keyName))
+	classAndTTL := make([]byte, 6)
+	binary.BigEndian.PutUint16(classAndTTL[0:2], ClassANY)
+	data = append(append(data, classAndTTL...), EncodeName(strings.ToLower(tsig.algorithm))...)
+	fields := make([]byte, 12)
+	putTime48(fields[0:6], tsig.timeSigned)
+	binary.BigEndian.PutUint16(fields[6:8], tsig.fudge)
+	binary.BigEndian.PutUint16(fields[8:10], tsig.error)
+	binary.BigEndian.PutUint16(fields[10:12], uint16(len(tsig.other)))
+	return append(append(data, fields...), tsig.other...)
+}
+
+// timers are the only variables covered by the MAC of the messages following the first one
+// of a zone transfer.
+func (tsig Tsig) timers() []byte {
+	timers := make([]byte, 8)
+	putTime48(timers[0:6], tsig.timeSigned)
+	binary.BigEndian.PutUint16(timers[6:8], tsig.fudge)
+	return timers
+}
+
+// sign computes the MAC of a message, a response also covers the MAC which preceded it:
+// the one of the request or of the previous message of a zone transfer.
+func (key *TsigKey) sign(priorMac []byte, message []byte, variables []byte) []byte {
+	hash := hmac.New(sha256.New, key.secret)
+	if priorMac != nil {
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(len(priorMac)))
+		hash.Write(size)
+		hash.Write(priorMac)
+	}
+	hash.Write(message)
+	hash.Write(variables)
+	return hash.Sum(nil)
+}
+
+// splitTsig separates the TSIG record from a packet and returns the message as it was signed:
+// without the record and with its original id. The TSIG is nil when the packet is not signed.
+func splitTsig(packet []byte) (message []byte, tsig *Tsig, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed packet: %v", r)
+		}
+	}()
+	header := DecodeHeader(packet[0:12])
+	if header.arcount == 0 {
+		return packet, nil, nil
+	}
+	offset := 12
+	for q := 0; q < int(header.qdcount); q++ {
+		_, nameEnd := DecodeNameAt(packet, offset)
+		offset = nameEnd + 4
+	}
+	_, offset = decodeRecords(packet, offset, header.ancount+header.nscount+header.arcount-1)
+	record, _ := decodeRecordAt(packet, offset)
+	if record.atype != TypeTSIG {
+		return packet, nil, nil
+	}
+	decoded, err := decodeTsig(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	message = append([]byte{}, packet[:offset]...)
+	binary.BigEndian.PutUint16(message[0:2], decoded.originalID)
+	binary.BigEndian.PutUint16(message[10:12], header.arcount-1)
+	return message, &decoded, nil
+}
+
+// verifyTsig checks the signature of a request against the keys, the error is one of
+// the TSIG errors when the signature cannot be trusted.
+func verifyTsig(keys map[string]*TsigKey, message []byte, tsig Tsig, now time.Time) (*TsigKey, uint16) {
+	key := keys[normalizeName(tsig.keyName)]
+	if key == nil || normalizeName(tsig.algorithm) != key.algorithm {
+		return nil, TsigBadKey
+	}
+	if !hmac.Equal(key.sign(nil, message, tsig.variables()), tsig.mac) {
+		return key, TsigBadSig
+	}
+	if skew := now.Unix() - int64(tsig.timeSigned); skew > int64(tsig.fudge) || skew < -int64(tsig.fudge) {
+		return key, TsigBadTime
+	}
+	return key, 0
+}
+
+// signRequest signs a message with the key, the TSIG returned is needed to verify the response.
+func signRequest(message []byte, key *TsigKey, now time.Time) ([]byte, Tsig) {
+	tsig := Tsig{
+		keyName:    key.name,
+		algorithm:  key.algorithm,
+		timeSigned: uint64(now.Unix()),
+		fudge:      defaultTsigFudge,
+		originalID: binary.BigEndian.Uint16(message[0:2]),
+	}
+	tsig.mac = key.sign(nil, message, tsig.variables())
+	return appendTsig(message, tsig), tsig
+}
+
+// signResponse signs the response to a signed request. The responses to requests failing
+// with BADKEY or BADSIG cannot be signed and only carry the error.
+func signResponse(response []byte, key *TsigKey, request Tsig, tsigError uint16, now time.Time) []byte {
+	tsig := Tsig{
+		keyName:    request.keyName,
+		algorithm:  request.algorithm,
+		timeSigned: uint64(now.Unix()),
+		fudge:      request.fudge,
+		originalID: binary.BigEndian.Uint16(response[0:2]),
+		error:      tsigError,
+	}
+	if tsigError == TsigBadTime {
+		// the client learns the time of the server
+		tsig.timeSigned = request.timeSigned
+		tsig.other = make([]byte, 6)
+		putTime48(tsig.other, uint64(now.Unix()))
+	}
+	if key != nil && tsigError != TsigBadKey && tsigError != TsigBadSig {
+		tsig.mac = key.sign(request.mac, response, tsig.variables())
+	}
+	return appendTsig(response, tsig)
+}
+
+// signTransfer signs the messages of a zone transfer, each MAC covers the previous one.
+func signTransfer(messages [][]byte, key *TsigKey, request Tsig, now time.Time) [][]byte {
+	signed := make([][]byte, len(messages))
+	priorMac := request.mac
+	for i, message := range messages {
+		tsig := Tsig{
+			keyName:    request.keyName,
+			algorithm:  request.algorithm,
+			timeSigned: uint64(now.Unix()),
+			fudge:      request.fudge,
+			originalID: binary.BigEndian.Uint16(message[0:2]),
+		}
+		if i == 0 {
+			tsig.mac = key.sign(priorMac, message, tsig.variables())
+		} else {
+			tsig.mac = key.sign(priorMac, message, tsig.timers())
+		}
+		signed[i] = appendTsig(message, tsig)
+		priorMac = tsig.mac
+	}
+	return signed
+}
+
+// tsigVerifier checks the signatures of the responses to a request signed with the key, nothing
+// when there is no key. Among the messages of a zone transfer only the last one must be signed,
+// the MAC of a message covering those received since the previous MAC.
+type tsigVerifier struct {
+	key      *TsigKey
+	priorMac []byte
+	unsigned []byte // messages received since the last signed one
+	count    int
+}
+
+// signRequest signs the request when there is a key.
+func (verifier *tsigVerifier) signRequest(request []byte, now time.Time) []byte {
+	if verifier.key == nil {
+		return request
+	}
+	signed, tsig := signRequest(request, verifier.key, now)
+	verifier.priorMac = tsig.mac
+	return signed
+}
+
+// verify checks the next response and returns it without its TSIG record.
+func (verifier *tsigVerifier) verify(packet []byte) ([]byte, error) {
+	if verifier.key == nil {
+		return packet, nil
+	}
+	message, tsig, err := splitTsig(packet)
+	if err != nil {
+		return nil, err
+	}
+	if tsig == nil {
+		if verifier.count == 0 {
+			return nil, fmt.Errorf("response not signed")
+		}
+		verifier.unsigned = append(verifier.unsigned, message...)
+		verifier.count++
+		return message, nil
+	}
+	if tsig.error != 0 {
+		return nil, fmt.Errorf("TSIG error %d", tsig.error)
+	}
+	variables := tsig.timers()
+	if verifier.count == 0 {
+		variables = tsig.variables()
+	}
+	signed := append(append([]byte{}, verifier.unsigned...), message...)
+	if normalizeName(tsig.keyName) != verifier.key.name || !hmac.Equal(verifier.key.sign(verifier.priorMac, signed, variables), tsig.mac) {
+		return nil, fmt.Errorf("invalid signature of the response")
+	}
+	verifier.priorMac, verifier.unsigned = tsig.mac, nil
+	verifier.count++
+	return message, nil
+}
+
+// complete checks that the last response was signed.
+func (verifier *tsigVerifier) complete() error {
+	if len(verifier.unsigned) > 0 {
+		return fmt.Errorf("last response not signed")
+	}
+	return nil
+}
+
+func appendTsig(message []byte, tsig Tsig) []byte {
+	signed := append(append([]byte{}, message...), EncodeAnswer(tsig.encode())...)
+	binary.BigEndian.PutUint16(signed[10:12], binary.BigEndian.Uint16(message[10:12])+1)
+	return signed
+}
+
+func putTime48(data []byte, seconds uint64) {
+	binary.BigEndian.PutUint16(data[0:2], uint16(seconds>>32))
+	binary.BigEndian.PutUint32(data[2:6], uint32(seconds))
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// See also: https://datatracker.ietf.org/doc/html/rfc2136
+//
+// The sections of an UPDATE message are those of a query renamed: the zone is the question,
+// the prerequisites are the answers and the updates the authorities.
+
+// ZoneChange is the difference between two versions of a zone, what an update did to it.
+type ZoneChange struct {
+	from    uint32 // serial before the change
+	to      uint32 // serial after the change
+	time    time.Time
+	deleted []DnsAnswer
+	added   []DnsAnswer
+}
+
+func (change *ZoneChange) isEmpty() bool {
+	return len(change.deleted) == 0 && len(change.added) == 0
+}
+
+// delete records a deletion, which cancels the addition of the same record.
+func (change *ZoneChange) delete(record DnsAnswer) {
+	if i := indexRecord(change.added, record); i >= 0 {
+		change.added = append(change.added[:i], change.added[i+1:]...)
+		return
+	}
+	change.deleted = append(change.deleted, record)
+}
+
+// add records an addition, which cancels the deletion of the same record.
+func (change *ZoneChange) add(record DnsAnswer) {
+	if i := indexRecord(change.deleted, record); i >= 0 {
+		change.deleted = append(change.deleted[:i], change.deleted[i+1:]...)
+		return
+	}
+	change.added = append(change.added, record)
+}
+
+func (change *ZoneChange) inverse() *ZoneChange {
+	return &ZoneChange{from: change.to, to: change.from, time: change.time, deleted: change.added, added: change.deleted}
+}
+
+// sameRecord compares the owners, types and data of records, not their TTL.
+func sameRecord(a DnsAnswer, b DnsAnswer) bool {
+	return a.name == b.name && a.atype == b.atype && bytes.Equal(a.rdata, b.rdata)
+}
+
+func indexRecord(records []DnsAnswer, record DnsAnswer) int {
+	for i := range records {
+		if sameRecord(records[i], record) {
+			return i
+		}
+	}
+	return -1
+}
+
+func soaSerial(soa DnsAnswer) uint32 {
+	return binary.BigEndian.Uint32(soa.rdata[len(soa.rdata)-20:])
+}
+
+func withSerial(soa DnsAnswer, serial uint32) DnsAnswer {
+	soa.rdata = append([]byte{}, soa.rdata...)
+	binary.BigEndian.PutUint32(soa.rdata[len(soa.rdata)-20:], serial)
+	return soa
+}
+
+// serialGreater compares serials in the arithmetic of RFC 1982, where they wrap around.
+func serialGreater(a uint32, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// isMetaType tells whether a type only makes sense in queries, RFC 6895 section 3.1.
+func isMetaType(rtype uint16) bool {
+	return rtype == TypeOPT || rtype >= 128 && rtype <= 255
+}
+
+func (zone *Zone) rrset(name string, rtype uint16) []DnsAnswer {
+	var rrset []DnsAnswer
+	for _, record := range zone.records[name] {
+		if record.atype == rtype {
+			rrset = append(rrset, record)
+		}
+	}
+	return rrset
+}
+
+// insert adds a record unless the zone has it already.
+func (zone *Zone) insert(record DnsAnswer, change *ZoneChange) {
+	if indexRecord(zone.records[record.name], record) >= 0 {
+		return
+	}
+	zone.add(record)
+	if record.atype == TypeSOA {
+		zone.soa = record
+	}
+	change.add(record)
+}
+
+// remove deletes the records of an owner passing the test, the names are reindexed afterwards.
+func (zone *Zone) remove(name string, test func(DnsAnswer) bool, change *ZoneChange) {
+	var kept []DnsAnswer
+	for _, record := range zone.records[name] {
+		if test(record) {
+			change.delete(record)
+		} else {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == 0 {
+		delete(zone.records, name)
+	} else {
+		zone.records[name] = kept
+	}
+}
+
+// apply replays a change made earlier, as recorded in the journal.
+func (zone *Zone) apply(change *ZoneChange) {
+	discarded := &ZoneChange{}
+	for _, record := range change.deleted {
+		zone.remove(record.name, func(existing DnsAnswer) bool { return sameRecord(existing, record) }, discarded)
+	}
+	for _, record := range change.added {
+		zone.insert(record, discarded)
+	}
+	zone.reindex()
+}
+
+// allowsUpdate tells whether updates signed with the key may change the zone.
+func (zone *Zone) allowsUpdate(key *TsigKey) bool {
+	return isOneOfKeys(key, zone.updateKeys)
+}
+
+func isOneOfKeys(key *TsigKey, names []string) bool {
+	if key == nil {
+		return false
+	}
+	for _, name := range names {
+		if name == key.name {
+			return true
+		}
+	}
+	return false
+}
+
+// remember keeps a change for the incremental transfers, up to maxZoneChanges of them.
+func (zone *Zone) remember(change *ZoneChange) {
+	zone.changes = append(zone.changes, change)
+	if len(zone.changes) > maxZoneChanges {
+		zone.changes = zone.changes[len(zone.changes)-maxZoneChanges:]
+	}
+}
+
+// checkPrerequisites follows RFC 2136 section 3.2, the rcode tells which prerequisite failed.
+func (zone *Zone) checkPrerequisites(prerequisites []DnsAnswer) uint8 {
+	expected := make(map[string][]DnsAnswer) // RRsets which must exist exactly, by owner and type
+	var order []string
+	for _, record := range prerequisites {
+		record.name = strings.ToLower(record.name)
+		if record.ttl != 0 {
+			return RcodeFormatError
+		}
+		if !zone.contains(record.name) {
+			return RcodeNotZone
+		}
+		inUse := len(zone.records[record.name]) > 0
+		switch record.aclass {
+		case ClassANY:
+			if len(record.rdata) != 0 {
+				return RcodeFormatError
+			}
+			if record.atype == TypeANY && !inUse {
+				return RcodeNameError
+			}
+			if record.atype != TypeANY && len(zone.rrset(record.name, record.atype)) == 0 {
+				return RcodeNXRRSet
+			}
+		case ClassNONE:
+			if len(record.rdata) != 0 {
+				return RcodeFormatError
+			}
+			if record.atype == TypeANY && inUse {
+				return RcodeYXDomain
+			}
+			if record.atype != TypeANY && len(zone.rrset(record.name, record.atype)) > 0 {
+				return RcodeYXRRSet
+			}
+		case ClassIN:
+			key := record.name + " " + typeName(record.atype)
+			if _, ok := expected[key]; !ok {
+				order = append(order, key)
+			}
+			expected[key] = append(expected[key], record)
+		default:
+			return RcodeFormatError
+		}
+	}
+	for _, key := range order {
+		rrset := expected[key]
+		existing := zone.rrset(rrset[0].name, rrset[0].atype)
+		for _, record := range rrset {
+			if indexRecord(existing, record) < 0 {
+				return RcodeNXRRSet
+			}
+		}
+		for _, record := range existing {
+			if indexRecord(rrset, record) < 0 {
+				return RcodeNXRRSet
+			}
+		}
+	}
+	return RcodeSuccess
+}
+
+// prescan validates the updates before any of them is applied, RFC 2136 section 3.4.1.
+func (zone *Zone) prescan(updates []DnsAnswer) uint8 {
+	for _, record := range updates {
+		if !zone.contains(record.name) {
+			return RcodeNotZone
+		}
+		switch record.aclass {
+		case ClassIN:
+			if isMetaType(record.atype) {
+				return RcodeFormatError
+			}
+		case ClassANY:
+			if record.ttl != 0 || len(record.rdata) != 0 || isMetaType(record.atype) && record.atype != TypeANY {
+				return RcodeFormatError
+			}
+		case ClassNONE:
+			if record.ttl != 0 || isMetaType(record.atype) {
+				return RcodeFormatError
+			}
+		default:
+			return RcodeFormatError
+		}
+	}
+	return RcodeSuccess
+}
+
+// applyUpdates follows RFC 2136 section 3.4.2: the SOA and NS records of the apex can be
+// replaced but not deleted, a CNAME never shares its owner with other records.
+func (zone *Zone) applyUpdates(updates []DnsAnswer, change *ZoneChange) {
+	for _, record := range updates {
+		record.name = strings.ToLower(record.name)
+		apex := record.name == zone.origin
+		switch record.aclass {
+		case ClassIN:
+			zone.addUpdate(record, change)
+		case ClassANY:
+			zone.remove(record.name, func(existing DnsAnswer) bool {
+				if apex && (existing.atype == TypeSOA || existing.atype == TypeNS) {
+					return false
+				}
+				return record.atype == TypeANY || existing.atype == record.atype
+			}, change)
+		case ClassNONE:
+			if record.atype == TypeSOA || apex && record.atype == TypeNS && len(zone.rrset(record.name, TypeNS)) == 1 {
+				continue
+			}
+			record.aclass = ClassIN
+			zone.remove(record.name, func(existing DnsAnswer) bool { return sameRecord(existing, record) }, change)
+		}
+	}
+}
+
+func (zone *Zone) addUpdate(record DnsAnswer, change *ZoneChange) {
+	existing := zone.records[record.name]
+	cname := findRecord(existing, TypeCNAME) != nil
+	switch {
+	case record.atype == TypeCNAME && !cname && len(existing) > 0, record.atype != TypeCNAME && cname:
+		return
+	case record.atype == TypeSOA:
+		if record.name != zone.origin || !serialGreater(soaSerial(record), soaSerial(zone.soa)) {
+			return
+		}
+		zone.remove(record.name, func(existing DnsAnswer) bool { return existing.atype == TypeSOA }, change)
+	case record.atype == TypeCNAME:
+		zone.remove(record.name, func(existing DnsAnswer) bool { return existing.atype == TypeCNAME }, change)
+	}
+	zone.insert(record, change)
+}
+
+// update checks the prerequisites and applies the updates, all of them or none. The serial is
+// incremented unless the updates replaced the SOA, and the change is journaled.
+func (zone *Zone) update(prerequisites []DnsAnswer, updates []DnsAnswer, now time.Time) (uint8, *ZoneChange) {
+	zone.mutex.Lock()
+	defer zone.mutex.Unlock()
+
+	if rcode := zone.checkPrerequisites(prerequisites); rcode != RcodeSuccess {
+		return rcode, nil
+	}
+	if rcode := zone.prescan(updates); rcode != RcodeSuccess {
+		return rcode, nil
+	}
+	change := &ZoneChange{from: soaSerial(zone.soa), time: now}
+	zone.applyUpdates(updates, change)
+	zone.reindex()
+	if change.isEmpty() {
+		return RcodeSuccess, nil
+	}
+	if findRecord(change.added, TypeSOA) == nil {
+		soa := zone.soa
+		zone.remove(zone.origin, func(existing DnsAnswer) bool { return existing.atype == TypeSOA }, change)
+		zone.insert(withSerial(soa, soaSerial(soa)+1), change)
+	}
+	change.to = soaSerial(zone.soa)
+
+	if err := zone.writeJournal(change); err != nil {
+		fmt.Println("Failed to journal update:", err)
+		zone.apply(change.inverse())
+		return RcodeServerFailure, nil
+	}
+	zone.remember(change)
+	return RcodeSuccess, change
+}
+
+// handleUpdate answers an UPDATE message, which must be signed with a key allowed to update the zone.
+func handleUpdate(packet []byte, clientIP net.IP, config *Config) []byte {
+	now := config.now()
+	message, err := SafeDecodePacket(packet)
+	if err != nil || len(message.questions) != 1 || message.questions[0].qtype != TypeSOA {
+		message.header = DecodeHeader(packet[0:12])
+		return EncodePacket(updateResponse(message, RcodeFormatError))
+	}
+	unsigned, tsig, err := splitTsig(packet)
+	if err != nil {
+		return EncodePacket(updateResponse(message, RcodeFormatError))
+	}
+
+	zoneName := message.questions[0].qname
+	var key *TsigKey
+	if tsig != nil {
+		var tsigError uint16
+		key, tsigError = verifyTsig(config.tsigKeys, unsigned, *tsig, now)
+		if tsigError != 0 {
+			fmt.Println("Rejected update:", zoneName, "client:", clientIP, "key:", tsig.keyName, "TSIG error:", tsigError)
+			return signResponse(EncodePacket(updateResponse(message, RcodeNotAuth)), key, *tsig, tsigError, now)
+		}
+	}
+
+	var rcode uint8
+	zone := findZone(config.zones, zoneName)
+	switch {
+	case zone == nil || zone.origin != normalizeName(zoneName):
+		rcode = RcodeNotAuth
+	case !zone.allowsUpdate(key):
+		rcode = RcodeRefused
+	default:
+		var change *ZoneChange
+		rcode, change = zone.update(message.answers, message.authorities, now)
+		if change != nil {
+			fmt.Println("Updated zone:", zone.origin, "client:", clientIP, "key:", key.name, "serial:", change.to,
+				"deleted:", len(change.deleted), "added:", len(change.added))
+			zone.notify(config)
+		}
+	}
+	if rcode != RcodeSuccess {
+		fmt.Println("Rejected update:", zoneName, "client:", clientIP, "rcode:", rcode)
+	}
+
+	response := EncodePacket(updateResponse(message, rcode))
+	if tsig != nil {
+		response = signResponse(response, key, *tsig, 0, now)
+	}
+	return response
+}
+
+func updateResponse(message DnsPacket, rcode uint8) DnsPacket {
+	header := message.header
+	header.qr = true
+	header.rcode = rcode
+	response := DnsPacket{header: header}
+	if len(message.questions) == 1 {
+		response.questions = message.questions
+	}
+	return response
+}
+
+// The journal keeps the changes made by updates, one JSON object per line, and is replayed
+// over the zone file when the zone is loaded.
+type journalEntry struct {
+	From    uint32          `json:"from"`
+	To      uint32          `json:"to"`
+	Time    time.Time       `json:"time"`
+	Deleted []journalRecord `json:"deleted"`
+	Added   []journalRecord `json:"added"`
+}
+
+type journalRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data []byte `json:"data"`
+}
+
+func journalRecords(records []DnsAnswer) []journalRecord {
+	converted := make([]journalRecord, len(records))
+	for i, record := range records {
+		converted[i] = journalRecord{Name: record.name, Type: record.atype, TTL: record.ttl, Data: record.rdata}
+	}
+	return converted
+}
+
+func zoneRecords(records []journalRecord) []DnsAnswer {
+	converted := make([]DnsAnswer, len(records))
+	for i, record := range records {
+		converted[i] = DnsAnswer{name: record.Name, atype: record.Type, aclass: ClassIN, ttl: record.TTL, rdata: record.Data}
+	}
+	return converted
+}
+
+func (zone *Zone) writeJournal(change *ZoneChange) error {
+	if zone.journal == "" {
+		return nil
+	}
+	line, err := json.Marshal(journalEntry{
+		From:    change.from,
+		To:      change.to,
+		Time:    change.time,
+		Deleted: journalRecords(change.deleted),
+		Added:   journalRecords(change.added),
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(zone.journal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// loadJournal replays the changes of the journal and returns how many there were. They must
+// follow each other from the serial of the zone file, a journal left behind by a zone file
+// edited since is an error rather than changes silently lost.
+func (zone *Zone) loadJournal() (int, error) {
+	zone.mutex.Lock()
+	defer zone.mutex.Unlock()
+
+	file, err := os.Open(zone.journal)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return count, fmt.Errorf("%s: change %d: %v", zone.journal, count+1, err)
+		}
+		if serial := soaSerial(zone.soa); entry.From != serial {
+			return count, fmt.Errorf("%s: change %d starts at serial %d but the zone is at serial %d",
+				zone.journal, count+1, entry.From, serial)
+		}
+		change := &ZoneChange{
+			from:    entry.From,
+			to:      entry.To,
+			time:    entry.Time,
+			deleted: zoneRecords(entry.Deleted),
+			added:   zoneRecords(entry.Added),
+		}
+		zone.apply(change)
+		zone.remember(change)
+		count++
+	}
+	return count, scanner.Err()
+}
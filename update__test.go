@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const lanZone = `
+$ORIGIN lan.
+$TTL 300
+@        SOA   ns hostmaster 100 3600 600 86400 60
+         NS    ns
+ns       A     192.168.1.1
+printer  A     192.168.1.20
+`
+
+const updateSecret = "c2VjcmV0LXNoYXJlZC13aXRoLXRoZS1kaGNwLXNlcnZlcg=="
+
+func updateConfig(t *testing.T, dir string) *Config {
+	path := filepath.Join(dir, "lan.zone")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		assert.NoError(t, os.WriteFile(path, []byte(lanZone), 0o644))
+	}
+	config := testConfig(t, fmt.Sprintf(`
+[tsig.ddns-key]
+secret = %s
+[tsig.other-key]
+secret = b3RoZXI=
+[zone.lan]
+file = %s
+allow_update = ddns-key
+`, updateSecret, path))
+	config.clock = fixedClock("2026-10-19T12:00:00Z")
+	return config
+}
+
+func updateMessage(prerequisites []DnsAnswer, updates []DnsAnswer) []byte {
+	return EncodePacket(DnsPacket{
+		header:      DnsHeader{id: 0x4242, opcode: OpcodeUpdate},
+		questions:   []DnsQuestion{{qname: "lan", qtype: TypeSOA, qclass: ClassIN}},
+		answers:     prerequisites,
+		authorities: updates,
+	})
+}
+
+func sendUpdate(t *testing.T, config *Config, packet []byte) DnsPacket {
+	response, err := process(packet, nil, udpAddr("192.168.1.50"), config)
+	assert.NoError(t, err)
+	return DecodePacket(response)
+}
+
+func signedUpdate(config *Config, key string, prerequisites []DnsAnswer, updates []DnsAnswer) []byte {
+	signed, _ := signRequest(updateMessage(prerequisites, updates), config.tsigKeys[key], config.now())
+	return signed
+}
+
+func lanAddress(name string, ip string) DnsAnswer {
+	return addressRecord(name, 300, net.ParseIP(ip))
+}
+
+func queryZone(config *Config, name string, qtype uint16) DnsPacket {
+	return config.zones[0].answer(testRequest(name, qtype))
+}
+
+func TestUpdateAddsRecords(t *testing.T) {
+	config := updateConfig(t, t.TempDir())
+
+	response := sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{lanAddress("Laptop.lan", "192.168.1.23")}))
+	assert.True(t, response.header.qr)
+	assert.Equal(t, OpcodeUpdate, response.header.opcode)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Equal(t, TypeTSIG, response.additionals[len(response.additionals)-1].atype)
+
+	answer := queryZone(config, "laptop.lan", TypeA)
+	assert.Equal(t, RcodeSuccess, answer.header.rcode)
+	assert.Equal(t, []byte{192, 168, 1, 23}, answer.answers[0].rdata)
+	assert.Equal(t, uint32(101), soaSerial(config.zones[0].soa))
+
+	// adding the same record again changes nothing, not even the serial
+	sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{lanAddress("laptop.lan", "192.168.1.23")}))
+	assert.Equal(t, uint32(101), soaSerial(config.zones[0].soa))
+}
+
+func TestUpdateOutlivesBuffer(t *testing.T) {
+	config := updateConfig(t, t.TempDir())
+	packet := signedUpdate(config, "ddns-key", nil, []DnsAnswer{lanAddress("laptop.lan", "192.168.1.23")})
+	assert.Equal(t, RcodeSuccess, sendUpdate(t, config, packet).header.rcode)
+
+	// the next datagram is read into the same buffer
+	for i := range packet {
+		packet[i] = 0xff
+	}
+	assert.Equal(t, []byte{192, 168, 1, 23}, queryZone(config, "laptop.lan", TypeA).answers[0].rdata)
+}
+
+func TestUpdatePrerequisites(t *testing.T) {
+	config := updateConfig(t, t.TempDir())
+	add := []DnsAnswer{lanAddress("laptop.lan", "192.168.1.23")}
+
+	notInUse := []DnsAnswer{{name: "printer.lan", atype: TypeANY, aclass: ClassNONE}}
+	assert.Equal(t, RcodeYXDomain, sendUpdate(t, config, signedUpdate(config, "ddns-key", notInUse, add)).header.rcode)
+
+	exists := []DnsAnswer{{name: "laptop.lan", atype: TypeA, aclass: ClassANY}}
+	assert.Equal(t, RcodeNXRRSet, sendUpdate(t, config, signedUpdate(config, "ddns-key", exists, add)).header.rcode)
+
+	inUse := []DnsAnswer{{name: "scanner.lan", atype: TypeANY, aclass: ClassANY}}
+	assert.Equal(t, RcodeNameError, sendUpdate(t, config, signedUpdate(config, "ddns-key", inUse, add)).header.rcode)
+
+	outside := []DnsAnswer{{name: "example.com", atype: TypeANY, aclass: ClassANY}}
+	assert.Equal(t, RcodeNotZone, sendUpdate(t, config, signedUpdate(config, "ddns-key", outside, add)).header.rcode)
+
+	exactly := []DnsAnswer{{name: "printer.lan", atype: TypeA, aclass: ClassIN, rdata: []byte{192, 168, 1, 21}}}
+	assert.Equal(t, RcodeNXRRSet, sendUpdate(t, config, signedUpdate(config, "ddns-key", exactly, add)).header.rcode)
+	assert.Equal(t, RcodeNameError, queryZone(config, "laptop.lan", TypeA).header.rcode)
+
+	exactly[0].rdata = []byte{192, 168, 1, 20}
+	assert.Equal(t, RcodeSuccess, sendUpdate(t, config, signedUpdate(config, "ddns-key", exactly, add)).header.rcode)
+	assert.Equal(t, RcodeSuccess, queryZone(config, "laptop.lan", TypeA).header.rcode)
+}
+
+func TestUpdateDeletes(t *testing.T) {
+	config := updateConfig(t, t.TempDir())
+	sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{
+		lanAddress("laptop.lan", "192.168.1.23"),
+		lanAddress("laptop.lan", "192.168.1.24"),
+		lanAddress("phone.lan", "192.168.1.30"),
+	}))
+
+	response := sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{
+		{name: "laptop.lan", atype: TypeA, aclass: ClassNONE, rdata: []byte{192, 168, 1, 23}},
+		{name: "phone.lan", atype: TypeA, aclass: ClassANY},
+		// the SOA and NS records of the apex survive
+		{name: "lan", atype: TypeANY, aclass: ClassANY},
+		{name: "lan", atype: TypeNS, aclass: ClassNONE, rdata: EncodeName("ns.lan")},
+	}))
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+
+	assert.Len(t, queryZone(config, "laptop.lan", TypeA).answers, 1)
+	assert.Equal(t, RcodeNameError, queryZone(config, "phone.lan", TypeA).header.rcode)
+	assert.Len(t, queryZone(config, "lan", TypeNS).answers, 1)
+	assert.Len(t, queryZone(config, "lan", TypeSOA).answers, 1)
+}
+
+func TestUpdateKeepsCnamesAlone(t *testing.T) {
+	config := updateConfig(t, t.TempDir())
+	sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{
+		cnameRecord("www.lan", 300, "printer.lan"),
+		lanAddress("www.lan", "192.168.1.80"),
+		cnameRecord("printer.lan", 300, "ns.lan"),
+	}))
+
+	records := config.zones[0].records
+	assert.Len(t, records["www.lan"], 1)
+	assert.Equal(t, TypeCNAME, records["www.lan"][0].atype)
+	assert.Len(t, records["printer.lan"], 1)
+	assert.Equal(t, TypeA, records["printer.lan"][0].atype)
+}
+
+func TestUpdateAuthentication(t *testing.T) {
+	config := updateConfig(t, t.TempDir())
+	add := []DnsAnswer{lanAddress("laptop.lan", "192.168.1.23")}
+
+	response := sendUpdate(t, config, updateMessage(nil, add))
+	assert.Equal(t, RcodeRefused, response.header.rcode)
+
+	response = sendUpdate(t, config, signedUpdate(config, "other-key", nil, add))
+	assert.Equal(t, RcodeRefused, response.header.rcode)
+
+	tampered := signedUpdate(config, "ddns-key", nil, add)
+	tampered[len(updateMessage(nil, add))-1] = 99
+	response = sendUpdate(t, config, tampered)
+	assert.Equal(t, RcodeNotAuth, response.header.rcode)
+	tsig, err := decodeTsig(response.additionals[0])
+	assert.NoError(t, err)
+	assert.Equal(t, TsigBadSig, tsig.error)
+	assert.Empty(t, tsig.mac)
+
+	late, _ := signRequest(updateMessage(nil, add), config.tsigKeys["ddns-key"], config.now().Add(-time.Hour))
+	response = sendUpdate(t, config, late)
+	assert.Equal(t, RcodeNotAuth, response.header.rcode)
+	tsig, _ = decodeTsig(response.additionals[0])
+	assert.Equal(t, TsigBadTime, tsig.error)
+	assert.NotEmpty(t, tsig.mac)
+
+	unknown := &TsigKey{name: "unknown-key", algorithm: TsigHmacSha256, secret: []byte("secret")}
+	signed, _ := signRequest(updateMessage(nil, add), unknown, config.now())
+	response = sendUpdate(t, config, signed)
+	assert.Equal(t, RcodeNotAuth, response.header.rcode)
+	tsig, _ = decodeTsig(response.additionals[0])
+	assert.Equal(t, TsigBadKey, tsig.error)
+
+	assert.Equal(t, RcodeNameError, queryZone(config, "laptop.lan", TypeA).header.rcode)
+}
+
+func TestUpdateResponseSignature(t *testing.T) {
+	config := updateConfig(t, t.TempDir())
+	key := config.tsigKeys["ddns-key"]
+	request, requestTsig := signRequest(updateMessage(nil, nil), key, config.now())
+
+	response, err := process(request, nil, udpAddr("192.168.1.50"), config)
+	assert.NoError(t, err)
+	message, tsig, err := splitTsig(response)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x4242), binary.BigEndian.Uint16(message[0:2]))
+	assert.Equal(t, key.sign(requestTsig.mac, message, tsig.variables()), tsig.mac)
+}
+
+func TestUpdateNotAuthoritative(t *testing.T) {
+	config := updateConfig(t, t.TempDir())
+	packet := DecodePacket(updateMessage(nil, nil))
+	packet.questions[0].qname = "printer.lan"
+	signed, _ := signRequest(EncodePacket(packet), config.tsigKeys["ddns-key"], config.now())
+	assert.Equal(t, RcodeNotAuth, sendUpdate(t, config, signed).header.rcode)
+}
+
+func TestUpdateJournal(t *testing.T) {
+	dir := t.TempDir()
+	config := updateConfig(t, dir)
+	sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{lanAddress("laptop.lan", "192.168.1.23")}))
+	sendUpdate(t, config, signedUpdate(config, "ddns-key", nil, []DnsAnswer{
+		{name: "printer.lan", atype: TypeANY, aclass: ClassANY},
+		lanAddress("phone.lan", "192.168.1.30"),
+	}))
+
+	reloaded := updateConfig(t, dir)
+	assert.Equal(t, uint32(102), soaSerial(reloaded.zones[0].soa))
+	assert.Equal(t, RcodeSuccess, queryZone(reloaded, "laptop.lan", TypeA).header.rcode)
+	assert.Equal(t, RcodeSuccess, queryZone(reloaded, "phone.lan", TypeA).header.rcode)
+	assert.Equal(t, RcodeNameError, queryZone(reloaded, "printer.lan", TypeA).header.rcode)
+
+	// a zone file edited since the journal was written
+	edited := "$ORIGIN lan.\n@ 300 SOA ns hostmaster 200 3600 600 86400 60\n@ 300 NS ns\nns 300 A 192.168.1.1\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "lan.zone"), []byte(edited), 0o644))
+	_, err := parseConfig(loadIni(t, fmt.Sprintf("[tsig.ddns-key]\nsecret = %s\n[zone.lan]\nfile = %s\nallow_update = ddns-key\n",
+		updateSecret, filepath.Join(dir, "lan.zone"))))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "starts at serial 100 but the zone is at serial 200")
+	}
+}
+
+func TestUpdateUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lan.zone")
+	assert.NoError(t, os.WriteFile(path, []byte(lanZone), 0o644))
+	_, err := parseConfig(loadIni(t, fmt.Sprintf("[zone.lan]\nfile = %s\nallow_update = missing\n", path)))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `unknown TSIG key "missing"`)
+	}
+}
+
+func TestLargeUpdateOverUdp(t *testing.T) {
+	config := updateConfig(t, t.TempDir())
+	address := startPrimary(t, config)
+
+	var updates []DnsAnswer
+	for i := 0; i < 30; i++ {
+		updates = append(updates, lanAddress(fmt.Sprintf("host-%d.lan", i), fmt.Sprintf("192.168.1.%d", 100+i)))
+	}
+	packet := signedUpdate(config, "ddns-key", nil, updates)
+	assert.Greater(t, len(packet), 512)
+
+	conn, err := net.Dial("udp", address)
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Write(packet)
+	assert.NoError(t, err)
+	buffer := make([]byte, maxRequestSize)
+	n, err := conn.Read(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeSuccess, DecodePacket(buffer[:n]).header.rcode)
+	assert.Equal(t, []byte{192, 168, 1, 129}, queryZone(config, "host-29.lan", TypeA).answers[0].rdata)
+}
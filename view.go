@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// View gives the clients of some networks local records and zones of their own, split-horizon
+// style: internal clients get private addresses for a name which others resolve upstream.
+type View struct {
+	name     string
+	networks []*net.IPNet
+	records  []*Rewrite // in the syntax of the rewrites
+	zones    []*Zone    // take precedence over the zones of the same origin outside the view
+}
+
+// view selects the view of the most specific network containing the client, nil when none does.
+func (config Config) view(ip net.IP) *View {
+	var selected *View
+	selectedPrefix := -1
+	for _, view := range config.views {
+		for _, network := range view.networks {
+			prefix, _ := network.Mask.Size()
+			if ip != nil && network.Contains(ip) && prefix > selectedPrefix {
+				selected = view
+				selectedPrefix = prefix
+			}
+		}
+	}
+	return selected
+}
+
+// scope returns the group with the records of the view ahead of its own rewrites.
+func (view *View) scope(group *ClientGroup) *ClientGroup {
+	if view == nil {
+		return group
+	}
+	scoped := *group
+	scoped.rewrites = append(append([]*Rewrite{}, view.records...), group.rewrites...)
+	return &scoped
+}
+
+// findZone finds the zone of the name, among the zones of the view first.
+func (view *View) findZone(zones []*Zone, name string) *Zone {
+	if view != nil {
+		if zone := findZone(view.zones, name); zone != nil {
+			return zone
+		}
+	}
+	return findZone(zones, name)
+}
+
+func parseView(section *ini.Section) (*View, error) {
+	view := &View{name: strings.TrimPrefix(section.Name(), "view.")}
+	for _, value := range section.Key("networks").Strings(",") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		view.networks = append(view.networks, network)
+	}
+	if len(view.networks) == 0 {
+		return nil, fmt.Errorf("view without networks")
+	}
+
+	records, err := parseRewrites(section.Key("records").Strings("\n"))
+	if err != nil {
+		return nil, err
+	}
+	view.records = records
+
+	// one zone per line: origin and master file
+	for _, line := range filter(section.Key("zones").Strings("\n"), isNotEmpty) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("zone %q: expected an origin and a file", line)
+		}
+		zone, err := loadZone(fields[1], fields[0])
+		if err != nil {
+			return nil, err
+		}
+		view.zones = append(view.zones, zone)
+	}
+	return view, nil
+}
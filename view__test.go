@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViewSelection(t *testing.T) {
+	config := testConfig(t, `
+[view.internal]
+networks = 10.0.0.0/8
+records = app.example.com 10.0.0.10
+
+[view.vpn]
+networks = 10.8.0.0/24
+records = app.example.com 10.8.0.1
+`)
+	assert.Equal(t, "internal", config.view(net.ParseIP("10.1.2.3")).name)
+	assert.Equal(t, "vpn", config.view(net.ParseIP("10.8.0.7")).name)
+	assert.Nil(t, config.view(net.ParseIP("203.0.113.5")))
+	assert.Nil(t, config.view(nil))
+
+	_, err := parseConfig(loadIni(t, "[view.empty]\nrecords = app.example.com 10.0.0.10"))
+	assert.Error(t, err)
+}
+
+func TestSplitHorizonAnswers(t *testing.T) {
+	upstream := startUpstream(t, func(request DnsRequest) DnsPacket {
+		return addressResponse(request, 60, []net.IP{net.ParseIP("198.51.100.1")})
+	})
+	config := testConfig(t, `nameserver = `+upstream+`
+
+[view.internal]
+networks = 10.0.0.0/8
+records = app.example.com 10.0.0.10
+
+[view.vpn]
+networks = 10.8.0.0/24
+records = app.example.com 10.8.0.1
+`)
+	request := EncodeRequest(testRequest("app.example.com", TypeA))
+	for client, expected := range map[string]net.IP{
+		"10.1.2.3":    {10, 0, 0, 10},
+		"10.8.0.7":    {10, 8, 0, 1},
+		"203.0.113.5": {198, 51, 100, 1},
+	} {
+		packet, err := process(request, nil, udpAddr(client), config)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, net.IP(DecodePacket(packet).answers[0].rdata), client)
+	}
+}
+
+func TestViewZones(t *testing.T) {
+	dir := t.TempDir()
+	internal := filepath.Join(dir, "internal.zone")
+	assert.NoError(t, os.WriteFile(internal, []byte("$ORIGIN corp.internal.\n@ SOA ns hostmaster 1 3600 600 86400 300\nwww A 10.0.0.80\n"), 0o644))
+	public := filepath.Join(dir, "public.zone")
+	assert.NoError(t, os.WriteFile(public, []byte("$ORIGIN corp.internal.\n@ SOA ns hostmaster 1 3600 600 86400 300\nwww A 203.0.113.80\n"), 0o644))
+	config := testConfig(t, "[zone.corp.internal]\nfile = "+public+"\n\n[view.internal]\nnetworks = 10.0.0.0/8\nzones = corp.internal "+internal)
+
+	request := EncodeRequest(testRequest("www.corp.internal", TypeA))
+	packet, err := process(request, nil, udpAddr("10.0.0.5"), config)
+	assert.NoError(t, err)
+	assert.Equal(t, net.IP{10, 0, 0, 80}, net.IP(DecodePacket(packet).answers[0].rdata))
+
+	packet, err = process(request, nil, udpAddr("192.0.2.5"), config)
+	assert.NoError(t, err)
+	assert.Equal(t, net.IP{203, 0, 113, 80}, net.IP(DecodePacket(packet).answers[0].rdata))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// See also: https://datatracker.ietf.org/doc/html/rfc1034#section-4.3.2
+// and https://datatracker.ietf.org/doc/html/rfc4592 for wildcards
+
+const maxCnameHops = 16
+
+// Zone answers authoritatively for the names of a zone loaded from a master file.
+type Zone struct {
+	origin           string
+	updateKeys       []string // TSIG keys allowed to update the zone, see update.go
+	journal          string   // file of the changes made by updates
+	transferNetworks []*net.IPNet
+	transferKeys     []string // TSIG keys required to transfer the zone, see transfer.go
+	secondaries      []string // name servers notified of the changes
+	primaries        []string // name servers the zone is transferred from, see secondary.go
+	primaryKey       *TsigKey
+	notified         chan bool
+
+	mutex     sync.RWMutex
+	soa       DnsAnswer
+	records   map[string][]DnsAnswer // owner to records
+	names     map[string]bool        // the owners and the empty non-terminals above them
+	changes   []*ZoneChange          // the latest changes, oldest first
+	refreshed time.Time              // when the primaries last answered
+	expired   bool
+}
+
+func loadZone(path string, origin string) (*Zone, error) {
+	records, err := parseZoneFile(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	return newZone(origin, records)
+}
+
+func newZone(origin string, records []DnsAnswer) (*Zone, error) {
+	zone := &Zone{
+		origin:  normalizeName(origin),
+		records: make(map[string][]DnsAnswer),
+		names:   make(map[string]bool),
+	}
+	for _, record := range records {
+		if !zone.contains(record.name) {
+			return nil, fmt.Errorf("%s is outside of the zone %s", record.name, zone.origin)
+		}
+		if record.atype == TypeSOA {
+			if record.name != zone.origin || zone.soa.rdata != nil {
+				return nil, fmt.Errorf("a single SOA record is expected at the apex of %s", zone.origin)
+			}
+			zone.soa = record
+		}
+		zone.add(record)
+	}
+	if zone.soa.rdata == nil {
+		return nil, fmt.Errorf("zone %s without SOA record", zone.origin)
+	}
+	for owner, records := range zone.records {
+		if findRecord(records, TypeCNAME) != nil && len(records) > 1 {
+			return nil, fmt.Errorf("%s has a CNAME and other records", owner)
+		}
+	}
+	return zone, nil
+}
+
+func (zone *Zone) add(record DnsAnswer) {
+	zone.records[record.name] = append(zone.records[record.name], record)
+	zone.addName(record.name)
+}
+
+func (zone *Zone) addName(owner string) {
+	for name := owner; !zone.names[name]; name = parentName(name) {
+		zone.names[name] = true
+		if name == zone.origin {
+			break
+		}
+	}
+}
+
+// reindex rebuilds the names after records were removed.
+func (zone *Zone) reindex() {
+	zone.names = make(map[string]bool)
+	for owner := range zone.records {
+		zone.addName(owner)
+	}
+}
+
+// contains tells whether the name is the origin of the zone or below it.
+func (zone *Zone) contains(name string) bool {
+	return isSubdomain(strings.ToLower(name), zone.origin)
+}
+
+// findZone returns the closest zone containing the name.
+func findZone(zones []*Zone, name string) *Zone {
+	var closest *Zone
+	for _, zone := range zones {
+		if zone.contains(name) && (closest == nil || len(zone.origin) > len(closest.origin)) {
+			closest = zone
+		}
+	}
+	return closest
+}
+
+// answer follows the algorithm of RFC 1034: referrals below zone cuts, CNAME chains inside
+// the zone, wildcard synthesis, and NXDOMAIN or NODATA with the SOA for negative caching.
+func (zone *Zone) answer(request DnsRequest) DnsPacket {
+	zone.mutex.RLock()
+	defer zone.mutex.RUnlock()
+
+	if zone.soa.rdata == nil || zone.expired {
+		// a secondary zone before its first transfer or expired
+		return newResponse(request, RcodeServerFailure)
+	}
+	response := newResponse(request, RcodeSuccess)
+	response.header.aa = true
+	name := strings.ToLower(request.question.qname)
+	qtype := request.question.qtype
+
+	for hops := 0; hops < maxCnameHops; hops++ {
+		if cut := zone.delegation(name, qtype); cut != nil {
+			// a referral is not authoritative, unless a CNAME of the zone led to it
+			response.header.aa = len(response.answers) > 0
+			response.authorities = cut
+			response.additionals = zone.glue(cut)
+			return response
+		}
+
+		records, exists := zone.lookup(name)
+		if !exists {
+			response.header.rcode = RcodeNameError
+			response.authorities = []DnsAnswer{zone.negativeSoa()}
+			return response
+		}
+		if cname := findRecord(records, TypeCNAME); cname != nil && qtype != TypeCNAME && qtype != TypeANY {
+			response.answers = append(response.answers, *cname)
+			target, _ := DecodeNameAt(cname.rdata, 0)
+			if !zone.contains(target) {
+				return response
+			}
+			name = target
+			continue
+		}
+
+		var answers []DnsAnswer
+		for _, record := range records {
+			if record.atype == qtype || qtype == TypeANY {
+				answers = append(answers, record)
+			}
+		}
+		if len(answers) == 0 {
+			response.authorities = []DnsAnswer{zone.negativeSoa()}
+		}
+		response.answers = append(response.answers, answers...)
+		return response
+	}
+	response.header.rcode = RcodeServerFailure
+	return response
+}
+
+// lookup returns the records of a name, synthesized from the wildcard of its closest encloser
+// when the name does not exist. An empty non-terminal exists without records.
+func (zone *Zone) lookup(name string) ([]DnsAnswer, bool) {
+	if zone.names[name] {
+		return zone.records[name], true
+	}
+	encloser := name
+	for encloser != zone.origin {
+		encloser = parentName(encloser)
+		if zone.names[encloser] {
+			break
+		}
+	}
+	wildcard, ok := zone.records["*."+encloser]
+	if !ok {
+		return nil, false
+	}
+	synthesized := make([]DnsAnswer, len(wildcard))
+	for i, record := range wildcard {
+		record.name = name
+		synthesized[i] = record
+	}
+	return synthesized, true
+}
+
+// delegation returns the NS records of the zone cut closest to the origin between
+// the origin and the name. The parent side answers DS queries at the cut.
+func (zone *Zone) delegation(name string, qtype uint16) []DnsAnswer {
+	labels := strings.Split(strings.TrimSuffix(name, "."+zone.origin), ".")
+	if name == zone.origin {
+		return nil
+	}
+	for i := len(labels) - 1; i >= 0; i-- {
+		cut := strings.Join(labels[i:], ".") + "." + zone.origin
+		if cut == name && qtype == TypeDS {
+			return nil
+		}
+		var servers []DnsAnswer
+		for _, record := range zone.records[cut] {
+			if record.atype == TypeNS {
+				servers = append(servers, record)
+			}
+		}
+		if len(servers) > 0 {
+			return servers
+		}
+	}
+	return nil
+}
+
+// glue returns the addresses of the name servers which the zone knows.
+func (zone *Zone) glue(servers []DnsAnswer) []DnsAnswer {
+	var glue []DnsAnswer
+	for _, server := range servers {
+		target, _ := DecodeNameAt(server.rdata, 0)
+		for _, record := range zone.records[target] {
+			if record.atype == TypeA || record.atype == TypeAAAA {
+				glue = append(glue, record)
+			}
+		}
+	}
+	return glue
+}
+
+// negativeSoa is the SOA of negative answers, its TTL is the lesser of its own and its minimum field.
+func (zone *Zone) negativeSoa() DnsAnswer {
+	soa := zone.soa
+	if minimum := binary.BigEndian.Uint32(soa.rdata[len(soa.rdata)-4:]); minimum < soa.ttl {
+		soa.ttl = minimum
+	}
+	return soa
+}
+
+func findRecord(records []DnsAnswer, rtype uint16) *DnsAnswer {
+	for i := range records {
+		if records[i].atype == rtype {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+func parentName(name string) string {
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		return name[dot+1:]
+	}
+	return ""
+}
+
+func isSubdomain(name string, parent string) bool {
+	return parent == "" || name == parent || strings.HasSuffix(name, "."+parent)
+}
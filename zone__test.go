@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const corpZone = `
+$ORIGIN corp.internal.
+$TTL 3600
+@         SOA   ns1 hostmaster 2026101901 3600 600 86400 300
+          NS    ns1
+ns1       A     10.0.0.53
+www       A     10.0.0.80
+          AAAA  fd00::80
+intranet  CNAME www
+alias     CNAME intranet
+outside   CNAME www.example.com.
+loop      CNAME loop
+*.apps    A     10.0.0.90
+a.b.deep  TXT   "leaf"
+lab       NS    ns.lab
+ns.lab    A     10.0.1.53
+`
+
+func testZone(t *testing.T) *Zone {
+	records, err := parseZone(strings.NewReader(corpZone), "")
+	assert.NoError(t, err)
+	zone, err := newZone("corp.internal", records)
+	assert.NoError(t, err)
+	return zone
+}
+
+func TestZoneAnswers(t *testing.T) {
+	zone := testZone(t)
+
+	response := zone.answer(testRequest("WWW.corp.internal", TypeA))
+	assert.True(t, response.header.aa)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Len(t, response.answers, 1)
+
+	response = zone.answer(testRequest("www.corp.internal", TypeANY))
+	assert.Len(t, response.answers, 2)
+
+	response = zone.answer(testRequest("corp.internal", TypeNS))
+	assert.True(t, response.header.aa)
+	assert.Len(t, response.answers, 1)
+}
+
+func TestZoneNegativeAnswers(t *testing.T) {
+	zone := testZone(t)
+
+	response := zone.answer(testRequest("missing.corp.internal", TypeA))
+	assert.Equal(t, RcodeNameError, response.header.rcode)
+	assert.True(t, response.header.aa)
+	assert.Equal(t, TypeSOA, response.authorities[0].atype)
+	assert.Equal(t, uint32(300), response.authorities[0].ttl)
+
+	response = zone.answer(testRequest("www.corp.internal", TypeMX))
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Empty(t, response.answers)
+	assert.Equal(t, TypeSOA, response.authorities[0].atype)
+
+	// empty non-terminal
+	response = zone.answer(testRequest("b.deep.corp.internal", TypeA))
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+	assert.Empty(t, response.answers)
+}
+
+func TestZoneCnameChains(t *testing.T) {
+	zone := testZone(t)
+
+	response := zone.answer(testRequest("alias.corp.internal", TypeA))
+	assert.Len(t, response.answers, 3)
+	assert.Equal(t, []uint16{TypeCNAME, TypeCNAME, TypeA}, []uint16{response.answers[0].atype, response.answers[1].atype, response.answers[2].atype})
+
+	response = zone.answer(testRequest("outside.corp.internal", TypeA))
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, TypeCNAME, response.answers[0].atype)
+
+	response = zone.answer(testRequest("intranet.corp.internal", TypeCNAME))
+	assert.Len(t, response.answers, 1)
+
+	response = zone.answer(testRequest("loop.corp.internal", TypeA))
+	assert.Equal(t, RcodeServerFailure, response.header.rcode)
+}
+
+func TestZoneWildcards(t *testing.T) {
+	zone := testZone(t)
+
+	response := zone.answer(testRequest("crm.apps.corp.internal", TypeA))
+	assert.Len(t, response.answers, 1)
+	assert.Equal(t, "crm.apps.corp.internal", response.answers[0].name)
+
+	// the wildcard covers names below its closest encloser only
+	response = zone.answer(testRequest("x.crm.apps.corp.internal", TypeA))
+	assert.Len(t, response.answers, 1)
+	response = zone.answer(testRequest("apps.corp.internal", TypeA))
+	assert.Empty(t, response.answers)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+
+	response = zone.answer(testRequest("crm.apps.corp.internal", TypeAAAA))
+	assert.Empty(t, response.answers)
+	assert.Equal(t, RcodeSuccess, response.header.rcode)
+}
+
+func TestZoneDelegation(t *testing.T) {
+	zone := testZone(t)
+
+	response := zone.answer(testRequest("host.lab.corp.internal", TypeA))
+	assert.False(t, response.header.aa)
+	assert.Empty(t, response.answers)
+	assert.Len(t, response.authorities, 1)
+	assert.Equal(t, TypeNS, response.authorities[0].atype)
+	assert.Len(t, response.additionals, 1)
+	assert.Equal(t, "ns.lab.corp.internal", response.additionals[0].name)
+
+	response = zone.answer(testRequest("lab.corp.internal", TypeDS))
+	assert.True(t, response.header.aa)
+}
+
+func TestZoneValidation(t *testing.T) {
+	_, err := newZone("corp.internal", nil)
+	assert.EqualError(t, err, "zone corp.internal without SOA record")
+
+	records, _ := parseZone(strings.NewReader("$ORIGIN example.com.\n@ SOA ns hostmaster 1 1 1 1 1\n"), "")
+	_, err = newZone("corp.internal", records)
+	assert.EqualError(t, err, "example.com is outside of the zone corp.internal")
+
+	records, _ = parseZone(strings.NewReader("$ORIGIN corp.internal.\n@ SOA ns hostmaster 1 1 1 1 1\nwww CNAME a\nwww A 10.0.0.1\n"), "")
+	_, err = newZone("corp.internal", records)
+	assert.EqualError(t, err, "www.corp.internal has a CNAME and other records")
+}
+
+func TestZonesInProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corp.zone")
+	assert.NoError(t, os.WriteFile(path, []byte(corpZone), 0o644))
+	config := testConfig(t, "[zone.corp.internal]\nfile = "+path)
+
+	packet, err := process(EncodeRequest(testRequest("www.corp.internal", TypeA)), nil, nil, config)
+	assert.NoError(t, err)
+	response := DecodePacket(packet)
+	assert.True(t, response.header.aa)
+	assert.Len(t, response.answers, 1)
+	assert.Nil(t, findZone(config.zones, "example.com"))
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// See also: https://datatracker.ietf.org/doc/html/rfc1035#section-5
+
+const defaultZoneTTL = 3600
+
+const maxIncludeDepth = 8
+
+// zoneLine is a logical line of a master file: parentheses are joined, comments removed.
+type zoneLine struct {
+	tokens       []string
+	ownerOmitted bool // the line started with a blank, reusing the previous owner
+	number       int
+}
+
+type zoneParser struct {
+	origin  string
+	ttl     uint32
+	lastTTL uint32
+	hasTTL  bool
+	owner   string
+	path    string
+	depth   int
+	records []DnsAnswer
+}
+
+// parseZoneFile reads the records of a master file, names are returned absolute without the trailing dot.
+func parseZoneFile(path string, origin string) ([]DnsAnswer, error) {
+	parser := &zoneParser{origin: normalizeName(origin), ttl: defaultZoneTTL, lastTTL: defaultZoneTTL}
+	if err := parser.parseFile(path); err != nil {
+		return nil, err
+	}
+	return parser.records, nil
+}
+
+func parseZone(reader io.Reader, origin string) ([]DnsAnswer, error) {
+	parser := &zoneParser{origin: normalizeName(origin), ttl: defaultZoneTTL, lastTTL: defaultZoneTTL, path: "."}
+	if err := parser.parse(reader); err != nil {
+		return nil, err
+	}
+	return parser.records, nil
+}
+
+func (parser *zoneParser) parseFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	previous := parser.path
+	parser.path = path
+	defer func() { parser.path = previous }()
+	return parser.parse(file)
+}
+
+func (parser *zoneParser) parse(reader io.Reader) error {
+	lines, err := readZoneLines(reader)
+	if err != nil {
+		return fmt.Errorf("%s: %v", parser.path, err)
+	}
+	for _, line := range lines {
+		if err := parser.parseLine(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", parser.path, line.number, err)
+		}
+	}
+	return nil
+}
+
+func (parser *zoneParser) parseLine(line zoneLine) error {
+	tokens := line.tokens
+	switch strings.ToUpper(tokens[0]) {
+	case "$ORIGIN":
+		if len(tokens) < 2 {
+			return fmt.Errorf("$ORIGIN without a name")
+		}
+		parser.origin = parser.absoluteName(tokens[1])
+		return nil
+	case "$TTL":
+		if len(tokens) < 2 {
+			return fmt.Errorf("$TTL without a value")
+		}
+		ttl, err := parseTTL(tokens[1])
+		if err != nil {
+			return err
+		}
+		parser.ttl, parser.hasTTL = ttl, true
+		return nil
+	case "$INCLUDE":
+		return parser.include(tokens[1:])
+	}
+
+	if !line.ownerOmitted {
+		parser.owner = parser.absoluteName(tokens[0])
+		tokens = tokens[1:]
+	}
+
+	ttl := parser.lastTTL
+	if parser.hasTTL {
+		ttl = parser.ttl
+	}
+	class := ClassIN
+	// TTL and class may come in any order before the type
+	for len(tokens) > 0 {
+		if value, err := parseTTL(tokens[0]); err == nil {
+			ttl = value
+			parser.lastTTL = value
+		} else if strings.EqualFold(tokens[0], "IN") {
+			class = ClassIN
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("missing record type")
+	}
+
+	rtype, err := parseType(tokens[0])
+	if err != nil {
+		return err
+	}
+	rdata, err := parser.encodeRdata(rtype, tokens[1:])
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", parser.owner, tokens[0], err)
+	}
+	parser.records = append(parser.records, DnsAnswer{
+		name:   parser.owner,
+		atype:  rtype,
+		aclass: class,
+		ttl:    ttl,
+		rdata:  rdata,
+	})
+	return nil
+}
+
+func (parser *zoneParser) include(arguments []string) error {
+	if len(arguments) == 0 {
+		return fmt.Errorf("$INCLUDE without a file name")
+	}
+	if parser.depth >= maxIncludeDepth {
+		return fmt.Errorf("$INCLUDE nested too deeply")
+	}
+	path := arguments[0]
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(parser.path), path)
+	}
+	origin, owner := parser.origin, parser.owner
+	if len(arguments) > 1 {
+		parser.origin = parser.absoluteName(arguments[1])
+	}
+	parser.depth++
+	err := parser.parseFile(path)
+	parser.depth--
+	parser.origin, parser.owner = origin, owner
+	return err
+}
+
+// absoluteName resolves "@" and names relative to the origin.
+func (parser *zoneParser) absoluteName(name string) string {
+	if name == "@" {
+		return parser.origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return strings.ToLower(strings.TrimSuffix(name, "."))
+	}
+	if parser.origin == "" {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name) + "." + parser.origin
+}
+
+func (parser *zoneParser) encodeRdata(rtype uint16, fields []string) ([]byte, error) {
+	if len(fields) >= 2 && fields[0] == `\#` {
+		// generic notation of RFC 3597: \# length hex
+		return hex.DecodeString(strings.Join(fields[2:], ""))
+	}
+	switch rtype {
+	case TypeA, TypeAAAA:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("expected an address")
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || (rtype == TypeA) != (ip.To4() != nil) {
+			return nil, fmt.Errorf("invalid address %q", fields[0])
+		}
+		return addressRecord("", 0, ip).rdata, nil
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("expected a name")
+		}
+		return EncodeName(parser.absoluteName(fields[0])), nil
+	case TypeMX:
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("expected a preference and a name")
+		}
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, 2)
+		binary.BigEndian.PutUint16(data, uint16(preference))
+		return append(data, EncodeName(parser.absoluteName(fields[1]))...), nil
+	case TypeSRV:
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("expected priority, weight, port and target")
+		}
+		data := make([]byte, 6)
+		for i := 0; i < 3; i++ {
+			value, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint16(data[i*2:], uint16(value))
+		}
+		return append(data, EncodeName(parser.absoluteName(fields[3]))...), nil
+	case TypeTXT:
+		var data []byte
+		for _, text := range fields {
+			if len(text) > 255 {
+				return nil, fmt.Errorf("text longer than 255 characters")
+			}
+			data = append(append(data, byte(len(text))), text...)
+		}
+		return data, nil
+	case TypeSOA:
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("expected mname, rname, serial, refresh, retry, expire and minimum")
+		}
+		var timers [5]uint32
+		for i := range timers {
+			value, err := parseTTL(fields[2+i])
+			if err != nil {
+				return nil, err
+			}
+			timers[i] = value
+		}
+		return EncodeSoaData(SoaData{
+			mname:   parser.absoluteName(fields[0]),
+			rname:   parser.absoluteName(fields[1]),
+			serial:  timers[0],
+			refresh: timers[1],
+			retry:   timers[2],
+			expire:  timers[3],
+			minimum: timers[4],
+		}), nil
+	}
+	return nil, fmt.Errorf("unsupported record type, use the \\# notation")
+}
+
+// parseTTL reads a number of seconds, also accepting the units of BIND such as 1h30m or 1w.
+func parseTTL(value string) (uint32, error) {
+	if number, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(number), nil
+	}
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total, number uint64
+	digits := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= '0' && c <= '9' {
+			number = number*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		unit, ok := units[c|0x20]
+		if !ok || !digits {
+			return 0, fmt.Errorf("invalid TTL %q", value)
+		}
+		total += number * unit
+		number, digits = 0, false
+	}
+	if digits || total > 0xffffffff {
+		return 0, fmt.Errorf("invalid TTL %q", value)
+	}
+	return uint32(total), nil
+}
+
+// readZoneLines splits a master file into logical lines of tokens.
+func readZoneLines(reader io.Reader) ([]zoneLine, error) {
+	var lines []zoneLine
+	var current zoneLine
+	depth := 0
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := scanner.Text()
+		if depth == 0 {
+			current = zoneLine{number: number, ownerOmitted: len(text) > 0 && (text[0] == ' ' || text[0] == '\t')}
+		}
+		for i := 0; i < len(text); {
+			c := text[i]
+			switch {
+			case c == ';':
+				i = len(text)
+			case c == ' ' || c == '\t' || c == '\r':
+				i++
+			case c == '(':
+				depth++
+				i++
+			case c == ')':
+				if depth == 0 {
+					return nil, fmt.Errorf("line %d: unbalanced parenthesis", number)
+				}
+				depth--
+				i++
+			case c == '"':
+				end := i + 1
+				var sb strings.Builder
+				for end < len(text) && text[end] != '"' {
+					if text[end] == '\\' && end+1 < len(text) {
+						end++
+					}
+					sb.WriteByte(text[end])
+					end++
+				}
+				if end == len(text) {
+					return nil, fmt.Errorf("line %d: unterminated string", number)
+				}
+				current.tokens = append(current.tokens, sb.String())
+				i = end + 1
+			default:
+				end := i
+				for end < len(text) && !strings.ContainsRune(" \t\r;()\"", rune(text[end])) {
+					end++
+				}
+				current.tokens = append(current.tokens, text[i:end])
+				i = end
+			}
+		}
+		if depth == 0 && len(current.tokens) > 0 {
+			lines = append(lines, current)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parenthesis at end of file")
+	}
+	return lines, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseZone(t *testing.T) {
+	records, err := parseZone(strings.NewReader(`
+$ORIGIN corp.internal.
+$TTL 1h
+@   IN  SOA ns1 hostmaster (
+            2026101901 ; serial
+            3600 900 1w 300 )
+        NS  ns1
+ns1     A   10.0.0.53
+www 60  IN  CNAME web.corp.internal.
+web     A   10.0.0.80
+        AAAA fd00::80
+txt     TXT "hello world" "second"
+`), "")
+	assert.NoError(t, err)
+	assert.Len(t, records, 7)
+
+	assert.Equal(t, "corp.internal", records[0].name)
+	assert.Equal(t, TypeSOA, records[0].atype)
+	assert.Equal(t, uint32(3600), records[0].ttl)
+
+	assert.Equal(t, "corp.internal", records[1].name)
+	assert.Equal(t, TypeNS, records[1].atype)
+
+	assert.Equal(t, "www.corp.internal", records[3].name)
+	assert.Equal(t, uint32(60), records[3].ttl)
+	target, _ := DecodeNameAt(records[3].rdata, 0)
+	assert.Equal(t, "web.corp.internal", target)
+
+	assert.Equal(t, "web.corp.internal", records[5].name)
+	assert.Equal(t, TypeAAAA, records[5].atype)
+
+	assert.Equal(t, append([]byte("\x0bhello world"), "\x06second"...), records[6].rdata)
+}
+
+func TestParseZoneInclude(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "hosts.inc"), []byte("printer A 10.0.0.9\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "zone"), []byte(`
+$TTL 300
+$INCLUDE hosts.inc lan.
+nas.lan. A 10.0.0.10
+`), 0o644))
+
+	records, err := parseZoneFile(filepath.Join(dir, "zone"), "")
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "printer.lan", records[0].name)
+	assert.Equal(t, uint32(300), records[0].ttl)
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	_, err := parseZone(strings.NewReader("www A 10.0.0.1 (\n"), "lan")
+	assert.Error(t, err)
+
+	_, err = parseZone(strings.NewReader("www A fd00::1\n"), "lan")
+	assert.Error(t, err)
+}
+
+func TestParseTTL(t *testing.T) {
+	for value, expected := range map[string]uint32{"300": 300, "1h": 3600, "1h30m": 5400, "1W": 604800} {
+		ttl, err := parseTTL(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, ttl)
+	}
+	_, err := parseTTL("1x")
+	assert.Error(t, err)
+}